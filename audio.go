@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// WAV and FLAC files are read and written without external tools. The
+// signature is added to the tags that players show and keep: the comment of
+// the INFO list of WAV files and a Vorbis comment of FLAC files.
+var audioDecoders = map[string]func([]byte) (*pcmAudio, error){
+	".wav":  readWAV,
+	".flac": readFLAC,
+}
+
+var audioEncoders = map[string]func([]byte, *pcmAudio) ([]byte, error){
+	".wav":  writeWAV,
+	".flac": writeFLAC,
+}
+
+var audioMetadataWriters = map[string]func([]byte, string) ([]byte, error){
+	".wav":  addWAVInfo,
+	".flac": addFLACComment,
+}
+
+var audioMetadataReaders = map[string]func([]byte) []string{
+	".wav":  readWAVInfo,
+	".flac": readFLACComments,
+}
+
+// Leaked recordings are often converted to a compressed format. These are
+// decoded with ffmpeg, if it's installed, to look for the watermark.
+var compressedAudioExtensions = map[string]bool{
+	".mp3":  true,
+	".m4a":  true,
+	".aac":  true,
+	".ogg":  true,
+	".opus": true,
+	".wma":  true,
+}
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+	wavCommentID        = "ICMT"
+	flacCommentField    = "COMMENT"
+	ffmpegSampleRate    = 44100
+)
+
+// pcmAudio holds the samples of a recording, one slice per channel. Samples
+// of integer formats are whole numbers in the range of the format, samples of
+// floating point formats are between -1 and 1.
+type pcmAudio struct {
+	rate     int
+	bits     int
+	float    bool
+	channels [][]float32
+}
+
+func (a *pcmAudio) fullScale() float64 {
+	if a.float {
+		return 1
+	}
+	return math.Ldexp(1, a.bits-1)
+}
+
+func isAudioFile(extension string) bool {
+	_, found := audioDecoders[strings.ToLower(extension)]
+	return found
+}
+
+func isCompressedAudio(extension string) bool {
+	return compressedAudioExtensions[strings.ToLower(extension)]
+}
+
+func addAudioMetadata(file, signature string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	content, err = audioMetadataWriters[strings.ToLower(filepath.Ext(file))](content, signature)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+func detectAudioMetadata(file, signature string) bool {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	read, found := audioMetadataReaders[strings.ToLower(filepath.Ext(file))]
+	if !found {
+		return false
+	}
+	for _, value := range read(content) {
+		if strings.Contains(value, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeAudioFile returns the samples of a WAV or FLAC file, or of another
+// audio file decoded by ffmpeg to mono.
+func decodeAudioFile(file string) (*pcmAudio, error) {
+	extension := strings.ToLower(filepath.Ext(file))
+	if decode, found := audioDecoders[extension]; found {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return decode(content)
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg is required for reading %s files", extension)
+	}
+	out, err := exec.Command(ffmpeg, "-v", "quiet", "-i", file, "-ac", "1", "-ar", fmt.Sprint(ffmpegSampleRate), "-f", "s16le", "-").Output()
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]float32, len(out)/2)
+	for i := range samples {
+		samples[i] = float32(int16(binary.LittleEndian.Uint16(out[2*i:])))
+	}
+	return &pcmAudio{rate: ffmpegSampleRate, bits: 16, channels: [][]float32{samples}}, nil
+}
+
+// riffChunks returns the chunks of a RIFF file of the form. The data chunk of
+// a WAV file that was cut off is shortened to the end of the file.
+func riffChunks(content []byte, form string) ([]riffChunk, error) {
+	if len(content) < 12 || string(content[:4]) != "RIFF" || string(content[8:12]) != form {
+		return nil, fmt.Errorf("not a %s file", form)
+	}
+	var chunks []riffChunk
+	for i := 12; i+8 <= len(content); {
+		size := int(binary.LittleEndian.Uint32(content[i+4:]))
+		if size < 0 || i+8+size > len(content) {
+			if string(content[i:i+4]) != "data" || form != "WAVE" {
+				return nil, fmt.Errorf("invalid %s chunk", form)
+			}
+			size = len(content) - i - 8
+		}
+		chunks = append(chunks, riffChunk{string(content[i : i+4]), content[i+8 : i+8+size]})
+		i += 8 + size + size%2
+	}
+	return chunks, nil
+}
+
+func writeRIFF(form string, chunks []riffChunk) []byte {
+	out := []byte("RIFF\x00\x00\x00\x00" + form)
+	for _, chunk := range chunks {
+		start := len(out)
+		out = append(append(out, chunk.kind...), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(out[start+4:], uint32(len(chunk.data)))
+		out = append(out, chunk.data...)
+		if len(chunk.data)%2 == 1 {
+			out = append(out, 0)
+		}
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
+
+// wavData returns the format and the sample data of a WAV file.
+func wavData(chunks []riffChunk) (format, channels, rate, bits int, data []byte, err error) {
+	for _, chunk := range chunks {
+		switch chunk.kind {
+		case "fmt ":
+			if len(chunk.data) < 16 {
+				return 0, 0, 0, 0, nil, fmt.Errorf("invalid WAV format")
+			}
+			format = int(binary.LittleEndian.Uint16(chunk.data))
+			channels = int(binary.LittleEndian.Uint16(chunk.data[2:]))
+			rate = int(binary.LittleEndian.Uint32(chunk.data[4:]))
+			bits = int(binary.LittleEndian.Uint16(chunk.data[14:]))
+			if format == wavFormatExtensible && len(chunk.data) >= 26 {
+				format = int(binary.LittleEndian.Uint16(chunk.data[24:]))
+			}
+		case "data":
+			data = chunk.data
+		}
+	}
+	switch {
+	case channels == 0 || data == nil:
+		err = fmt.Errorf("invalid WAV file")
+	case format == wavFormatPCM && (bits == 8 || bits == 16 || bits == 24 || bits == 32):
+	case format == wavFormatFloat && (bits == 32 || bits == 64):
+	default:
+		err = fmt.Errorf("unsupported WAV format")
+	}
+	return
+}
+
+func readWAV(content []byte) (*pcmAudio, error) {
+	chunks, err := riffChunks(content, "WAVE")
+	if err != nil {
+		return nil, err
+	}
+	format, channels, rate, bits, data, err := wavData(chunks)
+	if err != nil {
+		return nil, err
+	}
+	audio := &pcmAudio{rate: rate, bits: bits, float: format == wavFormatFloat, channels: make([][]float32, channels)}
+	width := bits / 8
+	count := len(data) / (width * channels)
+	for c := range audio.channels {
+		samples := make([]float32, count)
+		for i := range samples {
+			at := (i*channels + c) * width
+			switch {
+			case bits == 8:
+				samples[i] = float32(int(data[at]) - 128)
+			case bits == 16:
+				samples[i] = float32(int16(binary.LittleEndian.Uint16(data[at:])))
+			case bits == 24:
+				samples[i] = float32(int32(uint32(data[at])<<8|uint32(data[at+1])<<16|uint32(data[at+2])<<24) >> 8)
+			case audio.float && bits == 32:
+				samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[at:]))
+			case audio.float:
+				samples[i] = float32(math.Float64frombits(binary.LittleEndian.Uint64(data[at:])))
+			default:
+				samples[i] = float32(int32(binary.LittleEndian.Uint32(data[at:])))
+			}
+		}
+		audio.channels[c] = samples
+	}
+	return audio, nil
+}
+
+// writeWAV writes the samples over the sample data of a WAV file in place,
+// which keeps its other chunks. The samples are clipped to the range of the
+// format.
+func writeWAV(content []byte, audio *pcmAudio) ([]byte, error) {
+	chunks, err := riffChunks(content, "WAVE")
+	if err != nil {
+		return nil, err
+	}
+	_, channels, _, bits, data, err := wavData(chunks)
+	if err != nil {
+		return nil, err
+	}
+	if channels != len(audio.channels) || bits != audio.bits {
+		return nil, fmt.Errorf("the format of the samples doesn't match the WAV file")
+	}
+	width := bits / 8
+	limit := audio.fullScale()
+	for c, samples := range audio.channels {
+		for i, sample := range samples {
+			at := (i*channels + c) * width
+			if at+width > len(data) {
+				break
+			}
+			if audio.float {
+				if bits == 32 {
+					binary.LittleEndian.PutUint32(data[at:], math.Float32bits(sample))
+				} else {
+					binary.LittleEndian.PutUint64(data[at:], math.Float64bits(float64(sample)))
+				}
+				continue
+			}
+			v := int64(math.Max(-limit, math.Min(limit-1, math.Round(float64(sample)))))
+			switch bits {
+			case 8:
+				data[at] = byte(v + 128)
+			case 16:
+				binary.LittleEndian.PutUint16(data[at:], uint16(v))
+			case 24:
+				data[at], data[at+1], data[at+2] = byte(v), byte(v>>8), byte(v>>16)
+			default:
+				binary.LittleEndian.PutUint32(data[at:], uint32(v))
+			}
+		}
+	}
+	return content, nil
+}
+
+// wavInfo returns the entries of the INFO list of a WAV file.
+func wavInfo(list []byte) []riffChunk {
+	var entries []riffChunk
+	for i := 4; i+8 <= len(list); {
+		size := int(binary.LittleEndian.Uint32(list[i+4:]))
+		if i+8+size > len(list) {
+			break
+		}
+		entries = append(entries, riffChunk{string(list[i : i+4]), list[i+8 : i+8+size]})
+		i += 8 + size + size%2
+	}
+	return entries
+}
+
+// addWAVInfo adds the signature to the comment in the INFO list of a WAV
+// file. The list is created before the sample data if the file has none.
+func addWAVInfo(content []byte, signature string) ([]byte, error) {
+	chunks, err := riffChunks(content, "WAVE")
+	if err != nil {
+		return nil, err
+	}
+	list := -1
+	for i, chunk := range chunks {
+		if chunk.kind == "LIST" && bytes.HasPrefix(chunk.data, []byte("INFO")) {
+			list = i
+			break
+		}
+	}
+	var entries []riffChunk
+	if list >= 0 {
+		entries = wavInfo(chunks[list].data)
+	}
+	found := false
+	for i, entry := range entries {
+		if entry.kind == wavCommentID {
+			comment := strings.TrimRight(string(entry.data), "\x00")
+			entries[i].data = []byte(strings.TrimSpace(comment+" "+signature) + "\x00")
+			found = true
+		}
+	}
+	if !found {
+		entries = append(entries, riffChunk{wavCommentID, []byte(signature + "\x00")})
+	}
+	info := writeRIFF("INFO", entries)[8:]
+	if list >= 0 {
+		chunks[list].data = info
+	} else {
+		for i, chunk := range chunks {
+			if chunk.kind == "data" {
+				chunks = append(chunks[:i], append([]riffChunk{{"LIST", info}}, chunks[i:]...)...)
+				break
+			}
+		}
+	}
+	return writeRIFF("WAVE", chunks), nil
+}
+
+func readWAVInfo(content []byte) []string {
+	chunks, err := riffChunks(content, "WAVE")
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, chunk := range chunks {
+		if chunk.kind == "LIST" && bytes.HasPrefix(chunk.data, []byte("INFO")) {
+			for _, entry := range wavInfo(chunk.data) {
+				values = append(values, strings.TrimRight(string(entry.data), "\x00"))
+			}
+		}
+	}
+	return values
+}
+
+// vorbisComments returns the vendor string and the fields of a Vorbis comment
+// block.
+func vorbisComments(data []byte) (string, []string, error) {
+	if len(data) < 8 {
+		return "", nil, fmt.Errorf("invalid Vorbis comment")
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	if 4+size+4 > len(data) {
+		return "", nil, fmt.Errorf("invalid Vorbis comment")
+	}
+	vendor := string(data[4 : 4+size])
+	count := int(binary.LittleEndian.Uint32(data[4+size:]))
+	var fields []string
+	for i, at := 0, 8+size; i < count; i++ {
+		if at+4 > len(data) {
+			return "", nil, fmt.Errorf("invalid Vorbis comment")
+		}
+		size := int(binary.LittleEndian.Uint32(data[at:]))
+		if at+4+size > len(data) {
+			return "", nil, fmt.Errorf("invalid Vorbis comment")
+		}
+		fields = append(fields, string(data[at+4:at+4+size]))
+		at += 4 + size
+	}
+	return vendor, fields, nil
+}
+
+// addFLACComment adds the signature as a COMMENT field to the Vorbis comment
+// block of a FLAC file, or adds the block.
+func addFLACComment(content []byte, signature string) ([]byte, error) {
+	blocks, start, offset, err := flacMetadata(content)
+	if err != nil {
+		return nil, err
+	}
+	vendor, fields, comments := "wholeaked", []string(nil), -1
+	for i, block := range blocks {
+		if block.kind == flacVorbisComment {
+			if vendor, fields, err = vorbisComments(block.data); err != nil {
+				return nil, err
+			}
+			comments = i
+		}
+	}
+	fields = append(fields, flacCommentField+"="+signature)
+	data := vorbisString(nil, vendor)
+	data = append(data, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(data[len(data)-4:], uint32(len(fields)))
+	for _, field := range fields {
+		data = vorbisString(data, field)
+	}
+	if comments >= 0 {
+		blocks[comments].data = data
+	} else {
+		blocks = append(blocks[:1], append([]flacBlock{{flacVorbisComment, data}}, blocks[1:]...)...)
+	}
+	return concat(content[:start], writeFLACMetadata(blocks), content[offset:]), nil
+}
+
+func vorbisString(out []byte, value string) []byte {
+	out = append(out, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[len(out)-4:], uint32(len(value)))
+	return append(out, value...)
+}
+
+func readFLACComments(content []byte) []string {
+	blocks, _, _, err := flacMetadata(content)
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, block := range blocks {
+		if block.kind == flacVorbisComment {
+			if _, fields, err := vorbisComments(block.data); err == nil {
+				values = append(values, fields...)
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Tags and appended data are lost when a recording is converted to MP3 or
+// cut. The audio watermark is a spread spectrum pattern in the loudness of
+// the recording: the time is cut into short slots and the range of the voice
+// into narrow frequency bands, and every band of every slot is made a little
+// louder or quieter, following a pattern of cells derived from the signature.
+// The change is proportional to the sound that is already there, so it's
+// masked by it, and it's defined in seconds and hertz, so resampling doesn't
+// move it. Lossy codecs keep the loudness of the bands, which is what they
+// are built to preserve.
+//
+// The pattern repeats every few seconds. The detector measures the loudness
+// of the bands of the leaked recording, folds the slots onto one period and
+// correlates the result with the pattern of every recipient at every shift,
+// so a recording that was trimmed at any point is still found.
+const (
+	audioMarkSlot       = 0.05
+	audioMarkPeriod     = 128
+	audioMarkBands      = 32
+	audioMarkLowFreq    = 300.0
+	audioMarkHighFreq   = 6000.0
+	audioMarkFrame      = 0.04
+	audioMarkStrength   = 0.08
+	audioMarkPhases     = 8
+	audioMarkClip       = 1.0
+	audioMarkMaxSeconds = 600
+	minAudioMarkScore   = 6.0
+)
+
+// addAudioWatermark adds the watermark to the samples of a WAV or FLAC file.
+// Files with less than 16 bits per sample are left as they are, since the
+// change is smaller than the steps between their samples.
+func addAudioWatermark(file, signature string) {
+	extension := strings.ToLower(filepath.Ext(file))
+	content, err := ioutil.ReadFile(file)
+	if err == nil {
+		var audio *pcmAudio
+		if audio, err = audioDecoders[extension](content); err == nil {
+			if !audio.float && audio.bits < 16 {
+				return
+			}
+			addAudioMark(audio, signature)
+			content, err = audioEncoders[extension](content, audio)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(file, content, 0644)
+		}
+	}
+	if err != nil {
+		color.Red("Error occurred while adding the watermark to the audio file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// audioMarkPattern returns the cells of a recipient, one value of -1 or 1 for
+// every band of every slot of the period.
+func audioMarkPattern(signature string) []float64 {
+	rng := rand.New(rand.NewSource(imageMarkSeed("audio", signature)))
+	pattern := make([]float64, audioMarkPeriod*audioMarkBands)
+	for i := range pattern {
+		pattern[i] = float64(rng.Intn(2)*2 - 1)
+	}
+	return pattern
+}
+
+// audioFrameSize returns the length of the analysis frames for the sample
+// rate, a power of two.
+func audioFrameSize(rate int) int {
+	size := 1
+	for float64(size) < audioMarkFrame*float64(rate) {
+		size <<= 1
+	}
+	return size
+}
+
+// audioBandOfBins returns the band of every frequency bin of a frame, or -1
+// for the bins outside of the bands.
+func audioBandOfBins(size, rate int) []int {
+	bands := make([]int, size/2+1)
+	step := math.Log(audioMarkHighFreq/audioMarkLowFreq) / audioMarkBands
+	for bin := range bands {
+		frequency := float64(bin) * float64(rate) / float64(size)
+		bands[bin] = -1
+		if frequency >= audioMarkLowFreq && frequency < audioMarkHighFreq {
+			bands[bin] = int(math.Log(frequency/audioMarkLowFreq) / step)
+		}
+	}
+	return bands
+}
+
+// addAudioMark changes the loudness of the bands of every channel by the
+// pattern. The frames are windowed with a square root of a Hann window
+// before and after the change, so the overlapping frames add up to the
+// original samples where nothing is changed.
+func addAudioMark(audio *pcmAudio, signature string) {
+	pattern := audioMarkPattern(signature)
+	size := audioFrameSize(audio.rate)
+	hop := size / 2
+	bands := audioBandOfBins(size, audio.rate)
+	window := make([]float64, size)
+	for i := range window {
+		window[i] = math.Sin(math.Pi * float64(i) / float64(size))
+	}
+	frame := make([]complex128, size)
+	pending := make([]float64, size)
+	for _, samples := range audio.channels {
+		for i := range pending {
+			pending[i] = 0
+		}
+		for start := -hop; start < len(samples); start += hop {
+			for i := range frame {
+				frame[i] = 0
+				if at := start + i; at >= 0 && at < len(samples) {
+					frame[i] = complex(float64(samples[at])*window[i], 0)
+				}
+			}
+			fft(frame, false)
+			slot := int(float64(start+hop)/float64(audio.rate)/audioMarkSlot) % audioMarkPeriod
+			for bin, band := range bands {
+				gain := 0.0
+				if band >= 0 {
+					gain = audioMarkStrength * pattern[slot*audioMarkBands+band]
+				}
+				frame[bin] *= complex(gain, 0)
+				if bin > 0 && bin < size/2 {
+					frame[size-bin] *= complex(gain, 0)
+				}
+			}
+			fft(frame, true)
+			for i := range pending {
+				pending[i] += real(frame[i]) / float64(size) * window[i]
+			}
+			// The first half of the frame is complete now.
+			for i := 0; i < hop; i++ {
+				if at := start + i; at >= 0 && at < len(samples) {
+					samples[at] += float32(pending[i])
+					if !audio.float {
+						samples[at] = float32(math.Round(float64(samples[at])))
+					}
+				}
+			}
+			copy(pending, pending[hop:])
+			for i := hop; i < size; i++ {
+				pending[i] = 0
+			}
+		}
+	}
+}
+
+// audioObservation is the leaked recording folded onto the period of the
+// pattern: the change of the loudness of every band of every slot from its
+// neighbours, once for every phase of the slots.
+type audioObservation struct {
+	folds [][]float64
+}
+
+func observeAudioMark(file string) *audioObservation {
+	audio, err := decodeAudioFile(file)
+	if err != nil {
+		if isCompressedAudio(filepath.Ext(file)) {
+			color.Red("Couldn't read the audio file for the watermark")
+			fmt.Println(err)
+		}
+		return nil
+	}
+	count := len(audio.channels[0])
+	if limit := audioMarkMaxSeconds * audio.rate; count > limit {
+		count = limit
+	}
+	mono := make([]float64, count)
+	for _, samples := range audio.channels {
+		for i := range mono {
+			mono[i] += float64(samples[i]) / audio.fullScale() / float64(len(audio.channels))
+		}
+	}
+	size := audioFrameSize(audio.rate)
+	bands := audioBandOfBins(size, audio.rate)
+	window := make([]float64, size)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(size))
+	}
+	// Every slot is measured with audioMarkPhases frames, and a slot can
+	// start at any of them.
+	step := audioMarkSlot * float64(audio.rate) / audioMarkPhases
+	var energies [][audioMarkBands]float64
+	frame := make([]complex128, size)
+	for j := 0; ; j++ {
+		center := int(float64(j)*step + step/2)
+		if center+size/2 > count {
+			break
+		}
+		for i := range frame {
+			frame[i] = 0
+			if at := center - size/2 + i; at >= 0 {
+				frame[i] = complex(mono[at]*window[i], 0)
+			}
+		}
+		fft(frame, false)
+		var energy [audioMarkBands]float64
+		for bin, band := range bands {
+			if band >= 0 {
+				energy[band] += real(frame[bin])*real(frame[bin]) + imag(frame[bin])*imag(frame[bin])
+			}
+		}
+		energies = append(energies, energy)
+	}
+	o := &audioObservation{}
+	for phase := 0; phase < audioMarkPhases; phase++ {
+		var levels [][audioMarkBands]float64
+		for start := phase; start+audioMarkPhases <= len(energies); start += audioMarkPhases {
+			var level [audioMarkBands]float64
+			for band := range level {
+				sum := 1e-12
+				for j := start; j < start+audioMarkPhases; j++ {
+					sum += energies[j][band]
+				}
+				level[band] = 10 * math.Log10(sum)
+			}
+			levels = append(levels, level)
+		}
+		fold := make([]float64, audioMarkPeriod*audioMarkBands)
+		for t, level := range levels {
+			for band, value := range level {
+				sum, n := 0.0, 0
+				if band > 0 {
+					sum, n = sum+level[band-1], n+1
+				}
+				if band < audioMarkBands-1 {
+					sum, n = sum+level[band+1], n+1
+				}
+				if t > 0 {
+					sum, n = sum+levels[t-1][band], n+1
+				}
+				if t < len(levels)-1 {
+					sum, n = sum+levels[t+1][band], n+1
+				}
+				residual := math.Max(-audioMarkClip, math.Min(audioMarkClip, value-sum/float64(n)))
+				fold[t%audioMarkPeriod*audioMarkBands+band] += residual
+			}
+		}
+		o.folds = append(o.folds, fold)
+	}
+	return o
+}
+
+// score returns the best correlation of the recipient's pattern with the
+// folded recording, over all phases and shifts, in standard deviations of
+// the correlation of a pattern that isn't there. Patterns of other
+// recipients stay below minAudioMarkScore.
+func (o *audioObservation) score(signature string) float64 {
+	if o == nil {
+		return 0
+	}
+	pattern := audioMarkPattern(signature)
+	best := 0.0
+	for _, fold := range o.folds {
+		power := 0.0
+		for _, value := range fold {
+			power += value * value
+		}
+		if power == 0 {
+			continue
+		}
+		for shift := 0; shift < audioMarkPeriod; shift++ {
+			correlation := 0.0
+			for slot := 0; slot < audioMarkPeriod; slot++ {
+				cells := pattern[(slot+shift)%audioMarkPeriod*audioMarkBands:]
+				for band, value := range fold[slot*audioMarkBands : (slot+1)*audioMarkBands] {
+					correlation += value * cells[band]
+				}
+			}
+			best = math.Max(best, correlation/math.Sqrt(power))
+		}
+	}
+	return best
+}
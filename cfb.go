@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// Compound File Binary (OLE2) is the container of legacy Office documents and
+// Outlook messages. A compound file is read into memory completely, so its
+// streams can be changed and the whole file can be written again.
+const (
+	cfbSignature     = "\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1"
+	cfbHeaderSize    = 512
+	cfbEntrySize     = 128
+	cfbMiniSector    = 64
+	cfbMiniCutoff    = 4096
+	cfbHeaderDIFAT   = 109
+	cfbFreeSector    = 0xFFFFFFFF
+	cfbEndOfChain    = 0xFFFFFFFE
+	cfbFATSector     = 0xFFFFFFFD
+	cfbDIFATSector   = 0xFFFFFFFC
+	cfbNoStream      = 0xFFFFFFFF
+	cfbTypeEmpty     = 0
+	cfbTypeStorage   = 1
+	cfbTypeStream    = 2
+	cfbTypeRoot      = 5
+	cfbColorRed      = 0
+	cfbColorBlack    = 1
+	cfbMaxEntryCount = 1 << 20
+)
+
+type cfbEntry struct {
+	name              string
+	kind              byte
+	color             byte
+	left, right       uint32
+	child             uint32
+	clsid             [16]byte
+	state             uint32
+	created, modified [8]byte
+	data              []byte
+}
+
+type cfbFile struct {
+	sectorSize int
+	clsid      [16]byte
+	entries    []*cfbEntry
+}
+
+func isCFBFile(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	signature := make([]byte, len(cfbSignature))
+	_, err = f.Read(signature)
+	return err == nil && string(signature) == cfbSignature
+}
+
+func readCFB(file string) (*cfbFile, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseCFB(content)
+}
+
+func parseCFB(content []byte) (*cfbFile, error) {
+	if len(content) < cfbHeaderSize || string(content[:8]) != cfbSignature {
+		return nil, fmt.Errorf("not a compound file")
+	}
+	le := binary.LittleEndian
+	doc := &cfbFile{sectorSize: 1 << le.Uint16(content[30:])}
+	if doc.sectorSize != 512 && doc.sectorSize != 4096 {
+		return nil, fmt.Errorf("unsupported sector size %d", doc.sectorSize)
+	}
+	copy(doc.clsid[:], content[8:24])
+	sector := func(n uint32) []byte {
+		start := (int(n) + 1) * doc.sectorSize
+		if n >= cfbDIFATSector || start+doc.sectorSize > len(content) {
+			return nil
+		}
+		return content[start : start+doc.sectorSize]
+	}
+	perSector := doc.sectorSize / 4
+
+	var fatSectors []uint32
+	for i := 0; i < cfbHeaderDIFAT; i++ {
+		fatSectors = append(fatSectors, le.Uint32(content[76+4*i:]))
+	}
+	next := le.Uint32(content[68:])
+	for i := 0; next < cfbDIFATSector && i < int(le.Uint32(content[72:])); i++ {
+		s := sector(next)
+		if s == nil {
+			return nil, fmt.Errorf("invalid DIFAT sector %d", next)
+		}
+		for j := 0; j < perSector-1; j++ {
+			fatSectors = append(fatSectors, le.Uint32(s[4*j:]))
+		}
+		next = le.Uint32(s[doc.sectorSize-4:])
+	}
+	if count := int(le.Uint32(content[44:])); count < len(fatSectors) {
+		fatSectors = fatSectors[:count]
+	}
+	var fat []uint32
+	for _, n := range fatSectors {
+		s := sector(n)
+		if s == nil {
+			return nil, fmt.Errorf("invalid FAT sector %d", n)
+		}
+		for j := 0; j < perSector; j++ {
+			fat = append(fat, le.Uint32(s[4*j:]))
+		}
+	}
+	chain := func(table []uint32, start uint32) []uint32 {
+		var sectors []uint32
+		for n := start; n < uint32(len(table)) && len(sectors) <= len(table); n = table[n] {
+			sectors = append(sectors, n)
+		}
+		return sectors
+	}
+	readChain := func(start uint32) ([]byte, error) {
+		var b bytes.Buffer
+		for _, n := range chain(fat, start) {
+			s := sector(n)
+			if s == nil {
+				return nil, fmt.Errorf("invalid sector %d", n)
+			}
+			b.Write(s)
+		}
+		return b.Bytes(), nil
+	}
+
+	directory, err := readChain(le.Uint32(content[48:]))
+	if err != nil {
+		return nil, err
+	}
+	type location struct {
+		start uint32
+		size  int
+	}
+	var locations []location
+	for i := 0; i+cfbEntrySize <= len(directory) && i/cfbEntrySize < cfbMaxEntryCount; i += cfbEntrySize {
+		raw := directory[i : i+cfbEntrySize]
+		entry := &cfbEntry{
+			kind:  raw[66],
+			color: raw[67],
+			left:  le.Uint32(raw[68:]),
+			right: le.Uint32(raw[72:]),
+			child: le.Uint32(raw[76:]),
+			state: le.Uint32(raw[96:]),
+		}
+		nameLength := int(le.Uint16(raw[64:]))
+		if nameLength > 64 {
+			nameLength = 64
+		}
+		units := make([]uint16, 0, 32)
+		for j := 0; j+1 < nameLength; j += 2 {
+			if unit := le.Uint16(raw[j:]); unit != 0 {
+				units = append(units, unit)
+			}
+		}
+		entry.name = string(utf16.Decode(units))
+		copy(entry.clsid[:], raw[80:96])
+		copy(entry.created[:], raw[100:108])
+		copy(entry.modified[:], raw[108:116])
+		size := le.Uint64(raw[120:])
+		if doc.sectorSize == 512 {
+			size &= 0xFFFFFFFF
+		}
+		if entry.kind == cfbTypeEmpty {
+			size = 0
+		}
+		if size > uint64(len(content)) {
+			return nil, fmt.Errorf("invalid size of stream %q", entry.name)
+		}
+		doc.entries = append(doc.entries, entry)
+		locations = append(locations, location{le.Uint32(raw[116:]), int(size)})
+	}
+	if len(doc.entries) == 0 || doc.entries[0].kind != cfbTypeRoot {
+		return nil, fmt.Errorf("compound file has no root entry")
+	}
+
+	miniStream, err := readChain(locations[0].start)
+	if err != nil {
+		return nil, err
+	}
+	miniFATData, err := readChain(le.Uint32(content[60:]))
+	if err != nil {
+		return nil, err
+	}
+	miniFAT := make([]uint32, len(miniFATData)/4)
+	for i := range miniFAT {
+		miniFAT[i] = le.Uint32(miniFATData[4*i:])
+	}
+	cutoff := int(le.Uint32(content[56:]))
+	for i, entry := range doc.entries {
+		if entry.kind != cfbTypeStream {
+			continue
+		}
+		var data []byte
+		if locations[i].size < cutoff {
+			var b bytes.Buffer
+			for _, n := range chain(miniFAT, locations[i].start) {
+				start := int(n) * cfbMiniSector
+				if start+cfbMiniSector > len(miniStream) {
+					return nil, fmt.Errorf("invalid mini sector %d", n)
+				}
+				b.Write(miniStream[start : start+cfbMiniSector])
+			}
+			data = b.Bytes()
+		} else if data, err = readChain(locations[i].start); err != nil {
+			return nil, err
+		}
+		if len(data) < locations[i].size {
+			return nil, fmt.Errorf("stream %q is truncated", entry.name)
+		}
+		entry.data = data[:locations[i].size]
+	}
+	return doc, nil
+}
+
+// children returns the entries of a storage in the order of their names.
+func (doc *cfbFile) children(storage int) []int {
+	var ids []int
+	visited := make(map[uint32]bool)
+	var walk func(id uint32)
+	walk = func(id uint32) {
+		if id >= uint32(len(doc.entries)) || visited[id] {
+			return
+		}
+		visited[id] = true
+		walk(doc.entries[id].left)
+		ids = append(ids, int(id))
+		walk(doc.entries[id].right)
+	}
+	walk(doc.entries[storage].child)
+	return ids
+}
+
+// find returns the entry with the given name in a storage, or -1.
+func (doc *cfbFile) find(storage int, name string) int {
+	for _, id := range doc.children(storage) {
+		if strings.EqualFold(doc.entries[id].name, name) {
+			return id
+		}
+	}
+	return -1
+}
+
+func (doc *cfbFile) stream(storage int, name string) ([]byte, bool) {
+	id := doc.find(storage, name)
+	if id < 0 || doc.entries[id].kind != cfbTypeStream {
+		return nil, false
+	}
+	return doc.entries[id].data, true
+}
+
+// setStream replaces the content of a stream in a storage or adds the stream.
+func (doc *cfbFile) setStream(storage int, name string, data []byte) {
+	if id := doc.find(storage, name); id >= 0 {
+		doc.entries[id].data = data
+		return
+	}
+	ids := doc.children(storage)
+	for i, entry := range doc.entries {
+		if entry.kind == cfbTypeEmpty && i > 0 {
+			*entry = cfbEntry{name: name, kind: cfbTypeStream, data: data}
+			doc.linkChildren(storage, append(ids, i))
+			return
+		}
+	}
+	doc.entries = append(doc.entries, &cfbEntry{name: name, kind: cfbTypeStream, data: data})
+	doc.linkChildren(storage, append(ids, len(doc.entries)-1))
+}
+
+// linkChildren rebuilds the red-black tree of a storage as a balanced tree.
+// All levels but the deepest one are black, which keeps the tree valid.
+func (doc *cfbFile) linkChildren(storage int, ids []int) {
+	sort.Slice(ids, func(i, j int) bool {
+		return cfbCompareNames(doc.entries[ids[i]].name, doc.entries[ids[j]].name) < 0
+	})
+	depth := 0
+	for n := len(ids); n > 0; n /= 2 {
+		depth++
+	}
+	perfect := len(ids) == 1<<uint(depth)-1
+	var build func(ids []int, level int) uint32
+	build = func(ids []int, level int) uint32 {
+		if len(ids) == 0 {
+			return cfbNoStream
+		}
+		middle := len(ids) / 2
+		entry := doc.entries[ids[middle]]
+		entry.left = build(ids[:middle], level+1)
+		entry.right = build(ids[middle+1:], level+1)
+		entry.color = cfbColorBlack
+		if level == depth && !perfect {
+			entry.color = cfbColorRed
+		}
+		return uint32(ids[middle])
+	}
+	doc.entries[storage].child = build(ids, 1)
+}
+
+// cfbCompareNames orders entry names like the specification does: shorter
+// names first, then by their upper case form.
+func cfbCompareNames(a, b string) int {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	if len(ua) != len(ub) {
+		return len(ua) - len(ub)
+	}
+	for i := range ua {
+		ca, cb := unicode.ToUpper(rune(ua[i])), unicode.ToUpper(rune(ub[i]))
+		if ca != cb {
+			return int(ca) - int(cb)
+		}
+	}
+	return 0
+}
+
+func writeCFB(doc *cfbFile, file string) error {
+	tempFile := file + ".tmp"
+	if err := ioutil.WriteFile(tempFile, doc.bytes(), 0644); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return os.Rename(tempFile, file)
+}
+
+// bytes serializes the compound file. Streams are laid out one after another,
+// followed by the mini stream, the mini FAT, the directory, the FAT and the
+// DIFAT sectors.
+func (doc *cfbFile) bytes() []byte {
+	le := binary.LittleEndian
+	sectorSize := doc.sectorSize
+	perSector := sectorSize / 4
+	var body bytes.Buffer
+	var fat []uint32
+	allocate := func(data []byte) uint32 {
+		if len(data) == 0 {
+			return cfbEndOfChain
+		}
+		start := uint32(len(fat))
+		count := (len(data) + sectorSize - 1) / sectorSize
+		for i := 0; i < count; i++ {
+			fat = append(fat, uint32(len(fat))+1)
+		}
+		fat[len(fat)-1] = cfbEndOfChain
+		body.Write(data)
+		body.Write(make([]byte, count*sectorSize-len(data)))
+		return start
+	}
+
+	starts := make([]uint32, len(doc.entries))
+	var miniStream bytes.Buffer
+	var miniFAT []uint32
+	for i, entry := range doc.entries {
+		starts[i] = cfbEndOfChain
+		if entry.kind != cfbTypeStream || len(entry.data) == 0 {
+			if entry.kind == cfbTypeStorage {
+				starts[i] = 0
+			}
+			continue
+		}
+		if len(entry.data) >= cfbMiniCutoff {
+			starts[i] = allocate(entry.data)
+			continue
+		}
+		starts[i] = uint32(len(miniFAT))
+		count := (len(entry.data) + cfbMiniSector - 1) / cfbMiniSector
+		for j := 0; j < count; j++ {
+			miniFAT = append(miniFAT, uint32(len(miniFAT))+1)
+		}
+		miniFAT[len(miniFAT)-1] = cfbEndOfChain
+		miniStream.Write(entry.data)
+		miniStream.Write(make([]byte, count*cfbMiniSector-len(entry.data)))
+	}
+	starts[0] = allocate(miniStream.Bytes())
+	miniFATStart := uint32(cfbEndOfChain)
+	if len(miniFAT) > 0 {
+		data := make([]byte, 4*len(miniFAT))
+		for i, n := range miniFAT {
+			le.PutUint32(data[4*i:], n)
+		}
+		for len(data)%sectorSize != 0 {
+			data = append(data, 0xFF)
+		}
+		miniFATStart = allocate(data)
+	}
+
+	entriesPerSector := sectorSize / cfbEntrySize
+	directory := make([]byte, 0, (len(doc.entries)+entriesPerSector-1)/entriesPerSector*sectorSize)
+	for i, entry := range doc.entries {
+		raw := make([]byte, cfbEntrySize)
+		units := utf16.Encode([]rune(entry.name))
+		if len(units) > 31 {
+			units = units[:31]
+		}
+		for j, unit := range units {
+			le.PutUint16(raw[2*j:], unit)
+		}
+		if entry.kind != cfbTypeEmpty {
+			le.PutUint16(raw[64:], uint16(2*len(units)+2))
+		}
+		raw[66] = entry.kind
+		raw[67] = entry.color
+		le.PutUint32(raw[68:], entry.left)
+		le.PutUint32(raw[72:], entry.right)
+		le.PutUint32(raw[76:], entry.child)
+		copy(raw[80:], entry.clsid[:])
+		le.PutUint32(raw[96:], entry.state)
+		copy(raw[100:], entry.created[:])
+		copy(raw[108:], entry.modified[:])
+		switch entry.kind {
+		case cfbTypeRoot:
+			le.PutUint32(raw[116:], starts[0])
+			le.PutUint64(raw[120:], uint64(miniStream.Len()))
+		case cfbTypeStream:
+			le.PutUint32(raw[116:], starts[i])
+			le.PutUint64(raw[120:], uint64(len(entry.data)))
+		}
+		directory = append(directory, raw...)
+	}
+	for len(directory)%sectorSize != 0 {
+		raw := make([]byte, cfbEntrySize)
+		le.PutUint32(raw[68:], cfbNoStream)
+		le.PutUint32(raw[72:], cfbNoStream)
+		le.PutUint32(raw[76:], cfbNoStream)
+		directory = append(directory, raw...)
+	}
+	directoryStart := allocate(directory)
+
+	dataSectors := len(fat)
+	fatCount, difatCount := 0, 0
+	for {
+		if fatCount > cfbHeaderDIFAT {
+			difatCount = (fatCount - cfbHeaderDIFAT + perSector - 2) / (perSector - 1)
+		}
+		if (dataSectors+fatCount+difatCount+perSector-1)/perSector <= fatCount {
+			break
+		}
+		fatCount++
+	}
+	fatSectors := make([]uint32, fatCount)
+	for i := range fatSectors {
+		fatSectors[i] = uint32(len(fat))
+		fat = append(fat, cfbFATSector)
+	}
+	difatSectors := make([]uint32, difatCount)
+	for i := range difatSectors {
+		difatSectors[i] = uint32(len(fat))
+		fat = append(fat, cfbDIFATSector)
+	}
+	for len(fat) < fatCount*perSector {
+		fat = append(fat, cfbFreeSector)
+	}
+	for _, n := range fat {
+		binary.Write(&body, le, n)
+	}
+	for i := range difatSectors {
+		s := make([]byte, sectorSize)
+		for j := 0; j < perSector-1; j++ {
+			n := uint32(cfbFreeSector)
+			if k := cfbHeaderDIFAT + i*(perSector-1) + j; k < fatCount {
+				n = fatSectors[k]
+			}
+			le.PutUint32(s[4*j:], n)
+		}
+		next := uint32(cfbEndOfChain)
+		if i+1 < len(difatSectors) {
+			next = difatSectors[i+1]
+		}
+		le.PutUint32(s[sectorSize-4:], next)
+		body.Write(s)
+	}
+
+	header := make([]byte, sectorSize)
+	copy(header, cfbSignature)
+	copy(header[8:], doc.clsid[:])
+	le.PutUint16(header[24:], 0x3E)
+	le.PutUint16(header[26:], 3)
+	le.PutUint16(header[30:], 9)
+	if sectorSize == 4096 {
+		le.PutUint16(header[26:], 4)
+		le.PutUint16(header[30:], 12)
+		le.PutUint32(header[40:], uint32(len(directory)/sectorSize))
+	}
+	le.PutUint16(header[28:], 0xFFFE)
+	le.PutUint16(header[32:], 6)
+	le.PutUint32(header[44:], uint32(fatCount))
+	le.PutUint32(header[48:], directoryStart)
+	le.PutUint32(header[56:], cfbMiniCutoff)
+	le.PutUint32(header[60:], miniFATStart)
+	le.PutUint32(header[64:], uint32(len(miniFAT)*4+sectorSize-1)/uint32(sectorSize))
+	le.PutUint32(header[68:], cfbEndOfChain)
+	if difatCount > 0 {
+		le.PutUint32(header[68:], difatSectors[0])
+	}
+	le.PutUint32(header[72:], uint32(difatCount))
+	for i := 0; i < cfbHeaderDIFAT; i++ {
+		n := uint32(cfbFreeSector)
+		if i < fatCount {
+			n = fatSectors[i]
+		}
+		le.PutUint32(header[76+4*i:], n)
+	}
+	return append(header, body.Bytes()...)
+}
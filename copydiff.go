@@ -0,0 +1,362 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// The issued copies differ from each other in more places than the
+// signatures: identifiers, hashes, the layout of ZIP archives and whatever
+// the tools that wrote them changed on the way. When the signatures are
+// stripped from a leaked file, the rest of it is still compared with every
+// copy byte by byte. The bytes of the leaked file are aligned with a copy like
+// rsync does: the copy is cut into blocks, and a rolling hash finds them
+// anywhere in the leaked file, even if bytes were inserted or removed before
+// them. The copy that explains the most bytes is the one the file was made
+// from, and the bytes that only it explains are the evidence.
+//
+// ZIP archives (DOCX, XLSX, PPTX, ODT etc.) are compared by the uncompressed
+// content of their entries, since the compressed bytes change completely
+// when an archive is saved again, and by a list of their entries that keeps
+// the layout of the archive.
+//
+// A copy is only named if the leaked file has most of the bytes that set it
+// apart from the other copies and clearly fewer of the bytes of the next
+// one. A few of those bytes match any copy by chance, like the digits of
+// offsets, so it takes a share of them rather than a number of bytes.
+const (
+	copyBlockSize     = 16
+	copyReferences    = 3
+	minCopyShare      = 0.5
+	minDistinctShare  = 0.5
+	maxRunnerUpShare  = 0.5
+	maxReportedRanges = 6
+	rollingHashBase   = 1099511628211
+)
+
+// byteRange is a range of the bytes of a part of a file, end excluded.
+type byteRange struct {
+	start, end int
+}
+
+// contentPart is a part of a file that is compared on its own.
+type contentPart struct {
+	name string
+	data []byte
+}
+
+// copyDiff is the copy a leaked file is closest to. The ranges are in the
+// parts of the leaked file.
+type copyDiff struct {
+	name      string
+	share     float64
+	nextName  string
+	nextShare float64
+	parts     []contentPart
+	only      [][]byteRange
+	changed   [][]byteRange
+}
+
+// contentParts returns the parts of a file: the entries and the layout of a
+// ZIP archive or all of the file otherwise.
+func contentParts(file string) ([]contentPart, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil || len(r.File) == 0 {
+		return []contentPart{{"", content}}, nil
+	}
+	var layout strings.Builder
+	parts := []contentPart{{"(layout)", nil}}
+	for _, f := range r.File {
+		fmt.Fprintf(&layout, "%s %d %08x %d %x %q\n", f.Name, f.Method, f.CRC32, f.CompressedSize64, f.Extra, f.Comment)
+		rc, err := f.Open()
+		if err != nil {
+			return []contentPart{{"", content}}, nil
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return []contentPart{{"", content}}, nil
+		}
+		parts = append(parts, contentPart{f.Name, data})
+	}
+	fmt.Fprintf(&layout, "%q\n", r.Comment)
+	parts[0].data = []byte(layout.String())
+	return parts, nil
+}
+
+// nearestIssuedCopy compares a leaked file with the copies of the recipients
+// byte by byte. It returns nil if the file isn't made from one of them or if
+// no copy explains it clearly better than the others.
+func nearestIssuedCopy(file, dbPath string, targets []string) *copyDiff {
+	leaked, err := contentParts(file)
+	if err != nil {
+		return nil
+	}
+	total := 0
+	for _, part := range leaked {
+		total += len(part.data)
+	}
+	if total == 0 {
+		return nil
+	}
+	var names, paths []string
+	for _, target := range targets {
+		fields := strings.Split(target, ",")
+		if len(fields) < 5 {
+			continue
+		}
+		name := strings.ReplaceAll(fields[0], " ", "_")
+		names = append(names, name)
+		paths = append(paths, issuedCopyPath(dbPath, name, fields[4]))
+	}
+	// The first copies are kept to find the bytes that set every copy apart.
+	var references [][]contentPart
+	var referenceIndexes []int
+	for i, path := range paths {
+		if len(references) == copyReferences {
+			break
+		}
+		if parts, err := contentParts(path); err == nil {
+			references = append(references, parts)
+			referenceIndexes = append(referenceIndexes, i)
+		}
+	}
+	type candidate struct {
+		name     string
+		matched  int
+		ranges   [][]byteRange
+		distinct int
+		found    int
+	}
+	var candidates []candidate
+	for i, path := range paths {
+		parts, err := contentParts(path)
+		if err != nil {
+			continue
+		}
+		c := candidate{name: names[i]}
+		for _, part := range leaked {
+			var ranges []byteRange
+			if data, found := partData(parts, part.name); found {
+				ranges = matchBytes(part.data, data)
+			}
+			c.matched += rangesLength(ranges)
+			c.ranges = append(c.ranges, ranges)
+		}
+		var others [][]contentPart
+		for k, reference := range references {
+			if referenceIndexes[k] != i && len(others) < copyReferences-1 {
+				others = append(others, reference)
+			}
+		}
+		if len(others) > 0 {
+			c.distinct, c.found = distinctBytes(parts, others, leaked)
+		}
+		candidates = append(candidates, c)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	share := func(c candidate) float64 {
+		if c.distinct == 0 {
+			return 0
+		}
+		return float64(c.found) / float64(c.distinct)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if share(candidates[i]) != share(candidates[j]) {
+			return share(candidates[i]) > share(candidates[j])
+		}
+		return candidates[i].matched > candidates[j].matched
+	})
+	best := candidates[0]
+	diff := &copyDiff{name: best.name, share: float64(best.matched) / float64(total), parts: leaked}
+	if diff.share < minCopyShare {
+		return nil
+	}
+	for i, part := range leaked {
+		diff.changed = append(diff.changed, subtractRanges([]byteRange{{0, len(part.data)}}, best.ranges[i]))
+	}
+	if len(candidates) > 1 {
+		next := candidates[1]
+		if share(best) < minDistinctShare || share(next) > maxRunnerUpShare*share(best) {
+			return nil
+		}
+		diff.nextName, diff.nextShare = next.name, float64(next.matched)/float64(total)
+		for i := range leaked {
+			diff.only = append(diff.only, subtractRanges(best.ranges[i], next.ranges[i]))
+		}
+	}
+	return diff
+}
+
+// distinctBytes returns the number of bytes of a copy that aren't in the
+// other copies, and how many of them are in the leaked file.
+func distinctBytes(parts []contentPart, others [][]contentPart, leaked []contentPart) (int, int) {
+	distinct, found := 0, 0
+	for _, part := range parts {
+		own := []byteRange{{0, len(part.data)}}
+		for _, other := range others {
+			if data, ok := partData(other, part.name); ok {
+				own = subtractRanges(own, matchBytes(part.data, data))
+			}
+		}
+		distinct += rangesLength(own)
+		if data, ok := partData(leaked, part.name); ok {
+			found += rangesLength(subtractRanges(own, subtractRanges(own, matchBytes(part.data, data))))
+		}
+	}
+	return distinct, found
+}
+
+func partData(parts []contentPart, name string) ([]byte, bool) {
+	for _, part := range parts {
+		if part.name == name {
+			return part.data, true
+		}
+	}
+	return nil, false
+}
+
+func rangesLength(ranges []byteRange) int {
+	length := 0
+	for _, r := range ranges {
+		length += r.end - r.start
+	}
+	return length
+}
+
+// matchBytes returns the ranges of the leaked bytes that are found in the
+// copy. The copy is indexed by the hashes of its blocks, and every block
+// that is found is extended as far as the bytes go on to be the same.
+func matchBytes(leaked, copy []byte) []byteRange {
+	if len(leaked) < copyBlockSize || len(copy) < copyBlockSize {
+		if bytes.Equal(leaked, copy) && len(leaked) > 0 {
+			return []byteRange{{0, len(leaked)}}
+		}
+		return nil
+	}
+	blocks := make(map[uint64]int)
+	for i := 0; i+copyBlockSize <= len(copy); i += copyBlockSize {
+		if _, found := blocks[blockHash(copy[i:i+copyBlockSize])]; !found {
+			blocks[blockHash(copy[i:i+copyBlockSize])] = i
+		}
+	}
+	power := uint64(1)
+	for i := 1; i < copyBlockSize; i++ {
+		power *= rollingHashBase
+	}
+	var ranges []byteRange
+	done := 0
+	position := 0
+	hash := blockHash(leaked[:copyBlockSize])
+	for {
+		if offset, found := blocks[hash]; found && bytes.Equal(leaked[position:position+copyBlockSize], copy[offset:offset+copyBlockSize]) {
+			start, copyStart := position, offset
+			for start > done && copyStart > 0 && leaked[start-1] == copy[copyStart-1] {
+				start--
+				copyStart--
+			}
+			end, copyEnd := position+copyBlockSize, offset+copyBlockSize
+			for end < len(leaked) && copyEnd < len(copy) && leaked[end] == copy[copyEnd] {
+				end++
+				copyEnd++
+			}
+			ranges = append(ranges, byteRange{start, end})
+			done, position = end, end
+			if position+copyBlockSize > len(leaked) {
+				break
+			}
+			hash = blockHash(leaked[position : position+copyBlockSize])
+			continue
+		}
+		if position+copyBlockSize >= len(leaked) {
+			break
+		}
+		hash = (hash-uint64(leaked[position])*power)*rollingHashBase + uint64(leaked[position+copyBlockSize])
+		position++
+	}
+	return ranges
+}
+
+func blockHash(block []byte) uint64 {
+	var hash uint64
+	for _, b := range block {
+		hash = hash*rollingHashBase + uint64(b)
+	}
+	return hash
+}
+
+// subtractRanges returns the parts of the ranges that aren't in the other
+// ranges. Both are sorted and don't overlap.
+func subtractRanges(ranges, other []byteRange) []byteRange {
+	var result []byteRange
+	k := 0
+	for _, r := range ranges {
+		start := r.start
+		for k < len(other) && other[k].end <= start {
+			k++
+		}
+		for j := k; j < len(other) && other[j].start < r.end; j++ {
+			if other[j].start > start {
+				result = append(result, byteRange{start, other[j].start})
+			}
+			if other[j].end > start {
+				start = other[j].end
+			}
+		}
+		if start < r.end {
+			result = append(result, byteRange{start, r.end})
+		}
+	}
+	return result
+}
+
+func reportNearestCopy(d *copyDiff) {
+	// rounded down, so that a changed file never shows as 100%
+	share, nextShare := math.Floor(1000*d.share)/10, math.Floor(1000*d.nextShare)/10
+	if d.nextName == "" {
+		color.Magenta(fmt.Sprintf("Nearest Issued Copy (%.1f%% of the bytes match): %s", share, d.name))
+	} else {
+		color.Magenta(fmt.Sprintf("Nearest Issued Copy (%.1f%% of the bytes match, %s %.1f%%): %s", share, d.nextName, nextShare, d.name))
+		fmt.Println("Found Only in the Copy of " + d.name + ": " + d.report(d.only))
+	}
+	if changed := d.report(d.changed); changed != "" {
+		fmt.Println("Changed in the Leaked File: " + changed)
+	}
+}
+
+// report lists the ranges of the parts of the leaked file, at most a few of
+// them.
+func (d *copyDiff) report(ranges [][]byteRange) string {
+	var items []string
+	count := 0
+	for i, part := range ranges {
+		for _, r := range part {
+			count++
+			if len(items) == maxReportedRanges {
+				continue
+			}
+			item := fmt.Sprintf("0x%x-0x%x (%d bytes)", r.start, r.end-1, r.end-r.start)
+			if d.parts[i].name != "" {
+				item = d.parts[i].name + " " + item
+			}
+			items = append(items, item)
+		}
+	}
+	if count > len(items) {
+		items = append(items, fmt.Sprintf("and %d more", count-len(items)))
+	}
+	return strings.Join(items, ", ")
+}
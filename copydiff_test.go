@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNearestIssuedCopy(t *testing.T) {
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	base := make([]byte, 4000)
+	rng.Read(base)
+	copies := make(map[string][]byte)
+	var targets []string
+	for i, name := range []string{"Alice", "Bob", "Carol"} {
+		content := append([]byte(nil), base...)
+		copy(content[100:], signaturePrefix+"-"+name)
+		id := bytes.Repeat([]byte{byte('a' + i)}, 32)
+		copy(content[2000:], id)
+		file := filepath.Join(dir, name+".bin")
+		if err := ioutil.WriteFile(file, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		copies[name] = content
+		targets = append(targets, name+",,,,"+file)
+	}
+	leak := func(content []byte) string {
+		file := filepath.Join(dir, "leaked.bin")
+		if err := ioutil.WriteFile(file, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	// The signature is removed, but the identifier of the copy is left.
+	leaked := append([]byte(nil), copies["Bob"]...)
+	copy(leaked[100:], bytes.Repeat([]byte{'x'}, 30))
+	diff := nearestIssuedCopy(leak(leaked), filepath.Join(dir, "db.csv"), targets)
+	if diff == nil || diff.name != "Bob" {
+		t.Fatalf("got %+v", diff)
+	}
+
+	// Both are overwritten, and only a byte of the identifier is left.
+	copy(leaked[2001:], bytes.Repeat([]byte{'x'}, 31))
+	if diff := nearestIssuedCopy(leak(leaked), filepath.Join(dir, "db.csv"), targets); diff != nil {
+		t.Errorf("named %s by %d bytes", diff.name, int(float64(len(leaked))*(diff.share-diff.nextShare)))
+	}
+}
+
+// testCopy returns a file like a PDF file with a stamp of the recipient on
+// top and numbers that every copy has its own of, like renumbered objects.
+// Some of the digits are the same in every file by chance.
+func testCopy(recipient int64, stamp string) []byte {
+	text := rand.New(rand.NewSource(-1))
+	numbers := rand.New(rand.NewSource(recipient))
+	out := []byte("%PDF-1.7\n" + stamp + "\n")
+	for i := 0; i < 3000; i++ {
+		words := make([]byte, 40)
+		for k := range words {
+			words[k] = byte('a' + text.Intn(26))
+		}
+		out = append(out, fmt.Sprintf("%d 0 obj (%s) endobj %04d\n", i+1, words, numbers.Intn(10000))...)
+	}
+	return out
+}
+
+func TestNearestIssuedCopyUnmarked(t *testing.T) {
+	dir := t.TempDir()
+	var targets []string
+	for i, name := range []string{"Alice Smith", "Bob Jones", "Carol King"} {
+		file := filepath.Join(dir, strings.ReplaceAll(name, " ", "_")+".pdf")
+		stamp := name + " " + signaturePrefix + "-" + name
+		if err := ioutil.WriteFile(file, testCopy(int64(i), stamp), 0644); err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, name+",,,,"+file)
+	}
+	file := filepath.Join(dir, "leaked.pdf")
+	if err := ioutil.WriteFile(file, testCopy(-2, ""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if diff := nearestIssuedCopy(file, filepath.Join(dir, "db.csv"), targets); diff != nil {
+		t.Errorf("the unmarked file was attributed to %s", diff.name)
+	}
+
+	// The stamp is removed from the copy, but the numbers are left.
+	leaked := testCopy(1, "Bob Jones "+signaturePrefix+"-Bob Jones")
+	copy(leaked[9:], bytes.Repeat([]byte{'x'}, 34))
+	if err := ioutil.WriteFile(file, leaked, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if diff := nearestIssuedCopy(file, filepath.Join(dir, "db.csv"), targets); diff == nil || diff.name != "Bob_Jones" {
+		t.Errorf("got %+v", diff)
+	}
+}
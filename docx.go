@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// The signature is repeated in several paragraphs of the body. Half of the
+// runs are hidden text, which Word and LibreOffice keep on "Save As", and the
+// other half are 1pt white text, which is also kept on "Export to PDF".
+const docxWatermarkParagraphs = 8
+
+const (
+	docxHiddenRun = `<w:r><w:rPr><w:vanish/></w:rPr><w:t xml:space="preserve"> %s</w:t></w:r>`
+	docxWhiteRun  = `<w:r><w:rPr><w:color w:val="FFFFFF"/><w:sz w:val="2"/><w:szCs w:val="2"/></w:rPr><w:t xml:space="preserve"> %s</w:t></w:r>`
+)
+
+func addDocxWatermark(file, signature string) {
+	content, err := readZipFile(file, "word/document.xml")
+	if err != nil {
+		color.Red("Error occurred while reading word/document.xml")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	document := string(content)
+	var ends []int
+	for i := 0; ; {
+		end := strings.Index(document[i:], "</w:p>")
+		if end < 0 {
+			break
+		}
+		ends = append(ends, i+end)
+		i += end + len("</w:p>")
+	}
+	if len(ends) == 0 {
+		return
+	}
+	count := docxWatermarkParagraphs
+	if len(ends) < count {
+		count = len(ends)
+	}
+	var sb strings.Builder
+	last := 0
+	for i := 0; i < count; i++ {
+		end := ends[i*len(ends)/count]
+		sb.WriteString(document[last:end])
+		if i%2 == 0 {
+			sb.WriteString(fmt.Sprintf(docxHiddenRun, signature))
+		} else {
+			sb.WriteString(fmt.Sprintf(docxWhiteRun, signature))
+		}
+		last = end
+	}
+	sb.WriteString(document[last:])
+	err = writeOfficeParts(file, map[string][]byte{"word/document.xml": []byte(sb.String())})
+	if err != nil {
+		color.Red("Error occurred while writing word/document.xml")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// docxText returns the text of the document body, including hidden runs.
+func docxText(file string) string {
+	content, err := readZipFile(file, "word/document.xml")
+	if err != nil {
+		return ""
+	}
+	document := string(content)
+	var sb strings.Builder
+	for _, span := range xmlElementSpans(document, "w:t") {
+		sb.WriteString(document[span.start:span.end])
+	}
+	return sb.String()
+}
+
+func detectDocxWatermark(file, signature string) bool {
+	return strings.Contains(docxText(file), signature)
+}
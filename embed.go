@@ -0,0 +1,307 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// binaryEmbedders put the signature into a structure of the file format that
+// parsers skip over, so the file stays valid. Files without an embedder, or
+// files that an embedder can't parse, get the signature appended to the end.
+var binaryEmbedders = map[string]func([]byte, string) ([]byte, error){
+	".png":  embedPNG,
+	".jpg":  embedJPEG,
+	".jpeg": embedJPEG,
+	".gif":  embedGIF,
+	".mp4":  embedMP4,
+	".m4v":  embedMP4,
+	".m4a":  embedMP4,
+	".mov":  embedMP4,
+	".zip":  embedZip,
+	".pdf":  embedPDF,
+	".wav":  embedWAV,
+	".flac": embedFLAC,
+}
+
+const (
+	pngSignatureChunk = "dcId"
+	wavSignatureChunk = "dcId"
+	flacApplicationID = "dcId"
+	zipSignatureField = 0x6469
+)
+
+// embedSignature adds the signature with the embedder of the file format. It
+// returns false if there is no embedder or the embedder failed.
+func embedSignature(file, signature string) bool {
+	embed, found := binaryEmbedders[strings.ToLower(filepath.Ext(file))]
+	if !found {
+		return false
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	content, err = embed(content, signature)
+	if err != nil {
+		return false
+	}
+	return ioutil.WriteFile(file, content, 0644) == nil
+}
+
+// embedPNG adds a private ancillary chunk before IEND. The chunk type is
+// marked as safe to copy, so editors keep it.
+func embedPNG(content []byte, signature string) ([]byte, error) {
+	if !bytes.HasPrefix(content, []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+	for i := 8; i+12 <= len(content); {
+		length := int(binary.BigEndian.Uint32(content[i:]))
+		if length < 0 || i+12+length > len(content) {
+			break
+		}
+		if string(content[i+4:i+8]) == "IEND" {
+			chunk := make([]byte, 8, 12+len(signature))
+			binary.BigEndian.PutUint32(chunk, uint32(len(signature)))
+			copy(chunk[4:], pngSignatureChunk)
+			chunk = append(chunk, signature...)
+			checksum := make([]byte, 4)
+			binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(chunk[4:]))
+			chunk = append(chunk, checksum...)
+			return concat(content[:i], chunk, content[i:]), nil
+		}
+		i += 12 + length
+	}
+	return nil, fmt.Errorf("PNG file has no IEND chunk")
+}
+
+// embedJPEG adds a comment segment after the APPn segments.
+func embedJPEG(content []byte, signature string) ([]byte, error) {
+	if len(content) < 4 || content[0] != 0xFF || content[1] != 0xD8 {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+	i := 2
+	for i+4 <= len(content) && content[i] == 0xFF && content[i+1] >= 0xE0 && content[i+1] <= 0xEF {
+		i += 2 + int(binary.BigEndian.Uint16(content[i+2:]))
+	}
+	if i+2 > len(content) || content[i] != 0xFF {
+		return nil, fmt.Errorf("invalid JPEG segment")
+	}
+	segment := []byte{0xFF, 0xFE, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(signature)))
+	segment = append(segment, signature...)
+	return concat(content[:i], segment, content[i:]), nil
+}
+
+// embedGIF adds a comment extension after the global color table.
+func embedGIF(content []byte, signature string) ([]byte, error) {
+	if len(content) < 13 || !bytes.HasPrefix(content, []byte("GIF8")) {
+		return nil, fmt.Errorf("not a GIF file")
+	}
+	i := 13
+	if flags := content[10]; flags&0x80 != 0 {
+		i += 3 << (uint(flags&0x07) + 1)
+	}
+	if i >= len(content) {
+		return nil, fmt.Errorf("GIF file is truncated")
+	}
+	extension := []byte{0x21, 0xFE}
+	for data := []byte(signature); len(data) > 0; {
+		n := len(data)
+		if n > 255 {
+			n = 255
+		}
+		extension = append(extension, byte(n))
+		extension = append(extension, data[:n]...)
+		data = data[n:]
+	}
+	extension = append(extension, 0)
+	return concat(content[:i], extension, content[i:]), nil
+}
+
+// embedMP4 adds a free box to the user data of the movie if the movie box is
+// at the end of the file. Otherwise a top level free box is added to the end,
+// because growing the movie box would move the media data that the chunk
+// offsets point to.
+func embedMP4(content []byte, signature string) ([]byte, error) {
+	boxes, err := mp4Boxes(content, 0, len(content))
+	if err != nil || len(boxes) == 0 {
+		return nil, fmt.Errorf("not an MP4 file")
+	}
+	free := mp4Box("free", []byte(signature))
+	last := boxes[len(boxes)-1]
+	if last.kind != "moov" || last.headerSize != 8 {
+		return append(content[:len(content):len(content)], free...), nil
+	}
+	children, err := mp4Boxes(content, last.start+8, last.end)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if child.kind != "udta" || child.headerSize != 8 {
+			continue
+		}
+		result := concat(content[:child.end], free, content[child.end:])
+		binary.BigEndian.PutUint32(result[child.start:], uint32(child.end-child.start+len(free)))
+		binary.BigEndian.PutUint32(result[last.start:], uint32(last.end-last.start+len(free)))
+		return result, nil
+	}
+	udta := mp4Box("udta", free)
+	result := concat(content[:last.end], udta)
+	binary.BigEndian.PutUint32(result[last.start:], uint32(last.end-last.start+len(udta)))
+	return result, nil
+}
+
+type mp4BoxInfo struct {
+	kind       string
+	start, end int
+	headerSize int
+}
+
+func mp4Boxes(content []byte, start, end int) ([]mp4BoxInfo, error) {
+	var boxes []mp4BoxInfo
+	for i := start; i < end; {
+		if i+8 > end {
+			return nil, fmt.Errorf("truncated box")
+		}
+		size := int(binary.BigEndian.Uint32(content[i:]))
+		headerSize := 8
+		switch size {
+		case 0:
+			size = end - i
+		case 1:
+			if i+16 > end {
+				return nil, fmt.Errorf("truncated box")
+			}
+			size = int(binary.BigEndian.Uint64(content[i+8:]))
+			headerSize = 16
+		}
+		if size < headerSize || i+size > end {
+			return nil, fmt.Errorf("invalid box size")
+		}
+		kind := string(content[i+4 : i+8])
+		if i == start && start == 0 && kind != "ftyp" && kind != "moov" && kind != "wide" && kind != "free" && kind != "mdat" && kind != "skip" {
+			return nil, fmt.Errorf("unknown box %q", kind)
+		}
+		boxes = append(boxes, mp4BoxInfo{kind: kind, start: i, end: i + size, headerSize: headerSize})
+		i += size
+	}
+	return boxes, nil
+}
+
+func mp4Box(kind string, payload []byte) []byte {
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], kind)
+	return append(box, payload...)
+}
+
+// embedZip adds the signature to the archive comment and as an extra field of
+// every entry. The compressed data is copied as it is.
+func embedZip(content []byte, signature string) ([]byte, error) {
+	r, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+	field := make([]byte, 4, 4+len(signature))
+	binary.LittleEndian.PutUint16(field, zipSignatureField)
+	binary.LittleEndian.PutUint16(field[2:], uint16(len(signature)))
+	field = append(field, signature...)
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for _, f := range r.File {
+		f.Extra = append(f.Extra[:len(f.Extra):len(f.Extra)], field...)
+		if err := w.Copy(f); err != nil {
+			return nil, err
+		}
+	}
+	comment := signature
+	if r.Comment != "" {
+		comment = r.Comment + "\n" + signature
+	}
+	if err := w.SetComment(comment); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// embedWAV adds a private chunk before the sample data. Players skip chunks
+// they don't know, and unlike data after the end of the file, a chunk inside
+// the RIFF form is kept by editors that cut the samples.
+func embedWAV(content []byte, signature string) ([]byte, error) {
+	chunks, err := riffChunks(content, "WAVE")
+	if err != nil {
+		return nil, err
+	}
+	for i, chunk := range chunks {
+		if chunk.kind == "data" {
+			chunks = append(chunks[:i], append([]riffChunk{{wavSignatureChunk, []byte(signature)}}, chunks[i:]...)...)
+			return writeRIFF("WAVE", chunks), nil
+		}
+	}
+	return nil, fmt.Errorf("WAV file has no data chunk")
+}
+
+// embedFLAC adds an APPLICATION metadata block after the stream info.
+func embedFLAC(content []byte, signature string) ([]byte, error) {
+	blocks, start, offset, err := flacMetadata(content)
+	if err != nil {
+		return nil, err
+	}
+	block := flacBlock{flacApplication, []byte(flacApplicationID + signature)}
+	blocks = append(blocks[:1], append([]flacBlock{block}, blocks[1:]...)...)
+	return concat(content[:start], writeFLACMetadata(blocks), content[offset:]), nil
+}
+
+// embedPDF adds an object holding the signature in an incremental update, so
+// the original revision of the document is kept byte for byte.
+func embedPDF(content []byte, signature string) ([]byte, error) {
+	ctx, err := api.ReadContext(bytes.NewReader(content), pdfcpu.NewDefaultConfiguration())
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Encrypt != nil {
+		return nil, fmt.Errorf("PDF file is encrypted")
+	}
+	ctx.WriteXRefStream = ctx.Read.UsingXRefStreams
+	ctx.Write.Increment = true
+	ctx.Write.Offset = int64(len(content))
+	indRef, err := ctx.IndRefForNewObject(pdfcpu.StringLiteral(signature))
+	if err != nil {
+		return nil, err
+	}
+	ctx.Write.IncrementWithObjNr(indRef.ObjectNumber.Value())
+	var b bytes.Buffer
+	b.Write(content)
+	if !bytes.HasSuffix(content, []byte("\n")) {
+		b.WriteString("\n")
+		ctx.Write.Offset++
+	}
+	if err := api.WriteIncrement(ctx, &b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func concat(parts ...[]byte) []byte {
+	var n int
+	for _, part := range parts {
+		n += len(part)
+	}
+	result := make([]byte, 0, n)
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
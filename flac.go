@@ -0,0 +1,782 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// A small FLAC codec, so the watermark can be added to the samples of FLAC
+// files without external tools. The decoder reads everything the format
+// allows. The encoder uses the fixed predictors and stereo decorrelation,
+// which compresses a few percent worse than the reference encoder.
+const (
+	flacBlockSize        = 4096
+	flacMaxPartitionBits = 8
+	flacStreamInfo       = 0
+	flacApplication      = 2
+	flacSeekTable        = 3
+	flacVorbisComment    = 4
+)
+
+type flacBlock struct {
+	kind int
+	data []byte
+}
+
+// flacMetadata returns the metadata blocks of a FLAC file, the offset of the
+// stream, which is after an ID3v2 tag if the file has one, and the offset of
+// the first frame.
+func flacMetadata(content []byte) ([]flacBlock, int, int, error) {
+	start := 0
+	if len(content) >= 10 && string(content[:3]) == "ID3" {
+		start = 10 + (int(content[6]&0x7F)<<21 | int(content[7]&0x7F)<<14 | int(content[8]&0x7F)<<7 | int(content[9]&0x7F))
+		if content[5]&0x10 != 0 {
+			// the tag ends with a footer
+			start += 10
+		}
+	}
+	if len(content) < start+4 || string(content[start:start+4]) != "fLaC" {
+		return nil, 0, 0, fmt.Errorf("not a FLAC file")
+	}
+	var blocks []flacBlock
+	for i := start + 4; ; {
+		if i+4 > len(content) {
+			return nil, 0, 0, fmt.Errorf("invalid FLAC metadata")
+		}
+		last := content[i]&0x80 != 0
+		size := int(content[i+1])<<16 | int(content[i+2])<<8 | int(content[i+3])
+		if i+4+size > len(content) {
+			return nil, 0, 0, fmt.Errorf("invalid FLAC metadata")
+		}
+		blocks = append(blocks, flacBlock{int(content[i] & 0x7F), content[i+4 : i+4+size]})
+		i += 4 + size
+		if last {
+			if len(blocks[0].data) < 34 || blocks[0].kind != flacStreamInfo {
+				return nil, 0, 0, fmt.Errorf("FLAC stream info is missing")
+			}
+			return blocks, start, i, nil
+		}
+	}
+}
+
+// writeFLACMetadata returns the header of a FLAC file with the blocks.
+func writeFLACMetadata(blocks []flacBlock) []byte {
+	out := []byte("fLaC")
+	for i, block := range blocks {
+		kind := byte(block.kind)
+		if i == len(blocks)-1 {
+			kind |= 0x80
+		}
+		size := len(block.data)
+		out = append(out, kind, byte(size>>16), byte(size>>8), byte(size))
+		out = append(out, block.data...)
+	}
+	return out
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) read(n int) (uint64, error) {
+	if r.pos+n > 8*len(r.data) {
+		return 0, fmt.Errorf("unexpected end of FLAC frame")
+	}
+	var v uint64
+	for n > 0 {
+		bit := r.pos & 7
+		take := 8 - bit
+		if take > n {
+			take = n
+		}
+		b := uint64(r.data[r.pos>>3]>>(8-bit-take)) & (1<<take - 1)
+		v = v<<take | b
+		r.pos += take
+		n -= take
+	}
+	return v, nil
+}
+
+func (r *bitReader) readSigned(n int) (int64, error) {
+	v, err := r.read(n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	return int64(v<<(64-n)) >> (64 - n), nil
+}
+
+// unary counts the zero bits before the next one bit.
+func (r *bitReader) unary() (int, error) {
+	count := 0
+	for {
+		if r.pos >= 8*len(r.data) {
+			return 0, fmt.Errorf("unexpected end of FLAC frame")
+		}
+		b := r.data[r.pos>>3] << (r.pos & 7)
+		if b == 0 {
+			count += 8 - r.pos&7
+			r.pos += 8 - r.pos&7
+			continue
+		}
+		for b&0x80 == 0 {
+			b <<= 1
+			count++
+			r.pos++
+		}
+		r.pos++
+		return count, nil
+	}
+}
+
+type bitWriter struct {
+	data  []byte
+	cache uint64
+	bits  int
+}
+
+func (w *bitWriter) write(v uint64, n int) {
+	for n > 0 {
+		take := n
+		if take > 32 {
+			take = 32
+		}
+		n -= take
+		w.cache = w.cache<<take | (v>>n)&(1<<take-1)
+		w.bits += take
+		for w.bits >= 8 {
+			w.bits -= 8
+			w.data = append(w.data, byte(w.cache>>w.bits))
+		}
+	}
+}
+
+func (w *bitWriter) writeSigned(v int64, n int) {
+	w.write(uint64(v)&(1<<n-1), n)
+}
+
+func (w *bitWriter) align() {
+	if w.bits > 0 {
+		w.write(0, 8-w.bits)
+	}
+}
+
+func flacCRC8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func flacCRC16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// readFLAC decodes the samples of a FLAC file. If the stream info has the
+// number of samples, all of them have to be decoded, so that a damaged frame
+// doesn't shorten the file when it is written again.
+func readFLAC(content []byte) (*pcmAudio, error) {
+	blocks, _, offset, err := flacMetadata(content)
+	if err != nil {
+		return nil, err
+	}
+	info := blocks[0].data
+	audio := &pcmAudio{
+		rate: int(info[10])<<12 | int(info[11])<<4 | int(info[12])>>4,
+		bits: int(info[12]&1)<<4 | int(info[13])>>4 + 1,
+	}
+	channels := int(info[12]>>1&7) + 1
+	total := int(binary.BigEndian.Uint64(info[10:18]) & (1<<36 - 1))
+	audio.channels = make([][]float32, channels)
+	for c := range audio.channels {
+		audio.channels[c] = make([]float32, 0, total)
+	}
+	r := &bitReader{data: content, pos: 8 * offset}
+	for total == 0 || len(audio.channels[0]) < total {
+		// Frames start at a byte boundary with the sync code.
+		r.pos = (r.pos + 7) &^ 7
+		for r.pos+16 <= 8*len(content) && !(content[r.pos>>3] == 0xFF && content[r.pos>>3+1]&0xFE == 0xF8) {
+			r.pos += 8
+		}
+		if r.pos+16 > 8*len(content) {
+			break
+		}
+		frame, err := readFLACFrame(r, audio, channels)
+		if err != nil {
+			if total == 0 && len(audio.channels[0]) > 0 {
+				break
+			}
+			return nil, err
+		}
+		for c := range frame {
+			for _, v := range frame[c] {
+				audio.channels[c] = append(audio.channels[c], float32(v))
+			}
+		}
+	}
+	if len(audio.channels[0]) == 0 {
+		return nil, fmt.Errorf("no FLAC frames")
+	}
+	if total > 0 && len(audio.channels[0]) != total {
+		return nil, fmt.Errorf("the FLAC stream has %d of %d samples", len(audio.channels[0]), total)
+	}
+	return audio, nil
+}
+
+var flacSampleSizes = [8]int{0, 8, 12, 0, 16, 20, 24, 32}
+
+func readFLACFrame(r *bitReader, audio *pcmAudio, channels int) ([][]int64, error) {
+	start := r.pos >> 3
+	header, err := r.read(32)
+	if err != nil {
+		return nil, err
+	}
+	blockCode := int(header >> 12 & 0xF)
+	assignment := int(header >> 4 & 0xF)
+	bits := flacSampleSizes[header>>1&7]
+	if bits == 0 {
+		bits = audio.bits
+	}
+	// The frame or sample number is coded like UTF-8.
+	first, err := r.read(8)
+	if err != nil {
+		return nil, err
+	}
+	for mask := uint64(0x40); first&0x80 != 0 && first&mask != 0 && mask > 1; mask >>= 1 {
+		if _, err := r.read(8); err != nil {
+			return nil, err
+		}
+	}
+	size := 0
+	switch {
+	case blockCode == 1:
+		size = 192
+	case blockCode >= 2 && blockCode <= 5:
+		size = 576 << (blockCode - 2)
+	case blockCode == 6 || blockCode == 7:
+		v, err := r.read(8 * (blockCode - 5))
+		if err != nil {
+			return nil, err
+		}
+		size = int(v) + 1
+	case blockCode >= 8:
+		size = 256 << (blockCode - 8)
+	default:
+		return nil, fmt.Errorf("invalid FLAC block size")
+	}
+	switch rateCode := header >> 8 & 0xF; rateCode {
+	case 12:
+		_, err = r.read(8)
+	case 13, 14:
+		_, err = r.read(16)
+	}
+	if err != nil {
+		return nil, err
+	}
+	crc, err := r.read(8)
+	if err != nil || byte(crc) != flacCRC8(r.data[start:r.pos>>3-1]) {
+		return nil, fmt.Errorf("invalid FLAC frame header")
+	}
+	count := channels
+	if assignment < 8 {
+		count = assignment + 1
+	} else if assignment > 10 {
+		return nil, fmt.Errorf("invalid FLAC channel assignment")
+	}
+	if count != channels {
+		return nil, fmt.Errorf("the number of FLAC channels changed")
+	}
+	samples := make([][]int64, count)
+	for c := range samples {
+		subframeBits := bits
+		if (assignment == 8 && c == 1) || (assignment == 9 && c == 0) || (assignment == 10 && c == 1) {
+			subframeBits++
+		}
+		if samples[c], err = readFLACSubframe(r, size, subframeBits); err != nil {
+			return nil, err
+		}
+	}
+	r.pos = (r.pos + 7) &^ 7
+	footer, err := r.read(16)
+	if err != nil || uint16(footer) != flacCRC16(r.data[start:r.pos>>3-2]) {
+		return nil, fmt.Errorf("invalid FLAC frame")
+	}
+	switch assignment {
+	case 8:
+		for i, side := range samples[1] {
+			samples[1][i] = samples[0][i] - side
+		}
+	case 9:
+		for i, side := range samples[0] {
+			samples[0][i] = side + samples[1][i]
+		}
+	case 10:
+		for i, side := range samples[1] {
+			mid := samples[0][i]<<1 | side&1
+			samples[0][i], samples[1][i] = (mid+side)>>1, (mid-side)>>1
+		}
+	}
+	return samples, nil
+}
+
+var flacFixedCoefficients = [5][]int64{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}
+
+func readFLACSubframe(r *bitReader, size, bits int) ([]int64, error) {
+	header, err := r.read(8)
+	if err != nil {
+		return nil, err
+	}
+	wasted := 0
+	if header&1 != 0 {
+		if wasted, err = r.unary(); err != nil {
+			return nil, err
+		}
+		wasted++
+		bits -= wasted
+	}
+	kind := int(header >> 1 & 0x3F)
+	samples := make([]int64, size)
+	switch {
+	case kind == 0:
+		v, err := r.readSigned(bits)
+		if err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			samples[i] = v
+		}
+	case kind == 1:
+		for i := range samples {
+			if samples[i], err = r.readSigned(bits); err != nil {
+				return nil, err
+			}
+		}
+	case kind >= 8 && kind <= 12, kind >= 32:
+		order, coefficients, shift := kind-8, flacFixedCoefficients[(kind-8)%5], int64(0)
+		if kind >= 32 {
+			order = kind - 31
+		}
+		if order > size {
+			return nil, fmt.Errorf("invalid FLAC subframe")
+		}
+		for i := 0; i < order; i++ {
+			if samples[i], err = r.readSigned(bits); err != nil {
+				return nil, err
+			}
+		}
+		if kind >= 32 {
+			precision, err := r.read(4)
+			if err != nil || precision == 15 {
+				return nil, fmt.Errorf("invalid FLAC subframe")
+			}
+			if shift, err = r.readSigned(5); err != nil || shift < 0 {
+				return nil, fmt.Errorf("invalid FLAC subframe")
+			}
+			coefficients = make([]int64, order)
+			for i := range coefficients {
+				if coefficients[i], err = r.readSigned(int(precision) + 1); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := readFLACResidual(r, samples, order); err != nil {
+			return nil, err
+		}
+		for i := order; i < size; i++ {
+			var sum int64
+			for j, c := range coefficients {
+				sum += c * samples[i-1-j]
+			}
+			samples[i] += sum >> uint(shift)
+		}
+	default:
+		return nil, fmt.Errorf("invalid FLAC subframe")
+	}
+	if wasted > 0 {
+		for i := range samples {
+			samples[i] <<= uint(wasted)
+		}
+	}
+	return samples, nil
+}
+
+// readFLACResidual reads the Rice coded residual of a subframe into the
+// samples after the warm-up samples.
+func readFLACResidual(r *bitReader, samples []int64, order int) error {
+	method, err := r.read(2)
+	if err != nil || method > 1 {
+		return fmt.Errorf("invalid FLAC residual")
+	}
+	parameterBits, escape := 4, uint64(15)
+	if method == 1 {
+		parameterBits, escape = 5, 31
+	}
+	partitionOrder, err := r.read(4)
+	if err != nil {
+		return err
+	}
+	partitions := 1 << partitionOrder
+	if len(samples)%partitions != 0 || len(samples)/partitions < order {
+		return fmt.Errorf("invalid FLAC residual")
+	}
+	i := order
+	for p := 0; p < partitions; p++ {
+		end := (p + 1) * len(samples) / partitions
+		parameter, err := r.read(parameterBits)
+		if err != nil {
+			return err
+		}
+		if parameter == escape {
+			bits, err := r.read(5)
+			if err != nil {
+				return err
+			}
+			for ; i < end; i++ {
+				if samples[i], err = r.readSigned(int(bits)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for ; i < end; i++ {
+			high, err := r.unary()
+			if err != nil {
+				return err
+			}
+			low, err := r.read(int(parameter))
+			if err != nil {
+				return err
+			}
+			u := uint64(high)<<parameter | low
+			samples[i] = int64(u>>1) ^ -int64(u&1)
+		}
+	}
+	return nil
+}
+
+// writeFLAC encodes the samples as a FLAC file. The metadata of the original
+// file is kept, except for the seek table, which doesn't fit the new frames.
+func writeFLAC(content []byte, audio *pcmAudio) ([]byte, error) {
+	blocks, start, _, err := flacMetadata(content)
+	if err != nil {
+		return nil, err
+	}
+	channels := len(audio.channels)
+	if channels == 0 || channels > 8 || audio.bits < 4 || audio.bits > 32 {
+		return nil, fmt.Errorf("unsupported FLAC format")
+	}
+	total := len(audio.channels[0])
+	sum := md5.New()
+	var frames []byte
+	minFrame, maxFrame := 0, 0
+	samples := make([][]int64, channels)
+	sampleBytes := (audio.bits + 7) / 8
+	buf := make([]byte, 0, flacBlockSize*channels*sampleBytes)
+	limit := audio.fullScale()
+	for number, start := 0, 0; start < total; number, start = number+1, start+flacBlockSize {
+		end := start + flacBlockSize
+		if end > total {
+			end = total
+		}
+		buf = buf[:0]
+		for c := range samples {
+			samples[c] = samples[c][:0]
+			for _, v := range audio.channels[c][start:end] {
+				samples[c] = append(samples[c], int64(math.Max(-limit, math.Min(limit-1, math.Round(float64(v))))))
+			}
+		}
+		for i := 0; i < end-start; i++ {
+			for c := range samples {
+				v := samples[c][i]
+				for b := 0; b < sampleBytes; b++ {
+					buf = append(buf, byte(v>>(8*b)))
+				}
+			}
+		}
+		sum.Write(buf)
+		frame := encodeFLACFrame(samples, audio.bits, number)
+		if minFrame == 0 || len(frame) < minFrame {
+			minFrame = len(frame)
+		}
+		if len(frame) > maxFrame {
+			maxFrame = len(frame)
+		}
+		frames = append(frames, frame...)
+	}
+	info := make([]byte, 34)
+	blockSize := flacBlockSize
+	if total < blockSize {
+		blockSize = total
+	}
+	binary.BigEndian.PutUint16(info[0:], uint16(blockSize))
+	binary.BigEndian.PutUint16(info[2:], uint16(blockSize))
+	info[4], info[5], info[6] = byte(minFrame>>16), byte(minFrame>>8), byte(minFrame)
+	info[7], info[8], info[9] = byte(maxFrame>>16), byte(maxFrame>>8), byte(maxFrame)
+	binary.BigEndian.PutUint64(info[10:], uint64(audio.rate)<<44|uint64(channels-1)<<41|uint64(audio.bits-1)<<36|uint64(total))
+	copy(info[18:], sum.Sum(nil))
+	kept := []flacBlock{{flacStreamInfo, info}}
+	for _, block := range blocks[1:] {
+		if block.kind != flacSeekTable {
+			kept = append(kept, block)
+		}
+	}
+	return concat(content[:start], writeFLACMetadata(kept), frames), nil
+}
+
+func encodeFLACFrame(samples [][]int64, bits, number int) []byte {
+	size := len(samples[0])
+	assignment := len(samples) - 1
+	subframes := samples
+	subframeBits := make([]int, len(samples))
+	for c := range subframeBits {
+		subframeBits[c] = bits
+	}
+	if len(samples) == 2 && bits < 32 {
+		left, right := samples[0], samples[1]
+		side := make([]int64, size)
+		mid := make([]int64, size)
+		for i := range side {
+			side[i] = left[i] - right[i]
+			mid[i] = (left[i] + right[i]) >> 1
+		}
+		costs := [4]uint64{flacCost(left) + flacCost(right), flacCost(left) + flacCost(side), flacCost(side) + flacCost(right), flacCost(mid) + flacCost(side)}
+		best := 0
+		for i, cost := range costs {
+			if cost < costs[best] {
+				best = i
+			}
+		}
+		switch best {
+		case 1:
+			assignment, subframes, subframeBits = 8, [][]int64{left, side}, []int{bits, bits + 1}
+		case 2:
+			assignment, subframes, subframeBits = 9, [][]int64{side, right}, []int{bits + 1, bits}
+		case 3:
+			assignment, subframes, subframeBits = 10, [][]int64{mid, side}, []int{bits, bits + 1}
+		}
+	}
+	w := &bitWriter{}
+	blockCode := 12
+	if size != flacBlockSize {
+		blockCode = 7
+	}
+	sizeCode := 0
+	for code, value := range flacSampleSizes {
+		if value == bits && code > 0 {
+			sizeCode = code
+		}
+	}
+	w.write(0xFFF8, 16)
+	w.write(uint64(blockCode), 4)
+	w.write(0, 4)
+	w.write(uint64(assignment), 4)
+	w.write(uint64(sizeCode), 3)
+	w.write(0, 1)
+	w.data = append(w.data, flacUTF8(number)...)
+	if blockCode == 7 {
+		w.write(uint64(size-1), 16)
+	}
+	w.data = append(w.data, flacCRC8(w.data))
+	for c, subframe := range subframes {
+		encodeFLACSubframe(w, subframe, subframeBits[c])
+	}
+	w.align()
+	crc := flacCRC16(w.data)
+	return append(w.data, byte(crc>>8), byte(crc))
+}
+
+// flacUTF8 codes the number of a frame like UTF-8, with up to 36 bits.
+func flacUTF8(v int) []byte {
+	if v < 0x80 {
+		return []byte{byte(v)}
+	}
+	n := 2
+	for v >= 1<<uint(5*n+1) {
+		n++
+	}
+	out := []byte{byte(0xFF<<uint(8-n)) | byte(v>>uint(6*(n-1)))}
+	for i := n - 2; i >= 0; i-- {
+		out = append(out, 0x80|byte(v>>uint(6*i))&0x3F)
+	}
+	return out
+}
+
+// flacCost estimates the size of a channel with the second order predictor,
+// which is enough to choose the stereo decorrelation.
+func flacCost(samples []int64) uint64 {
+	var sum uint64
+	for i := 2; i < len(samples); i++ {
+		d := samples[i] - 2*samples[i-1] + samples[i-2]
+		if d < 0 {
+			d = -d
+		}
+		sum += uint64(d)
+	}
+	return sum
+}
+
+func encodeFLACSubframe(w *bitWriter, samples []int64, bits int) {
+	constant := true
+	for _, v := range samples {
+		if v != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		w.write(0, 8)
+		w.writeSigned(samples[0], bits)
+		return
+	}
+	bestOrder, bestCost := -1, uint64(0)
+	residual := make([]int64, len(samples))
+	for order := 0; order <= 4 && order < len(samples); order++ {
+		var cost uint64
+		for i := order; i < len(samples); i++ {
+			d := flacFixedResidual(samples, i, order)
+			if d < 0 {
+				d = -d
+			}
+			cost += uint64(d)
+		}
+		if bestOrder < 0 || cost < bestCost {
+			bestOrder, bestCost = order, cost
+		}
+	}
+	for i := bestOrder; i < len(samples); i++ {
+		residual[i] = flacFixedResidual(samples, i, bestOrder)
+	}
+	var rice bitWriter
+	writeFLACResidual(&rice, residual, bestOrder)
+	if 8+bestOrder*bits+8*len(rice.data)+rice.bits >= 8+len(samples)*bits {
+		w.write(1<<1, 8)
+		for _, v := range samples {
+			w.writeSigned(v, bits)
+		}
+		return
+	}
+	w.write(uint64(8+bestOrder)<<1, 8)
+	for _, v := range samples[:bestOrder] {
+		w.writeSigned(v, bits)
+	}
+	for _, b := range rice.data {
+		w.write(uint64(b), 8)
+	}
+	w.write(rice.cache&(1<<rice.bits-1), rice.bits)
+}
+
+func flacFixedResidual(samples []int64, i, order int) int64 {
+	v := samples[i]
+	for j, c := range flacFixedCoefficients[order] {
+		v -= c * samples[i-1-j]
+	}
+	return v
+}
+
+// writeFLACResidual writes the residual with the partition order and the
+// Rice parameters that make it the smallest.
+func writeFLACResidual(w *bitWriter, residual []int64, order int) {
+	size := len(residual)
+	folded := make([]uint64, size)
+	for i := order; i < size; i++ {
+		folded[i] = uint64(residual[i]<<1) ^ uint64(residual[i]>>63)
+	}
+	bestBits, bestOrder := uint64(0), -1
+	var bestParameters []int
+	for partitionOrder := 0; partitionOrder <= flacMaxPartitionBits; partitionOrder++ {
+		partitions := 1 << partitionOrder
+		if size%partitions != 0 || size/partitions <= order {
+			break
+		}
+		total := uint64(6)
+		parameters := make([]int, partitions)
+		for p := range parameters {
+			start, end := p*size/partitions, (p+1)*size/partitions
+			if p == 0 {
+				start = order
+			}
+			var bits uint64
+			parameters[p], bits = flacRiceParameter(folded[start:end])
+			total += bits
+		}
+		if bestOrder < 0 || total < bestBits {
+			bestBits, bestOrder, bestParameters = total, partitionOrder, parameters
+		}
+	}
+	method, parameterBits := uint64(0), 4
+	for _, p := range bestParameters {
+		if p >= 15 {
+			method, parameterBits = 1, 5
+		}
+	}
+	w.write(method, 2)
+	w.write(uint64(bestOrder), 4)
+	partitions := 1 << bestOrder
+	for p, parameter := range bestParameters {
+		start, end := p*size/partitions, (p+1)*size/partitions
+		if p == 0 {
+			start = order
+		}
+		w.write(uint64(parameter), parameterBits)
+		for _, u := range folded[start:end] {
+			for q := u >> uint(parameter); q > 0; {
+				n := q
+				if n > 32 {
+					n = 32
+				}
+				w.write(0, int(n))
+				q -= n
+			}
+			w.write(1, 1)
+			w.write(u&(1<<uint(parameter)-1), parameter)
+		}
+	}
+}
+
+// flacRiceParameter returns the Rice parameter that codes the values in the
+// fewest bits, with the number of bits including the parameter itself.
+func flacRiceParameter(values []uint64) (int, uint64) {
+	var sum uint64
+	for _, u := range values {
+		sum += u
+	}
+	guess := 0
+	for n := uint64(len(values)); n > 0 && guess < 30 && sum > n<<uint(guess+1); {
+		guess++
+	}
+	best, bestBits := 0, uint64(0)
+	for parameter := guess - 1; parameter <= guess+1; parameter++ {
+		if parameter < 0 || parameter > 30 {
+			continue
+		}
+		bits := uint64(5 + (parameter+1)*len(values))
+		for _, u := range values {
+			bits += u >> uint(parameter)
+		}
+		if bestBits == 0 || bits < bestBits {
+			best, bestBits = parameter, bits
+		}
+	}
+	return best, bestBits
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// testFLACFile returns the header of a FLAC file after an ID3v2 tag with a
+// footer, as some taggers write it.
+func testFLACFile() []byte {
+	tag := []byte{'I', 'D', '3', 4, 0, 0x10, 0, 0, 1, 0}
+	tag = append(tag, make([]byte, 128)...)
+	tag = append(tag, '3', 'D', 'I', 4, 0, 0x10, 0, 0, 1, 0)
+	header := writeFLACMetadata([]flacBlock{
+		{flacStreamInfo, make([]byte, 34)},
+		{flacVorbisComment, []byte("comment")},
+	})
+	return append(tag, header...)
+}
+
+func TestFLACRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, bits := range []int{8, 16, 24} {
+		for _, channels := range []int{1, 2} {
+			audio := &pcmAudio{rate: 44100, bits: bits, channels: make([][]float32, channels)}
+			limit := audio.fullScale()
+			for c := range audio.channels {
+				// a sine, a constant and noise, and a last block that
+				// isn't full
+				for i := 0; i < 3*flacBlockSize+1000; i++ {
+					v := math.Round(0.6 * limit * math.Sin(float64(i)/(20+float64(c))))
+					if i/flacBlockSize == 1 {
+						v = float64(c) - 3
+					} else if i/flacBlockSize == 2 {
+						v = math.Round(rng.NormFloat64() * limit / 8)
+					}
+					audio.channels[c] = append(audio.channels[c], float32(math.Max(-limit, math.Min(limit-1, v))))
+				}
+			}
+			encoded, err := writeFLAC(testFLACFile(), audio)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := readFLAC(encoded)
+			if err != nil {
+				t.Fatalf("%d bits, %d channels: %v", bits, channels, err)
+			}
+			if decoded.rate != audio.rate || decoded.bits != bits || !reflect.DeepEqual(decoded.channels, audio.channels) {
+				t.Errorf("%d bits, %d channels: the samples changed", bits, channels)
+			}
+			blocks, start, _, err := flacMetadata(encoded)
+			if err != nil || start != 148 || len(blocks) != 2 || string(blocks[1].data) != "comment" {
+				t.Errorf("%d bits, %d channels: the metadata after the ID3 tag changed", bits, channels)
+			}
+		}
+	}
+}
+
+func TestFLACClampsSamples(t *testing.T) {
+	audio := &pcmAudio{rate: 8000, bits: 16, channels: [][]float32{make([]float32, 1000)}}
+	for i := range audio.channels[0] {
+		audio.channels[0][i] = float32(40000 * math.Sin(float64(i)/10))
+	}
+	encoded, err := writeFLAC(testFLACFile(), audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := readFLAC(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range decoded.channels[0] {
+		want := math.Max(-32768, math.Min(32767, math.Round(float64(audio.channels[0][i]))))
+		if float64(v) != want {
+			t.Fatalf("sample %d is %g, want %g", i, v, want)
+		}
+	}
+}
+
+func TestFLACTruncated(t *testing.T) {
+	audio := &pcmAudio{rate: 8000, bits: 16, channels: [][]float32{make([]float32, 3*flacBlockSize)}}
+	for i := range audio.channels[0] {
+		audio.channels[0][i] = float32(math.Round(1000 * math.Sin(float64(i)/10)))
+	}
+	encoded, err := writeFLAC(testFLACFile(), audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFLAC(encoded[:len(encoded)-100]); err == nil {
+		t.Error("a truncated FLAC file was decoded")
+	}
+}
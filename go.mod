@@ -9,6 +9,7 @@ require (
 	github.com/google/uuid v1.3.0
 	github.com/pdfcpu/pdfcpu v0.3.13
 	github.com/sendgrid/sendgrid-go v3.10.5+incompatible
+	golang.org/x/text v0.3.6
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
 )
 
@@ -22,7 +23,6 @@ require (
 	github.com/sendgrid/rest v2.6.7+incompatible // indirect
 	golang.org/x/image v0.0.0-20210220032944-ac19c3e999fb // indirect
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
-	golang.org/x/text v0.3.6 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// Latin letters and the Cyrillic or Greek letters that look the same.
+var homoglyphs = map[rune]rune{
+	'a': '\u0430', 'c': '\u0441', 'e': '\u0435', 'o': '\u043e', 'p': '\u0440', 'x': '\u0445',
+	'y': '\u0443', 'i': '\u0456', 'j': '\u0458', 's': '\u0455',
+	'A': '\u0410', 'B': '\u0412', 'C': '\u0421', 'E': '\u0415', 'H': '\u041d', 'I': '\u0406',
+	'J': '\u0408', 'K': '\u041a', 'M': '\u041c', 'N': '\u039d', 'O': '\u041e', 'P': '\u0420',
+	'S': '\u0405', 'T': '\u0422', 'X': '\u0425', 'Y': '\u03a5', 'Z': '\u0396',
+}
+
+var homoglyphLatin = reverseHomoglyphs()
+
+const homoglyphOrder = "aceopxyijsABCEHIJKMNOPSTXYZ"
+
+// In text, a letter is swapped when a keyed hash of the letters around it
+// selects it for the recipient, so an excerpt can be attributed without
+// knowing where it was cut from the document. PDF text is drawn with glyphs
+// that can't be replaced, so the font's ToUnicode map is changed instead and a
+// recipient specific set of letters turns into homoglyphs when it is copied.
+const (
+	homoglyphContext     = 8
+	homoglyphRate        = 16
+	homoglyphFontLetters = 4
+	minHomoglyphMatch    = 3
+)
+
+type textSpan struct {
+	start, end int
+}
+
+type homoglyphLetter struct {
+	offset   int
+	normal   rune
+	original rune
+}
+
+// homoglyphRecord holds what was swapped for a recipient: the context keys of
+// the substituted letters in text and the letters remapped in PDF fonts.
+type homoglyphRecord struct {
+	contexts map[string]bool
+	letters  map[rune]bool
+}
+
+type homoglyphObservation struct {
+	contexts map[string]bool
+	swapped  map[rune]bool
+}
+
+func reverseHomoglyphs() map[rune]rune {
+	latin := make(map[rune]rune)
+	for l, h := range homoglyphs {
+		latin[h] = l
+	}
+	return latin
+}
+
+func isHomoglyphText(extension string) bool {
+	switch strings.ToLower(extension) {
+	case ".txt", ".md", ".markdown", ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+func isHTML(extension string) bool {
+	extension = strings.ToLower(extension)
+	return extension == ".html" || extension == ".htm"
+}
+
+func addHomoglyphSignature(projectDir, file, signature string) {
+	extension := strings.ToLower(filepath.Ext(file))
+	var kind string
+	var entries []string
+	switch {
+	case extension == ".pdf":
+		letters := homoglyphFontSet(signature)
+		err := addHomoglyphPDF(file, letters)
+		if err != nil {
+			color.Red("Error occurred while adding homoglyphs to the PDF file")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		kind = "font"
+		for _, l := range letters {
+			entries = append(entries, string(l))
+		}
+	case extension == ".docx":
+		content, err := readZipFile(file, "word/document.xml")
+		if err != nil {
+			color.Red("Error occurred while reading word/document.xml")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		var newContent string
+		newContent, entries = substituteHomoglyphs(string(content), xmlElementSpans(string(content), "w:t"), true, signature)
+		err = writeOfficeParts(file, map[string][]byte{"word/document.xml": []byte(newContent)})
+		if err != nil {
+			color.Red("Error occurred while writing word/document.xml")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		kind = "text"
+	case isHomoglyphText(extension):
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			color.Red("Error occurred while reading the text file")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if !utf8.Valid(content) {
+			return
+		}
+		text := string(content)
+		spans := []textSpan{{0, len(text)}}
+		if isHTML(extension) {
+			spans = htmlTextSpans(text)
+		} else if isMarkdown(extension) {
+			spans = markdownTextSpans(text)
+		}
+		text, entries = substituteHomoglyphs(text, spans, isHTML(extension), signature)
+		err = ioutil.WriteFile(file, []byte(text), 0644)
+		if err != nil {
+			color.Red("Error occurred while writing the text file")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		kind = "text"
+	default:
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(projectDir, "homoglyph.csv"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		color.Red("Can't write to the homoglyph database")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	_, err = f.WriteString(signature + "," + kind + "," + strings.Join(entries, " ") + "\n")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// homoglyphFontSet picks the letters that are remapped in the fonts of the
+// recipient's PDF: mostly common lowercase letters, so that a short excerpt
+// shows all of them, and one capital letter.
+func homoglyphFontSet(signature string) []rune {
+	lower := []rune(homoglyphOrder[:10])
+	upper := []rune(homoglyphOrder[10:])
+	var letters []rune
+	sum := sha256.Sum256([]byte(signature))
+	for _, b := range sum[:homoglyphFontLetters-1] {
+		i := int(b) % len(lower)
+		letters = append(letters, lower[i])
+		lower = append(lower[:i], lower[i+1:]...)
+	}
+	return append(letters, upper[int(sum[homoglyphFontLetters])%len(upper)])
+}
+
+func addHomoglyphPDF(file string, letters []rune) error {
+	swap := make(map[string]string)
+	for _, l := range letters {
+		swap[string(l)] = string(homoglyphs[l])
+	}
+	ctx, err := api.ReadContextFile(file)
+	if err != nil {
+		return err
+	}
+	for _, font := range pdfFonts(ctx) {
+		mapping, ok := readFontUnicode(ctx, font)
+		if !ok {
+			continue
+		}
+		changed := false
+		for code, text := range mapping.text {
+			if h, found := swap[text]; found {
+				mapping.text[code] = h
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		sd, err := ctx.NewStreamDictForBuf(toUnicodeCMap(mapping))
+		if err != nil {
+			return err
+		}
+		if err = sd.Encode(); err != nil {
+			return err
+		}
+		ir, err := ctx.IndRefForNewObject(*sd)
+		if err != nil {
+			return err
+		}
+		font.Update("ToUnicode", *ir)
+	}
+	return writePDFContext(ctx, file)
+}
+
+// homoglyphStream returns the letters and digits of the text inside spans.
+// Entities are skipped in escaped (HTML and XML) content.
+func homoglyphStream(content string, spans []textSpan, escaped bool) []homoglyphLetter {
+	var letters []homoglyphLetter
+	for _, span := range spans {
+		for i := span.start; i < span.end; {
+			r, size := utf8.DecodeRuneInString(content[i:span.end])
+			if escaped && r == '&' {
+				if end := strings.IndexByte(content[i:span.end], ';'); end > 0 && end < 12 {
+					i += end + 1
+					continue
+				}
+			}
+			normal := r
+			if l, found := homoglyphLatin[r]; found {
+				normal = l
+			}
+			if unicode.IsLetter(normal) || unicode.IsDigit(normal) {
+				letters = append(letters, homoglyphLetter{i, unicode.ToLower(normal), r})
+			}
+			i += size
+		}
+	}
+	return letters
+}
+
+func homoglyphContextKey(letters []homoglyphLetter, i int) string {
+	var sb strings.Builder
+	for j := i - homoglyphContext; j <= i+homoglyphContext; j++ {
+		if j >= 0 && j < len(letters) {
+			sb.WriteRune(letters[j].normal)
+		}
+		if j == i-1 || j == i {
+			sb.WriteByte('|')
+		}
+	}
+	sum := sha256.Sum256([]byte(sb.String()))
+	return hex.EncodeToString(sum[:6])
+}
+
+func isHomoglyphSelected(signature, key string) bool {
+	sum := sha256.Sum256([]byte(signature + key))
+	return int(sum[0]) < 256/homoglyphRate
+}
+
+// substituteHomoglyphs swaps the selected letters and returns the new content
+// with the substitution positions as "index:context" entries.
+func substituteHomoglyphs(content string, spans []textSpan, escaped bool, signature string) (string, []string) {
+	letters := homoglyphStream(content, spans, escaped)
+	var out strings.Builder
+	var entries []string
+	last := 0
+	for i, letter := range letters {
+		h, found := homoglyphs[letter.original]
+		if !found {
+			continue
+		}
+		key := homoglyphContextKey(letters, i)
+		if !isHomoglyphSelected(signature, key) {
+			continue
+		}
+		out.WriteString(content[last:letter.offset])
+		out.WriteRune(h)
+		last = letter.offset + utf8.RuneLen(letter.original)
+		entries = append(entries, fmt.Sprintf("%d:%s", i, key))
+	}
+	out.WriteString(content[last:])
+	return out.String(), entries
+}
+
+func markdownTextSpans(text string) []textSpan {
+	var spans []textSpan
+	fenced := false
+	offset := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		start := offset
+		offset += len(line)
+		trimmed := strings.TrimLeft(line, " ")
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fenced = !fenced
+			continue
+		}
+		if fenced || strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		for i, part := range strings.Split(line, "`") {
+			if i%2 == 0 {
+				spans = append(spans, textSpan{start, start + len(part)})
+			}
+			start += len(part) + 1
+		}
+	}
+	return spans
+}
+
+// htmlTextSpans returns the text between the tags, skipping comments, scripts
+// and styles.
+func htmlTextSpans(text string) []textSpan {
+	var spans []textSpan
+	lower := strings.ToLower(text)
+	for i := 0; i < len(text); {
+		next := strings.IndexByte(text[i:], '<')
+		if next < 0 {
+			spans = append(spans, textSpan{i, len(text)})
+			break
+		}
+		spans = append(spans, textSpan{i, i + next})
+		i += next
+		end := ""
+		switch {
+		case strings.HasPrefix(lower[i:], "<!--"):
+			end = "-->"
+		case strings.HasPrefix(lower[i:], "<script"):
+			end = "</script>"
+		case strings.HasPrefix(lower[i:], "<style"):
+			end = "</style>"
+		default:
+			end = ">"
+		}
+		closing := strings.Index(lower[i:], end)
+		if closing < 0 {
+			break
+		}
+		i += closing + len(end)
+	}
+	return spans
+}
+
+// xmlElementSpans returns the text content of every element with the given
+// tag name.
+func xmlElementSpans(content, tag string) []textSpan {
+	var spans []textSpan
+	open := "<" + tag
+	closing := "</" + tag + ">"
+	for i := 0; i < len(content); {
+		start := strings.Index(content[i:], open)
+		if start < 0 {
+			break
+		}
+		start += i
+		i = start + len(open)
+		if i >= len(content) || (content[i] != '>' && content[i] != ' ') {
+			continue
+		}
+		end := strings.IndexByte(content[i:], '>')
+		if end < 0 || content[i+end-1] == '/' {
+			continue
+		}
+		textStart := i + end + 1
+		textEnd := strings.Index(content[textStart:], closing)
+		if textEnd < 0 {
+			break
+		}
+		spans = append(spans, textSpan{textStart, textStart + textEnd})
+		i = textStart + textEnd + len(closing)
+	}
+	return spans
+}
+
+func readHomoglyphRecords(file string) map[string]homoglyphRecord {
+	records := make(map[string]homoglyphRecord)
+	f, err := os.Open(file)
+	if err != nil {
+		return records
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ",", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		record, found := records[fields[0]]
+		if !found {
+			record = homoglyphRecord{make(map[string]bool), make(map[rune]bool)}
+			records[fields[0]] = record
+		}
+		for _, entry := range strings.Fields(fields[2]) {
+			switch fields[1] {
+			case "text":
+				if i := strings.IndexByte(entry, ':'); i >= 0 {
+					record.contexts[entry[i+1:]] = true
+				}
+			case "font":
+				r, _ := utf8.DecodeRuneInString(entry)
+				record.letters[r] = true
+			}
+		}
+	}
+	return records
+}
+
+// observeHomoglyphs collects the homoglyphs of a leaked file. Swapped letters
+// are only reported for letters that appear often enough to tell.
+func observeHomoglyphs(file string) homoglyphObservation {
+	observation := homoglyphObservation{make(map[string]bool), make(map[rune]bool)}
+	extension := strings.ToLower(filepath.Ext(file))
+	if extension == ".pdf" {
+		ctx, err := api.ReadContextFile(file)
+		if err != nil {
+			return observation
+		}
+		for _, font := range pdfFonts(ctx) {
+			mapping, ok := readFontUnicode(ctx, font)
+			if !ok {
+				continue
+			}
+			for _, text := range mapping.text {
+				r, _ := utf8.DecodeRuneInString(text)
+				if l, found := homoglyphLatin[r]; found {
+					observation.swapped[l] = true
+				} else if _, found := homoglyphs[r]; found && !observation.swapped[r] {
+					observation.swapped[r] = false
+				}
+			}
+		}
+		return observation
+	}
+	var content string
+	var spans []textSpan
+	if extension == ".docx" {
+		document, err := readZipFile(file, "word/document.xml")
+		if err != nil {
+			return observation
+		}
+		content = string(document)
+		spans = xmlElementSpans(content, "w:t")
+	} else {
+		data, err := ioutil.ReadFile(file)
+		if err != nil || !utf8.Valid(data) {
+			return observation
+		}
+		content = string(data)
+		spans = []textSpan{{0, len(content)}}
+		if isHTML(extension) {
+			spans = htmlTextSpans(content)
+		}
+	}
+	letters := homoglyphStream(content, spans, isHTML(extension) || extension == ".docx")
+	counts := make(map[rune][2]int)
+	for i, letter := range letters {
+		l, swapped := homoglyphLatin[letter.original]
+		if !swapped {
+			l = letter.original
+		}
+		count := counts[l]
+		if swapped {
+			count[1]++
+			observation.contexts[homoglyphContextKey(letters, i)] = true
+		} else {
+			count[0]++
+		}
+		counts[l] = count
+	}
+	for l, count := range counts {
+		if _, found := homoglyphs[l]; found && count[0]+count[1] >= minHomoglyphMatch {
+			observation.swapped[l] = count[1]*2 >= count[0]+count[1]
+		}
+	}
+	return observation
+}
+
+// matches reports whether the homoglyphs of a leaked file belong to the
+// record of a recipient.
+func (o homoglyphObservation) matches(record homoglyphRecord) bool {
+	hits := 0
+	for key := range o.contexts {
+		if record.contexts[key] {
+			hits++
+		}
+	}
+	if hits >= minHomoglyphMatch && hits*2 >= len(o.contexts) {
+		return true
+	}
+	if len(record.letters) == 0 {
+		return false
+	}
+	swapped := 0
+	for l, isSwapped := range o.swapped {
+		if isSwapped != record.letters[l] {
+			return false
+		}
+		if isSwapped {
+			swapped++
+		}
+	}
+	return swapped >= 2
+}
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Metadata and appended data are lost as soon as a picture is re-encoded,
+// which every chat app does. The pixel watermark is a faint pattern in the
+// brightness of the image: a tile of pseudo-random cells derived from the
+// signature, repeated over the whole picture. It's added to the low
+// frequencies of 8x8 DCT blocks, more strongly in busy blocks where it's hard
+// to see, so JPEG compression keeps it. Because the tile repeats, a crop only
+// shifts it and a resize only changes its period. The detector finds the
+// period, folds the leaked image onto a single tile and correlates the tile
+// with the one of every recipient.
+//
+// PNG files also get the signature in the lowest bit of the blue channel,
+// which is read back exactly as long as the pixels are unchanged.
+const (
+	imageMarkTile      = 32
+	imageMarkCellRatio = 160
+	imageMarkMinCell   = 3.0
+	imageMarkMinSide   = 64
+	imageMarkStrength  = 2.0
+	imageMarkBand      = 6
+	imageMarkClip      = 1.0
+	imageMarkMaxCrop   = 0.2
+	imageMarkMaxPixels = 2000000
+	minImageMarkScore  = 7.0
+)
+
+func isPixelImage(extension string) bool {
+	switch strings.ToLower(extension) {
+	case ".png", ".jpg", ".jpeg":
+		return true
+	}
+	return false
+}
+
+// addImageWatermark adds the pixel watermark to a PNG or JPEG file and
+// records the size of the image, which the detector needs to find the period
+// of the pattern in a resized copy.
+func addImageWatermark(projectDir, file, signature string) {
+	width, height, err := addImageMark(file, signature)
+	if err != nil {
+		color.Red("Couldn't add the watermark to the image, skipping it")
+		fmt.Println(err)
+		return
+	}
+	if width == 0 {
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(projectDir, "imagemark.csv"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		color.Red("Can't write to the image watermark database")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	_, err = f.WriteString(fmt.Sprintf("%s,%d,%d\n", signature, width, height))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// addImageMark returns the size of the watermarked image, or zero if the
+// image is too small or its color model isn't supported.
+func addImageMark(file, signature string) (int, int, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	var img image.Image
+	if strings.ToLower(filepath.Ext(file)) == ".png" {
+		img, err = png.Decode(bytes.NewReader(content))
+	} else {
+		img, err = jpeg.Decode(bytes.NewReader(content))
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width < imageMarkMinSide || height < imageMarkMinSide {
+		return 0, 0, nil
+	}
+	luma := imageLuma(img)
+	rng := rand.New(rand.NewSource(imageMarkSeed("dither", signature)))
+	if !addImageLuma(img, imageMarkDelta(luma, width, height, signature), rng) {
+		return 0, 0, nil
+	}
+	if strings.ToLower(filepath.Ext(file)) == ".png" {
+		addLSBSignature(img, signature)
+		content, err = encodePNGLike(content, img)
+	} else {
+		content, err = encodeJPEGLike(content, img)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return width, height, ioutil.WriteFile(file, content, 0644)
+}
+
+func imageMarkSeed(use, signature string) int64 {
+	sum := sha256.Sum256([]byte("wholeaked image " + use + " " + signature))
+	return int64(binary.BigEndian.Uint64(sum[:]))
+}
+
+// imageMarkPattern returns the tile of a recipient, one value of -1 or 1 per
+// cell.
+func imageMarkPattern(signature string) []float64 {
+	rng := rand.New(rand.NewSource(imageMarkSeed("tile", signature)))
+	tile := make([]float64, imageMarkTile*imageMarkTile)
+	for i := range tile {
+		tile[i] = float64(rng.Intn(2)*2 - 1)
+	}
+	return tile
+}
+
+// imageMarkCell returns the size of a cell of the tile in pixels. It grows
+// with the image, so the pattern is still a few pixels wide when a large
+// picture is scaled down.
+func imageMarkCell(width, height int) float64 {
+	side := width
+	if height < side {
+		side = height
+	}
+	return math.Max(float64(side)/imageMarkCellRatio, imageMarkMinCell)
+}
+
+// tileAxis returns the two cells a pixel lies between and the weight of the
+// second one, so the pattern changes smoothly from cell to cell.
+func tileAxis(n int, cell float64) ([]int, []int, []float64) {
+	first, second, weight := make([]int, n), make([]int, n), make([]float64, n)
+	for i := range first {
+		position := float64(i) / cell
+		cellIndex := math.Floor(position)
+		first[i] = int(cellIndex) % imageMarkTile
+		second[i] = (first[i] + 1) % imageMarkTile
+		weight[i] = position - cellIndex
+	}
+	return first, second, weight
+}
+
+// imageMarkDelta returns the change of brightness of every pixel. The pattern
+// is transformed block by block, cut to the low frequencies and scaled by how
+// busy the block is.
+func imageMarkDelta(luma []float64, width, height int, signature string) []float64 {
+	tile := imageMarkPattern(signature)
+	cell := imageMarkCell(width, height)
+	x0, x1, wx := tileAxis(width, cell)
+	y0, y1, wy := tileAxis(height, cell)
+	delta := make([]float64, width*height)
+	var block, pattern [64]float64
+	for by := 0; by+8 <= height; by += 8 {
+		for bx := 0; bx+8 <= width; bx += 8 {
+			for y := 0; y < 8; y++ {
+				row0, row1, fy := y0[by+y]*imageMarkTile, y1[by+y]*imageMarkTile, wy[by+y]
+				for x := 0; x < 8; x++ {
+					i, fx := bx+x, wx[bx+x]
+					block[y*8+x] = luma[(by+y)*width+i]
+					pattern[y*8+x] = (1-fy)*((1-fx)*tile[row0+x0[i]]+fx*tile[row0+x1[i]]) +
+						fy*((1-fx)*tile[row1+x0[i]]+fx*tile[row1+x1[i]])
+				}
+			}
+			dct8(&block, false)
+			dct8(&pattern, false)
+			activity := 0.0
+			for i := 1; i < 64; i++ {
+				activity += block[i] * block[i]
+			}
+			// The AC energy of an orthonormal 8x8 DCT is 64 times the variance
+			// of the pixels.
+			strength := imageMarkStrength * math.Min(math.Max(0.5+math.Sqrt(activity)/8/16, 1), 3)
+			for v := 0; v < 8; v++ {
+				for u := 0; u < 8; u++ {
+					if u+v > imageMarkBand {
+						pattern[v*8+u] = 0
+					} else {
+						pattern[v*8+u] *= strength
+					}
+				}
+			}
+			dct8(&pattern, true)
+			for y := 0; y < 8; y++ {
+				copy(delta[(by+y)*width+bx:(by+y)*width+bx+8], pattern[y*8:y*8+8])
+			}
+		}
+	}
+	return delta
+}
+
+var dctBasis = func() [8][8]float64 {
+	var basis [8][8]float64
+	for k := 0; k < 8; k++ {
+		scale := math.Sqrt(2.0 / 8)
+		if k == 0 {
+			scale = math.Sqrt(1.0 / 8)
+		}
+		for n := 0; n < 8; n++ {
+			basis[k][n] = scale * math.Cos(float64(2*n+1)*float64(k)*math.Pi/16)
+		}
+	}
+	return basis
+}()
+
+// dct8 applies the orthonormal 8x8 DCT to a block, or its inverse.
+func dct8(block *[64]float64, inverse bool) {
+	var line [8]float64
+	for pass := 0; pass < 2; pass++ {
+		for a := 0; a < 8; a++ {
+			// The first pass works on the rows, the second on the columns.
+			at := func(b int) int {
+				if pass == 0 {
+					return a*8 + b
+				}
+				return b*8 + a
+			}
+			for k := 0; k < 8; k++ {
+				sum := 0.0
+				for n := 0; n < 8; n++ {
+					if inverse {
+						sum += dctBasis[n][k] * block[at(n)]
+					} else {
+						sum += dctBasis[k][n] * block[at(n)]
+					}
+				}
+				line[k] = sum
+			}
+			for k := 0; k < 8; k++ {
+				block[at(k)] = line[k]
+			}
+		}
+	}
+}
+
+// imageLuma returns the brightness of every pixel of an image.
+func imageLuma(img image.Image) []float64 {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	luma := make([]float64, width*height)
+	switch m := img.(type) {
+	case *image.YCbCr:
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				luma[y*width+x] = float64(m.Y[m.YOffset(b.Min.X+x, b.Min.Y+y)])
+			}
+		}
+	case *image.Gray:
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				luma[y*width+x] = float64(m.Pix[m.PixOffset(b.Min.X+x, b.Min.Y+y)])
+			}
+		}
+	default:
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				luma[y*width+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+			}
+		}
+	}
+	return luma
+}
+
+// addImageLuma changes the brightness of every pixel of an image in place.
+// Values are rounded up or down at random in proportion to the fraction, so
+// changes smaller than one level still add up. It returns false if the color
+// model isn't supported.
+func addImageLuma(img image.Image, delta []float64, rng *rand.Rand) bool {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	add8 := func(p []byte, i int, d float64) {
+		p[i] = byte(math.Min(math.Max(math.Floor(float64(p[i])+d+rng.Float64()), 0), 255))
+	}
+	add16 := func(p []byte, i int, d float64) {
+		value := math.Floor(float64(binary.BigEndian.Uint16(p[i:])) + d*257 + rng.Float64())
+		binary.BigEndian.PutUint16(p[i:], uint16(math.Min(math.Max(value, 0), 65535)))
+	}
+	switch img.(type) {
+	case *image.YCbCr, *image.Gray, *image.Gray16, *image.RGBA, *image.NRGBA, *image.RGBA64, *image.NRGBA64:
+	default:
+		return false
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			d := delta[y*width+x]
+			if d == 0 {
+				continue
+			}
+			px, py := b.Min.X+x, b.Min.Y+y
+			switch m := img.(type) {
+			case *image.YCbCr:
+				add8(m.Y, m.YOffset(px, py), d)
+			case *image.Gray:
+				add8(m.Pix, m.PixOffset(px, py), d)
+			case *image.Gray16:
+				add16(m.Pix, m.PixOffset(px, py), d)
+			case *image.RGBA, *image.NRGBA:
+				// The PNG decoder only returns RGBA for opaque images.
+				// Transparent pixels of NRGBA images are left alone.
+				pix, i := rgbaPixel(m, px, py)
+				if pix[i+3] != 0 {
+					add8(pix, i, d)
+					add8(pix, i+1, d)
+					add8(pix, i+2, d)
+				}
+			case *image.RGBA64, *image.NRGBA64:
+				pix, i := rgbaPixel(m, px, py)
+				if pix[i+6] != 0 || pix[i+7] != 0 {
+					add16(pix, i, d)
+					add16(pix, i+2, d)
+					add16(pix, i+4, d)
+				}
+			}
+		}
+	}
+	return true
+}
+
+func rgbaPixel(img image.Image, x, y int) ([]byte, int) {
+	switch m := img.(type) {
+	case *image.RGBA:
+		return m.Pix, m.PixOffset(x, y)
+	case *image.NRGBA:
+		return m.Pix, m.PixOffset(x, y)
+	case *image.RGBA64:
+		return m.Pix, m.PixOffset(x, y)
+	case *image.NRGBA64:
+		return m.Pix, m.PixOffset(x, y)
+	}
+	return nil, 0
+}
+
+// lsbSamples returns the pixel data of an image and the position of the
+// lowest byte of the blue (or gray) sample of every pixel.
+func lsbSamples(img image.Image) ([]byte, []int) {
+	b := img.Bounds()
+	var pix []byte
+	var offset func(x, y int) int
+	switch m := img.(type) {
+	case *image.Gray:
+		pix, offset = m.Pix, m.PixOffset
+	case *image.Gray16:
+		pix, offset = m.Pix, func(x, y int) int { return m.PixOffset(x, y) + 1 }
+	case *image.RGBA:
+		pix, offset = m.Pix, func(x, y int) int { return m.PixOffset(x, y) + 2 }
+	case *image.NRGBA:
+		pix, offset = m.Pix, func(x, y int) int { return m.PixOffset(x, y) + 2 }
+	case *image.RGBA64:
+		pix, offset = m.Pix, func(x, y int) int { return m.PixOffset(x, y) + 5 }
+	case *image.NRGBA64:
+		pix, offset = m.Pix, func(x, y int) int { return m.PixOffset(x, y) + 5 }
+	default:
+		return nil, nil
+	}
+	positions := make([]int, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			positions = append(positions, offset(x, y))
+		}
+	}
+	return pix, positions
+}
+
+// addLSBSignature writes the payload chunks of the signature into the lowest
+// bits, one bit per pixel in reading order, over and over.
+func addLSBSignature(img image.Image, signature string) {
+	payload := signatureBytes(signature)
+	pix, positions := lsbSamples(img)
+	if payload == nil {
+		return
+	}
+	for i, position := range positions {
+		chunk := i / payloadChunkBits
+		index := chunk % len(payload)
+		bit := byte(payloadChunk(index, payload[index]) >> (payloadChunkBits - 1 - i%payloadChunkBits) & 1)
+		pix[position] = pix[position]&^1 | bit
+	}
+}
+
+func readLSBSignature(img image.Image) payloadVotes {
+	votes := make(payloadVotes)
+	pix, positions := lsbSamples(img)
+	for i := 0; i+payloadChunkBits <= len(positions); i += payloadChunkBits {
+		var chunk uint16
+		for _, position := range positions[i : i+payloadChunkBits] {
+			chunk = chunk<<1 | uint16(pix[position]&1)
+		}
+		if index, value, valid := parsePayloadChunk(chunk); valid {
+			votes.add(index, value)
+		}
+	}
+	return votes
+}
+
+// encodePNGLike encodes an image as PNG and copies the ancillary chunks of
+// the original file that don't depend on the color type.
+func encodePNGLike(original []byte, img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	chunks, err := pngChunks(original)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := pngChunks(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	out := []byte("\x89PNG\r\n\x1a\n")
+	out = appendPNGChunk(out, encoded[0])
+	for _, chunk := range chunks {
+		switch chunk.kind {
+		case "IHDR", "PLTE", "IDAT", "IEND", "tRNS", "sBIT", "bKGD", "hIST":
+			continue
+		}
+		out = appendPNGChunk(out, chunk)
+	}
+	for _, chunk := range encoded[1:] {
+		out = appendPNGChunk(out, chunk)
+	}
+	return out, nil
+}
+
+// encodeJPEGLike encodes an image as JPEG at about the quality of the
+// original file and copies its application segments and comments. The Adobe
+// segment is left out, because it can declare another color transform.
+func encodeJPEGLike(original []byte, img image.Image) ([]byte, error) {
+	segments, _, err := jpegSegments(original)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality(segments)}); err != nil {
+		return nil, err
+	}
+	encoded, rest, err := jpegSegments(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	var kept []jpegSegment
+	for _, segment := range segments {
+		isApp := segment.marker >= 0xE0 && segment.marker <= 0xEF
+		if (isApp || segment.marker == 0xFE) && !(segment.marker == 0xEE && bytes.HasPrefix(segment.payload, []byte("Adobe"))) {
+			kept = append(kept, segment)
+		}
+	}
+	out := []byte{0xFF, 0xD8}
+	for _, segment := range append(kept, encoded...) {
+		out = append(out, 0xFF, segment.marker, 0, 0)
+		binary.BigEndian.PutUint16(out[len(out)-2:], uint16(len(segment.payload)+2))
+		out = append(out, segment.payload...)
+	}
+	return append(out, rest...), nil
+}
+
+var jpegLuminanceTable = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+// jpegQuality estimates the quality a JPEG file was saved with, by comparing
+// its luminance quantization table with the scaled tables of the encoder.
+func jpegQuality(segments []jpegSegment) int {
+	sum := 0
+	for _, segment := range segments {
+		for data := segment.payload; segment.marker == 0xDB && len(data) > 0; {
+			precision, id := data[0]>>4, data[0]&0xF
+			size := 64
+			if precision != 0 {
+				size = 128
+			}
+			if len(data) < 1+size {
+				break
+			}
+			if id == 0 {
+				for i := 0; i < 64; i++ {
+					if precision != 0 {
+						sum += int(binary.BigEndian.Uint16(data[1+2*i:]))
+					} else {
+						sum += int(data[1+i])
+					}
+				}
+			}
+			data = data[1+size:]
+		}
+	}
+	if sum == 0 {
+		return jpeg.DefaultQuality
+	}
+	best, bestDiff := jpeg.DefaultQuality, math.MaxInt32
+	for quality := 1; quality <= 100; quality++ {
+		scale := 200 - 2*quality
+		if quality < 50 {
+			scale = 5000 / quality
+		}
+		scaled := 0
+		for _, value := range jpegLuminanceTable {
+			x := (value*scale + 50) / 100
+			if x < 1 {
+				x = 1
+			} else if x > 255 {
+				x = 255
+			}
+			scaled += x
+		}
+		diff := scaled - sum
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff < bestDiff {
+			best, bestDiff = quality, diff
+		}
+	}
+	return best
+}
+
+func readImageMarkRecords(file string) map[string][2]int {
+	records := make(map[string][2]int)
+	f, err := os.Open(file)
+	if err != nil {
+		return records
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) != 3 {
+			continue
+		}
+		width, err1 := strconv.Atoi(fields[1])
+		height, err2 := strconv.Atoi(fields[2])
+		if err1 == nil && err2 == nil {
+			records[fields[0]] = [2]int{width, height}
+		}
+	}
+	return records
+}
+
+// imageObservation is what the detection needs of a leaked image: the bits
+// of its lowest samples and, for every size of issued image, the spectra of
+// the leaked image folded onto a tile at every period the pattern can have.
+type imageObservation struct {
+	lsb   payloadVotes
+	folds map[[2]int][][]complex128
+}
+
+func observeImageMark(file string, records map[string][2]int) *imageObservation {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	o := &imageObservation{lsb: readLSBSignature(img), folds: make(map[[2]int][][]complex128)}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width < imageMarkMinSide || height < imageMarkMinSide {
+		return o
+	}
+	luma := imageLuma(img)
+	for _, size := range records {
+		if _, found := o.folds[size]; !found {
+			o.folds[size] = imageFolds(luma, width, height, size)
+		}
+	}
+	return o
+}
+
+// imageFolds folds an image at every period the pattern of an issued image
+// of the given size can have after a resize and a crop.
+func imageFolds(luma []float64, width, height int, size [2]int) [][]complex128 {
+	cell := imageMarkCell(size[0], size[1])
+	// A crop makes the image smaller than its scale suggests, never larger.
+	scale := math.Max(float64(width)/float64(size[0]), float64(height)/float64(size[1]))
+	factor := int(math.Sqrt(float64(width*height) / imageMarkMaxPixels))
+	for factor > 1 && cell*scale/float64(factor) < imageMarkMinCell {
+		factor--
+	}
+	if factor > 1 {
+		luma, width, height = shrinkLuma(luma, width, height, factor)
+		scale /= float64(factor)
+	}
+	residual := imageResidual(luma, width, height, int(math.Max(1, math.Round(cell*scale*2/3))))
+	// The fold stays coherent as long as the period is off by less than a
+	// quarter of a cell over the whole image.
+	length := float64(width)
+	if height > width {
+		length = float64(height)
+	}
+	step := cell * scale / (2 * length)
+	var folds [][]complex128
+	for s := scale; s <= scale/(1-imageMarkMaxCrop)*(1+step); s *= 1 + step {
+		sum, count := foldImage(residual, width, height, cell*s*imageMarkTile)
+		fold := make([]complex128, len(sum))
+		for i := range sum {
+			if count[i] > 0 {
+				fold[i] = complex(sum[i]/float64(count[i]), 0)
+			}
+		}
+		fft2(fold, false)
+		folds = append(folds, fold)
+	}
+	return folds
+}
+
+// shrinkLuma scales an image down by averaging blocks of pixels.
+func shrinkLuma(luma []float64, width, height, factor int) ([]float64, int, int) {
+	w, h := width/factor, height/factor
+	small := make([]float64, w*h)
+	for y := 0; y < h*factor; y++ {
+		for x := 0; x < w*factor; x++ {
+			small[(y/factor)*w+x/factor] += luma[y*width+x] / float64(factor*factor)
+		}
+	}
+	return small, w, h
+}
+
+// imageResidual removes the content of the image, as far as it's smoother
+// than the pattern, by subtracting the mean of the surrounding pixels. The
+// result is clipped to one level of brightness, so edges and busy areas don't
+// drown the pattern.
+func imageResidual(luma []float64, width, height, radius int) []float64 {
+	integral := make([]float64, (width+1)*(height+1))
+	for y := 0; y < height; y++ {
+		row := 0.0
+		for x := 0; x < width; x++ {
+			row += luma[y*width+x]
+			integral[(y+1)*(width+1)+x+1] = integral[y*(width+1)+x+1] + row
+		}
+	}
+	residual := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		top, bottom := y-radius, y+radius+1
+		if top < 0 {
+			top = 0
+		}
+		if bottom > height {
+			bottom = height
+		}
+		for x := 0; x < width; x++ {
+			left, right := x-radius, x+radius+1
+			if left < 0 {
+				left = 0
+			}
+			if right > width {
+				right = width
+			}
+			sum := integral[bottom*(width+1)+right] - integral[top*(width+1)+right] - integral[bottom*(width+1)+left] + integral[top*(width+1)+left]
+			mean := sum / float64((bottom-top)*(right-left))
+			residual[y*width+x] = math.Min(math.Max(luma[y*width+x]-mean, -imageMarkClip), imageMarkClip)
+		}
+	}
+	return residual
+}
+
+// foldImage adds up the pixels that fall on each cell of the tile when the
+// tile repeats every period pixels.
+func foldImage(residual []float64, width, height int, period float64) ([]float64, []int) {
+	cell := period / imageMarkTile
+	columns := make([]int, width)
+	for x := range columns {
+		columns[x] = int(math.Floor(float64(x)/cell+0.5)) % imageMarkTile
+	}
+	sum := make([]float64, imageMarkTile*imageMarkTile)
+	count := make([]int, len(sum))
+	for y := 0; y < height; y++ {
+		row := int(math.Floor(float64(y)/cell+0.5)) % imageMarkTile * imageMarkTile
+		for x, column := range columns {
+			sum[row+column] += residual[y*width+x]
+			count[row+column]++
+		}
+	}
+	return sum, count
+}
+
+func (o *imageObservation) lsbMatches(signature string) bool {
+	return o != nil && o.lsb.matches(signature)
+}
+
+// score returns how far the best correlation of the recipient's tile with
+// the folded image, over all shifts and periods, stands out from the other
+// shifts, in standard deviations. Tiles of other recipients stay below
+// minImageMarkScore.
+func (o *imageObservation) score(signature string, size [2]int) float64 {
+	if o == nil {
+		return 0
+	}
+	pattern := imageMarkPattern(signature)
+	tile := make([]complex128, len(pattern))
+	for i, value := range pattern {
+		tile[i] = complex(value, 0)
+	}
+	fft2(tile, false)
+	best := 0.0
+	correlations := make([]complex128, len(tile))
+	for _, fold := range o.folds[size] {
+		// The mean of the fold doesn't say anything about the pattern.
+		correlations[0] = 0
+		for i := 1; i < len(fold); i++ {
+			correlations[i] = fold[i] * cmplx.Conj(tile[i])
+		}
+		fft2(correlations, true)
+		mean, peak := 0.0, math.Inf(-1)
+		for _, c := range correlations {
+			mean += real(c) / float64(len(correlations))
+			peak = math.Max(peak, real(c))
+		}
+		variance := 0.0
+		for _, c := range correlations {
+			variance += (real(c) - mean) * (real(c) - mean) / float64(len(correlations))
+		}
+		if variance > 0 {
+			best = math.Max(best, (peak-mean)/math.Sqrt(variance))
+		}
+	}
+	return best
+}
+
+// fft2 transforms a tile in place with a radix-2 FFT of its rows and columns.
+// The inverse isn't scaled, which doesn't matter for the scores.
+func fft2(tile []complex128, inverse bool) {
+	line := make([]complex128, imageMarkTile)
+	for pass := 0; pass < 2; pass++ {
+		for a := 0; a < imageMarkTile; a++ {
+			at := func(b int) int {
+				if pass == 0 {
+					return a*imageMarkTile + b
+				}
+				return b*imageMarkTile + a
+			}
+			for b := range line {
+				line[b] = tile[at(b)]
+			}
+			fft(line, inverse)
+			for b := range line {
+				tile[at(b)] = line[b]
+			}
+		}
+	}
+}
+
+func fft(a []complex128, inverse bool) {
+	n := len(a)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		angle := -2 * math.Pi / float64(size)
+		if inverse {
+			angle = -angle
+		}
+		w := cmplx.Rect(1, angle)
+		for start := 0; start < n; start += size {
+			t := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := a[start+k], a[start+k+size/2]*t
+				a[start+k], a[start+k+size/2] = u+v, u-v
+				t *= w
+			}
+		}
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Image metadata is written without exiftool. The signature is added to the
+// EXIF ImageDescription and UserComment, to the XMP dc:identifier and, where
+// the format has a place for it, to the IPTC job identifier.
+var imageMetadataWriters = map[string]func([]byte, string) ([]byte, error){
+	".jpg":  addJPEGMetadata,
+	".jpeg": addJPEGMetadata,
+	".png":  addPNGMetadata,
+	".gif":  addGIFMetadata,
+	".tif":  addTIFFMetadata,
+	".tiff": addTIFFMetadata,
+	".webp": addWebPMetadata,
+}
+
+var imageMetadataReaders = map[string]func([]byte) []string{
+	".jpg":  readJPEGMetadata,
+	".jpeg": readJPEGMetadata,
+	".png":  readPNGMetadata,
+	".gif":  readGIFMetadata,
+	".tif":  tiffStrings,
+	".tiff": tiffStrings,
+	".webp": readWebPMetadata,
+}
+
+const (
+	jpegExifHeader      = "Exif\x00\x00"
+	jpegXMPHeader       = "http://ns.adobe.com/xap/1.0/\x00"
+	jpegPhotoshopHeader = "Photoshop 3.0\x00"
+	pngXMPKeyword       = "XML:com.adobe.xmp"
+	gifXMPApplication   = "XMP DataXMP"
+	iptcResourceID      = 0x0404
+	iptcJobIdentifier   = 103
+)
+
+func isImageFile(extension string) bool {
+	_, found := imageMetadataWriters[strings.ToLower(extension)]
+	return found
+}
+
+func addImageMetadata(file, signature string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	content, err = imageMetadataWriters[strings.ToLower(filepath.Ext(file))](content, signature)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+func readImageMetadata(file string) ([]string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	read, found := imageMetadataReaders[strings.ToLower(filepath.Ext(file))]
+	if !found {
+		return nil, fmt.Errorf("unsupported image type")
+	}
+	return read(content), nil
+}
+
+func detectImageMetadata(file, signature string) bool {
+	values, err := readImageMetadata(file)
+	if err != nil {
+		return false
+	}
+	for _, value := range values {
+		if strings.Contains(value, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// addXMPIdentifier adds a description with the dc:identifier to an XMP
+// packet, or creates a new packet if there is none.
+func addXMPIdentifier(packet []byte, signature string) []byte {
+	description := `<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier>` + signature + `</dc:identifier></rdf:Description>`
+	if i := bytes.LastIndex(packet, []byte("</rdf:RDF>")); i >= 0 {
+		return concat(packet[:i], []byte(description), packet[i:])
+	}
+	return []byte(`<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>` +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		description + `</rdf:RDF></x:xmpmeta><?xpacket end="w"?>`)
+}
+
+// addIPTCJobIdentifier adds the signature as a job identifier dataset to IPTC
+// data.
+func addIPTCJobIdentifier(iptc []byte, signature string) []byte {
+	if len(iptc) == 0 {
+		iptc = []byte{0x1C, 2, 0, 0, 2, 0, 4}
+	}
+	dataset := []byte{0x1C, 2, iptcJobIdentifier, 0, 0}
+	binary.BigEndian.PutUint16(dataset[3:], uint16(len(signature)))
+	return concat(iptc, dataset, []byte(signature))
+}
+
+// addTIFFMetadata adds the signature to the IFD0 of a TIFF image. The XMP
+// packet and the IPTC data are stored in their own IFD0 tags.
+func addTIFFMetadata(content []byte, signature string) ([]byte, error) {
+	order, err := tiffByteOrder(content)
+	if err != nil {
+		return nil, err
+	}
+	ifd0Values, exifValues := tiffSignatureValues(content, signature)
+	var xmp, iptc []byte
+	if ifd0, _, err := readIFD(content, order, order.Uint32(content[4:])); err == nil {
+		if entry := findIFDEntry(ifd0, order, tiffXMP); entry != nil {
+			xmp = ifdEntryValue(content, order, entry)
+		}
+		if entry := findIFDEntry(ifd0, order, tiffIPTC); entry != nil {
+			iptc = ifdEntryValue(content, order, entry)
+		}
+	}
+	ifd0Values = append(ifd0Values,
+		tiffValue{tiffXMP, tiffTypeByte, addXMPIdentifier(xmp, signature)},
+		tiffValue{tiffIPTC, tiffTypeUndefined, addIPTCJobIdentifier(iptc, signature)})
+	return updateTIFF(content, ifd0Values, exifValues)
+}
+
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+}
+
+// jpegSegments splits a JPEG file into the segments before the image data and
+// the rest of the file.
+func jpegSegments(content []byte) ([]jpegSegment, []byte, error) {
+	if len(content) < 4 || content[0] != 0xFF || content[1] != 0xD8 {
+		return nil, nil, fmt.Errorf("not a JPEG file")
+	}
+	var segments []jpegSegment
+	i := 2
+	for {
+		if i+4 > len(content) || content[i] != 0xFF {
+			return nil, nil, fmt.Errorf("invalid JPEG segment")
+		}
+		// Any number of 0xFF fill bytes can come before a marker.
+		if content[i+1] == 0xFF {
+			i++
+			continue
+		}
+		marker := content[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return segments, content[i:], nil
+		}
+		length := int(binary.BigEndian.Uint16(content[i+2:]))
+		if length < 2 || i+2+length > len(content) {
+			return nil, nil, fmt.Errorf("invalid JPEG segment")
+		}
+		segments = append(segments, jpegSegment{marker, content[i+4 : i+2+length]})
+		i += 2 + length
+	}
+}
+
+func addJPEGMetadata(content []byte, signature string) ([]byte, error) {
+	segments, rest, err := jpegSegments(content)
+	if err != nil {
+		return nil, err
+	}
+	exif, xmp, photoshop := -1, -1, -1
+	for i, segment := range segments {
+		switch {
+		case segment.marker == 0xE1 && bytes.HasPrefix(segment.payload, []byte(jpegExifHeader)) && exif < 0:
+			exif = i
+		case segment.marker == 0xE1 && bytes.HasPrefix(segment.payload, []byte(jpegXMPHeader)) && xmp < 0:
+			xmp = i
+		case segment.marker == 0xED && bytes.HasPrefix(segment.payload, []byte(jpegPhotoshopHeader)) && photoshop < 0:
+			photoshop = i
+		}
+	}
+	tiff := emptyTIFF()
+	if exif >= 0 {
+		tiff = segments[exif].payload[len(jpegExifHeader):]
+	}
+	tiff, err = signTIFF(tiff, signature)
+	if err != nil {
+		return nil, err
+	}
+	var packet []byte
+	if xmp >= 0 {
+		packet = segments[xmp].payload[len(jpegXMPHeader):]
+	}
+	resources := []byte{}
+	if photoshop >= 0 {
+		resources = segments[photoshop].payload[len(jpegPhotoshopHeader):]
+	}
+	added := []jpegSegment{
+		{0xE1, concat([]byte(jpegExifHeader), tiff)},
+		{0xE1, concat([]byte(jpegXMPHeader), addXMPIdentifier(packet, signature))},
+		{0xED, concat([]byte(jpegPhotoshopHeader), addPhotoshopIPTC(resources, signature))},
+	}
+	var missing []jpegSegment
+	for j, index := range []int{exif, xmp, photoshop} {
+		if index >= 0 {
+			segments[index] = added[j]
+		} else {
+			missing = append(missing, added[j])
+		}
+	}
+	// New segments go after the JFIF header, which has to come first.
+	insert := 0
+	for insert < len(segments) && segments[insert].marker == 0xE0 {
+		insert++
+	}
+	result := append(append(append([]jpegSegment{}, segments[:insert]...), missing...), segments[insert:]...)
+	out := []byte{0xFF, 0xD8}
+	for _, segment := range result {
+		if len(segment.payload)+2 > 0xFFFF {
+			return nil, fmt.Errorf("JPEG metadata segment is too large")
+		}
+		out = append(out, 0xFF, segment.marker, 0, 0)
+		binary.BigEndian.PutUint16(out[len(out)-2:], uint16(len(segment.payload)+2))
+		out = append(out, segment.payload...)
+	}
+	return append(out, rest...), nil
+}
+
+// photoshopResources calls visit with the id and the data position of each
+// image resource block of a Photoshop APP13 segment, until visit returns false.
+func photoshopResources(resources []byte, visit func(id uint16, start, end int) bool) {
+	for i := 0; i+12 <= len(resources) && string(resources[i:i+4]) == "8BIM"; {
+		id := binary.BigEndian.Uint16(resources[i+4:])
+		nameLength := int(resources[i+6]) + 1
+		nameLength += nameLength % 2
+		sizeOffset := i + 6 + nameLength
+		if sizeOffset+4 > len(resources) {
+			return
+		}
+		size := int(binary.BigEndian.Uint32(resources[sizeOffset:]))
+		start := sizeOffset + 4
+		if size < 0 || start+size > len(resources) {
+			return
+		}
+		if !visit(id, start, start+size) {
+			return
+		}
+		i = start + size + size%2
+	}
+}
+
+// addPhotoshopIPTC adds the signature to the IPTC resource of the image
+// resources, or adds an IPTC resource.
+func addPhotoshopIPTC(resources []byte, signature string) []byte {
+	var result []byte
+	photoshopResources(resources, func(id uint16, start, end int) bool {
+		if id != iptcResourceID {
+			return true
+		}
+		iptc := addIPTCJobIdentifier(resources[start:end], signature)
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(iptc)))
+		if len(iptc)%2 == 1 {
+			iptc = append(iptc, 0)
+		}
+		next := end + (end-start)%2
+		result = concat(resources[:start-4], size, iptc, resources[next:])
+		return false
+	})
+	if result != nil {
+		return result
+	}
+	iptc := addIPTCJobIdentifier(nil, signature)
+	block := []byte{'8', 'B', 'I', 'M', 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(block[4:], iptcResourceID)
+	binary.BigEndian.PutUint32(block[8:], uint32(len(iptc)))
+	block = append(block, iptc...)
+	if len(block)%2 == 1 {
+		block = append(block, 0)
+	}
+	return concat(resources, block)
+}
+
+func readJPEGMetadata(content []byte) []string {
+	segments, _, err := jpegSegments(content)
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, segment := range segments {
+		switch {
+		case segment.marker == 0xE1 && bytes.HasPrefix(segment.payload, []byte(jpegExifHeader)):
+			values = append(values, tiffStrings(segment.payload[len(jpegExifHeader):])...)
+		case segment.marker == 0xE1 && bytes.HasPrefix(segment.payload, []byte(jpegXMPHeader)):
+			values = append(values, string(segment.payload[len(jpegXMPHeader):]))
+		case segment.marker == 0xED && bytes.HasPrefix(segment.payload, []byte(jpegPhotoshopHeader)):
+			resources := segment.payload[len(jpegPhotoshopHeader):]
+			photoshopResources(resources, func(id uint16, start, end int) bool {
+				if id == iptcResourceID {
+					values = append(values, string(resources[start:end]))
+				}
+				return true
+			})
+		}
+	}
+	return values
+}
+
+type pngChunk struct {
+	kind string
+	data []byte
+}
+
+func pngChunks(content []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(content, []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+	var chunks []pngChunk
+	for i := 8; i < len(content); {
+		if i+12 > len(content) {
+			return nil, fmt.Errorf("PNG file is truncated")
+		}
+		length := int(binary.BigEndian.Uint32(content[i:]))
+		if length < 0 || i+12+length > len(content) {
+			return nil, fmt.Errorf("invalid PNG chunk")
+		}
+		chunks = append(chunks, pngChunk{string(content[i+4 : i+8]), content[i+8 : i+8+length]})
+		i += 12 + length
+	}
+	return chunks, nil
+}
+
+// pngXMP returns the XMP packet of an iTXt chunk, or false if the chunk
+// doesn't hold XMP.
+func pngXMP(chunk pngChunk) ([]byte, bool) {
+	if chunk.kind != "iTXt" || !bytes.HasPrefix(chunk.data, []byte(pngXMPKeyword+"\x00")) {
+		return nil, false
+	}
+	data := chunk.data[len(pngXMPKeyword)+1:]
+	if len(data) < 2 {
+		return nil, false
+	}
+	compressed := data[0] == 1
+	data = data[2:]
+	for i := 0; i < 2; i++ {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return nil, false
+		}
+		data = data[end+1:]
+	}
+	if !compressed {
+		return data, true
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+	packet, err := ioutil.ReadAll(r)
+	return packet, err == nil
+}
+
+// addPNGMetadata adds the signature to the eXIf chunk and to an uncompressed
+// iTXt chunk holding XMP. New chunks are added before the image data.
+func addPNGMetadata(content []byte, signature string) ([]byte, error) {
+	chunks, err := pngChunks(content)
+	if err != nil {
+		return nil, err
+	}
+	exif, xmp, data := -1, -1, -1
+	for i, chunk := range chunks {
+		if _, found := pngXMP(chunk); found && xmp < 0 {
+			xmp = i
+		}
+		switch chunk.kind {
+		case "eXIf":
+			exif = i
+		case "IDAT":
+			if data < 0 {
+				data = i
+			}
+		}
+	}
+	if data < 0 {
+		return nil, fmt.Errorf("PNG file has no image data")
+	}
+	tiff := emptyTIFF()
+	if exif >= 0 {
+		tiff = chunks[exif].data
+	}
+	tiff, err = signTIFF(tiff, signature)
+	if err != nil {
+		return nil, err
+	}
+	var packet []byte
+	if xmp >= 0 {
+		packet, _ = pngXMP(chunks[xmp])
+	}
+	exifChunk := pngChunk{"eXIf", tiff}
+	xmpChunk := pngChunk{"iTXt", concat([]byte(pngXMPKeyword+"\x00\x00\x00\x00\x00"), addXMPIdentifier(packet, signature))}
+	out := []byte("\x89PNG\r\n\x1a\n")
+	for i, chunk := range chunks {
+		if i == data {
+			if exif < 0 {
+				out = appendPNGChunk(out, exifChunk)
+			}
+			if xmp < 0 {
+				out = appendPNGChunk(out, xmpChunk)
+			}
+		}
+		switch i {
+		case exif:
+			chunk = exifChunk
+		case xmp:
+			chunk = xmpChunk
+		}
+		out = appendPNGChunk(out, chunk)
+	}
+	return out, nil
+}
+
+func appendPNGChunk(out []byte, chunk pngChunk) []byte {
+	start := len(out)
+	out = append(out, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(out[start:], uint32(len(chunk.data)))
+	out = append(append(out, chunk.kind...), chunk.data...)
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(out[start+4:]))
+	return append(out, checksum...)
+}
+
+func readPNGMetadata(content []byte) []string {
+	chunks, err := pngChunks(content)
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, chunk := range chunks {
+		if chunk.kind == "eXIf" {
+			values = append(values, tiffStrings(chunk.data)...)
+		} else if packet, found := pngXMP(chunk); found {
+			values = append(values, string(packet))
+		}
+	}
+	return values
+}
+
+// gifXMPTrailer follows the XMP packet of a GIF application extension. It
+// makes decoders that read the packet as data sub-blocks end at the block
+// terminator, wherever they start.
+func gifXMPTrailer() []byte {
+	trailer := []byte{1}
+	for i := 255; i >= 0; i-- {
+		trailer = append(trailer, byte(i))
+	}
+	return append(trailer, 0)
+}
+
+// gifXMPPacket returns the position of the XMP packet of a GIF file.
+func gifXMPPacket(content []byte) (int, int, bool) {
+	start := bytes.Index(content, []byte("\x21\xFF\x0B"+gifXMPApplication))
+	if start < 0 {
+		return 0, 0, false
+	}
+	start += 3 + len(gifXMPApplication)
+	end := bytes.Index(content[start:], gifXMPTrailer())
+	if end < 0 {
+		return 0, 0, false
+	}
+	return start, start + end, true
+}
+
+// addGIFMetadata adds the signature to the XMP application extension. GIF has
+// no place for EXIF or IPTC data.
+func addGIFMetadata(content []byte, signature string) ([]byte, error) {
+	if len(content) < 13 || !bytes.HasPrefix(content, []byte("GIF8")) {
+		return nil, fmt.Errorf("not a GIF file")
+	}
+	if start, end, found := gifXMPPacket(content); found {
+		return concat(content[:start], addXMPIdentifier(content[start:end], signature), content[end:]), nil
+	}
+	i := 13
+	if flags := content[10]; flags&0x80 != 0 {
+		i += 3 << (uint(flags&0x07) + 1)
+	}
+	if i >= len(content) {
+		return nil, fmt.Errorf("GIF file is truncated")
+	}
+	extension := concat([]byte("\x21\xFF\x0B"+gifXMPApplication), addXMPIdentifier(nil, signature), gifXMPTrailer())
+	return concat(content[:i], extension, content[i:]), nil
+}
+
+func readGIFMetadata(content []byte) []string {
+	if start, end, found := gifXMPPacket(content); found {
+		return []string{string(content[start:end])}
+	}
+	return nil
+}
+
+const (
+	webpFlagXMP  = 0x04
+	webpFlagEXIF = 0x08
+	webpFlagAlph = 0x10
+)
+
+type riffChunk struct {
+	kind string
+	data []byte
+}
+
+func webpChunks(content []byte) ([]riffChunk, error) {
+	return riffChunks(content, "WEBP")
+}
+
+// webpCanvas returns the image size and whether the image has alpha, for
+// files in the simple format that need an extended header.
+func webpCanvas(chunk riffChunk) (int, int, bool, error) {
+	switch {
+	case chunk.kind == "VP8 " && len(chunk.data) >= 10 && bytes.Equal(chunk.data[3:6], []byte{0x9D, 0x01, 0x2A}):
+		width := int(binary.LittleEndian.Uint16(chunk.data[6:]) & 0x3FFF)
+		height := int(binary.LittleEndian.Uint16(chunk.data[8:]) & 0x3FFF)
+		return width, height, false, nil
+	case chunk.kind == "VP8L" && len(chunk.data) >= 5 && chunk.data[0] == 0x2F:
+		bits := binary.LittleEndian.Uint32(chunk.data[1:])
+		return int(bits&0x3FFF) + 1, int(bits>>14&0x3FFF) + 1, bits>>28&1 == 1, nil
+	}
+	return 0, 0, false, fmt.Errorf("unknown WebP image data")
+}
+
+// addWebPMetadata adds the signature to the EXIF and XMP chunks. Files in the
+// simple format get an extended header, which is required for metadata.
+func addWebPMetadata(content []byte, signature string) ([]byte, error) {
+	chunks, err := webpChunks(content)
+	if err != nil || len(chunks) == 0 {
+		return nil, fmt.Errorf("not a WebP file")
+	}
+	if chunks[0].kind != "VP8X" {
+		width, height, alpha, err := webpCanvas(chunks[0])
+		if err != nil {
+			return nil, err
+		}
+		header := make([]byte, 10)
+		if alpha {
+			header[0] = webpFlagAlph
+		}
+		header[4], header[5], header[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+		header[7], header[8], header[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+		chunks = append([]riffChunk{{"VP8X", header}}, chunks...)
+	} else if len(chunks[0].data) < 10 {
+		return nil, fmt.Errorf("invalid WebP header")
+	}
+	header := append([]byte{}, chunks[0].data...)
+	header[0] |= webpFlagEXIF | webpFlagXMP
+	chunks[0].data = header
+	exif, xmp := -1, -1
+	for i, chunk := range chunks {
+		switch chunk.kind {
+		case "EXIF":
+			exif = i
+		case "XMP ":
+			xmp = i
+		}
+	}
+	tiff, prefix := emptyTIFF(), []byte{}
+	if exif >= 0 {
+		tiff = chunks[exif].data
+		if bytes.HasPrefix(tiff, []byte(jpegExifHeader)) {
+			prefix, tiff = tiff[:len(jpegExifHeader)], tiff[len(jpegExifHeader):]
+		}
+	}
+	tiff, err = signTIFF(tiff, signature)
+	if err != nil {
+		return nil, err
+	}
+	exifChunk := riffChunk{"EXIF", concat(prefix, tiff)}
+	var packet []byte
+	if xmp >= 0 {
+		packet = chunks[xmp].data
+	}
+	xmpChunk := riffChunk{"XMP ", addXMPIdentifier(packet, signature)}
+	switch {
+	case exif >= 0:
+		chunks[exif] = exifChunk
+	case xmp >= 0:
+		// EXIF comes before XMP in the container.
+		chunks = append(chunks[:xmp], append([]riffChunk{exifChunk}, chunks[xmp:]...)...)
+		xmp++
+	default:
+		chunks = append(chunks, exifChunk)
+	}
+	if xmp >= 0 {
+		chunks[xmp] = xmpChunk
+	} else {
+		chunks = append(chunks, xmpChunk)
+	}
+	return writeRIFF("WEBP", chunks), nil
+}
+
+func readWebPMetadata(content []byte) []string {
+	chunks, err := webpChunks(content)
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, chunk := range chunks {
+		switch chunk.kind {
+		case "EXIF":
+			values = append(values, tiffStrings(bytes.TrimPrefix(chunk.data, []byte(jpegExifHeader)))...)
+		case "XMP ":
+			values = append(values, string(chunk.data))
+		}
+	}
+	return values
+}
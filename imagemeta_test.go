@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+// jpegWithFillBytes returns a JPEG file with 0xFF fill bytes before every
+// marker after the start of the image.
+func jpegWithFillBytes(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(4 * x), uint8(5 * y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	segments, rest, err := jpegSegments(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := []byte{0xFF, 0xD8}
+	for _, segment := range segments {
+		out = append(out, 0xFF, 0xFF, 0xFF, segment.marker, byte((len(segment.payload)+2)>>8), byte(len(segment.payload)+2))
+		out = append(out, segment.payload...)
+	}
+	return append(append(out, 0xFF, 0xFF), rest...)
+}
+
+func TestJPEGFillBytes(t *testing.T) {
+	content := jpegWithFillBytes(t)
+	if _, err := jpeg.Decode(bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	tagged, err := addJPEGMetadata(content, testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, value := range readJPEGMetadata(tagged) {
+		found = found || strings.Contains(value, testSignature)
+	}
+	if !found {
+		t.Error("signature not found in the metadata")
+	}
+	img, _ := jpeg.Decode(bytes.NewReader(content))
+	encoded, err := encodeJPEGLike(content, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(encoded)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebPExifBeforeXMP(t *testing.T) {
+	content := writeRIFF("WEBP", []riffChunk{
+		{"VP8X", []byte{webpFlagXMP, 0, 0, 0, 63, 0, 0, 47, 0, 0}},
+		{"VP8 ", []byte{0x30, 0x01, 0x00, 0x9D, 0x01, 0x2A, 64, 0, 48, 0}},
+		{"XMP ", addXMPIdentifier(nil, "an earlier identifier")},
+	})
+	tagged, err := addWebPMetadata(content, testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := webpChunks(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, chunk := range chunks {
+		kinds = append(kinds, chunk.kind)
+	}
+	if strings.Join(kinds, ",") != "VP8X,VP8 ,EXIF,XMP " {
+		t.Errorf("chunks in the order %q", kinds)
+	}
+	found := false
+	for _, value := range readWebPMetadata(tagged) {
+		found = found || strings.Contains(value, testSignature)
+	}
+	if !found {
+		t.Error("signature not found in the metadata")
+	}
+}
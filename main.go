@@ -1,7 +1,6 @@
 package main
 
 import (
-	"archive/zip"
 	"bufio"
 	"bytes"
 	"crypto/sha256"
@@ -13,10 +12,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
 
@@ -52,7 +48,11 @@ func main() {
 	baseFile := flag.String("f", "", "Path of the base file")
 	binaryFlag := flag.Bool("binary", true, "Add a unique signature to the binary")
 	metadataFlag := flag.Bool("metadata", true, "Add a unique signature to metadata of the file")
-	watermarkFlag := flag.Bool("watermark", true, "Add a unique signature to the PDF file as a watermark")
+	watermarkFlag := flag.Bool("watermark", true, "Add an invisible watermark to PDF, text, image and audio files")
+	homoglyphFlag := flag.Bool("homoglyph", false, "Swap some letters of the text with identical looking Cyrillic and Greek letters")
+	stampFlag := flag.Bool("stamp", false, "Add a visible stamp with the recipient's name to the pages of PDF files")
+	coverFlag := flag.Bool("cover", false, "Insert a cover page for the recipient to PDF files")
+	dotsFlag := flag.Bool("dots", false, "Cover the pages of PDF files with faint yellow dots that can be read from screenshots")
 	sendgridFlag := flag.Bool("sendgrid", false, "Send files with Sendgrid Integration")
 	sesFlag := flag.Bool("ses", false, "Send files with AWS SES Integration")
 	smtpFlag := flag.Bool("smtp", false, "Send files with a SMTP server")
@@ -74,15 +74,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	if !*binaryFlag && !*metadataFlag && !*watermarkFlag && !*validateFlag {
+	if !*binaryFlag && !*metadataFlag && !*watermarkFlag && !*homoglyphFlag && !*stampFlag && !*coverFlag && !*dotsFlag && !*validateFlag {
 		color.Red("No flags are set")
 		os.Exit(1)
 	}
-	startProcess(*baseFile, *targetsFile, *projectName, *binaryFlag, *metadataFlag, *watermarkFlag, *sendgridFlag, *sesFlag, *smtpFlag, *validateFlag)
+	startProcess(*baseFile, *targetsFile, *projectName, *binaryFlag, *metadataFlag, *watermarkFlag, *homoglyphFlag, *stampFlag, *coverFlag, *dotsFlag, *sendgridFlag, *sesFlag, *smtpFlag, *validateFlag)
 
 }
 
-func startProcess(baseFile, targetsFile, projectName string, binaryFlag, metadataFlag, watermarkFlag, sendgridFlag, sesFlag, smtpFlag, validateFlag bool) {
+func startProcess(baseFile, targetsFile, projectName string, binaryFlag, metadataFlag, watermarkFlag, homoglyphFlag, stampFlag, coverFlag, dotsFlag, sendgridFlag, sesFlag, smtpFlag, validateFlag bool) {
 	fmt.Println("Operation started")
 	projectDir := filepath.Join(currentDir, projectName)
 	dbPath := filepath.Join(projectDir, "db.csv")
@@ -123,7 +123,7 @@ func startProcess(baseFile, targetsFile, projectName string, binaryFlag, metadat
 	}
 	if !existsFlag {
 		generateTargetDB(dbPath, readTargets(targetsFile))
-		createLocalFiles(baseFile, projectName, binaryFlag, metadataFlag, watermarkFlag)
+		createLocalFiles(baseFile, projectName, binaryFlag, metadataFlag, watermarkFlag, homoglyphFlag, stampFlag, coverFlag, dotsFlag)
 		color.Magenta("Local files are created")
 	}
 	configs := parseConfigFile()
@@ -151,43 +151,111 @@ func startProcess(baseFile, targetsFile, projectName string, binaryFlag, metadat
 
 }
 
-func detectWatermarkPDF(file, signature string) bool {
-	operatingSystem := runtime.GOOS
-	var cmd *exec.Cmd
-	if operatingSystem == "windows" {
-		cmd = exec.Command(filepath.Join(currentDir, "pdftotext.exe"), file)
-	} else {
-		cmd = exec.Command(filepath.Join(currentDir, "pdftotext"), file)
-	}
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+// detectWatermarkPDF returns the watermark channels of a PDF file that hold
+// the signature: the text of the pages and the hidden layer.
+func detectWatermarkPDF(file, signature string) []string {
+	text, err := readPDFWatermarkText(file)
 	if err != nil {
-		color.Red("Couldn't run pdftotext binary")
+		color.Red("Couldn't read the text of the PDF file")
 		fmt.Println(err)
-		os.Exit(1)
+		return nil
 	}
-	outPath := strings.ReplaceAll(file, ".pdf", ".txt")
-	defer os.Remove(outPath)
-	content, err := ioutil.ReadFile(outPath)
-	if err != nil {
-		color.Red("Couldn't read the PDF file")
-		fmt.Println(err)
-		os.Exit(1)
+	var channels []string
+	if pdfTextContains(text, signature) || decodeWatermarkWords(text).matches(signature) {
+		channels = append(channels, pdfChannelText)
+	}
+	if pages, err := extractPDFHiddenText(file); err == nil && decodeWatermarkWords(strings.Join(pages, "\n")).matches(signature) {
+		channels = append(channels, pdfChannelLayer)
 	}
+	return channels
+}
 
-	text := string(content)
-	return strings.Contains(text, signature)
+// readPDFWatermarkText returns the text of a PDF file with homoglyphs mapped
+// back to Latin letters.
+func readPDFWatermarkText(file string) (string, error) {
+	pages, err := extractPDFText(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.Map(func(r rune) rune {
+		if l, found := homoglyphLatin[r]; found {
+			return l
+		}
+		return r
+	}, strings.Join(pages, "\n")), nil
 }
 
 func addWatermarkPDF(file, signature string) {
-	wm, _ := api.TextWatermark(signature, "sc:.9, rot:0, mo:1, op:0", false, false, pdfcpu.POINTS)
-	api.AddWatermarksFile(file, "", nil, wm, nil)
+	pageCount, err := api.PageCountFile(file)
+	if err != nil {
+		color.Red("Error occurred while adding the watermark to the PDF file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	watermarks := make(map[int]*pdfcpu.Watermark)
+	for page := 1; page <= pageCount; page++ {
+		wm, err := api.TextWatermark(pageWatermarkWords(signature, page), "sc:.9, rot:0, mo:1, op:0", false, false, pdfcpu.POINTS)
+		if err != nil {
+			color.Red("Error occurred while adding the watermark to the PDF file")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		watermarks[page] = wm
+	}
+	if err := api.AddWatermarksMapFile(file, "", watermarks, nil); err != nil {
+		color.Red("Error occurred while adding the watermark to the PDF file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
 
 func detectLeak(file, dbPath string) {
+	if filepath.Ext(file) == ".msg" {
+		detectMsgLeak(file, dbPath)
+		return
+	}
 	targets := readTargets(dbPath)
 	foundFlag := false
+	whitespaceVotes := make(payloadVotes)
+	if isWhitespaceSource(filepath.Ext(file)) {
+		whitespaceVotes = readWhitespaceSignature(file)
+	}
+	homoglyphRecords := readHomoglyphRecords(filepath.Join(filepath.Dir(dbPath), "homoglyph.csv"))
+	var homoglyphObserved homoglyphObservation
+	if len(homoglyphRecords) > 0 {
+		homoglyphObserved = observeHomoglyphs(file)
+	}
+	var slides map[int]string
+	if filepath.Ext(file) == ".pptx" {
+		slides = readPptxSlides(file)
+	}
+	var pageMarks []pageMark
+	if filepath.Ext(file) == ".pdf" {
+		if text, err := readPDFWatermarkText(file); err == nil {
+			pageMarks = decodePageMarks(text)
+		}
+	}
+	spacingRecords := readSpacingRecords(filepath.Join(filepath.Dir(dbPath), "spacing.csv"))
+	var spacingObserved *spacingObservation
+	if len(spacingRecords) > 0 && filepath.Ext(file) == ".pdf" {
+		spacingObserved = observeSpacing(file)
+	}
+	var structure *pdfStructure
+	if filepath.Ext(file) == ".pdf" {
+		structure = observePDFStructure(file)
+	}
+	minOrder := structure.minOrderScore(len(targets))
+	imageRecords := readImageMarkRecords(filepath.Join(filepath.Dir(dbPath), "imagemark.csv"))
+	var imageObserved *imageObservation
+	var dots *dotReading
+	if isPixelImage(filepath.Ext(file)) {
+		imageObserved = observeImageMark(file, imageRecords)
+		dots = readDotPattern(file)
+	}
+	var audioObserved *audioObservation
+	if isAudioFile(filepath.Ext(file)) || isCompressedAudio(filepath.Ext(file)) {
+		audioObserved = observeAudioMark(file)
+	}
 	for _, target := range targets {
 		signature := strings.Split(target, ",")[2]
 		name := strings.ReplaceAll(strings.Split(target, ",")[0], " ", "_")
@@ -201,17 +269,85 @@ func detectLeak(file, dbPath string) {
 			color.Magenta("Signature Detected in Binary: " + name)
 			foundFlag = true
 		}
-		if metadataFlag {
+		if metadataFlag && filepath.Ext(file) == ".pdf" {
+			report := pdfChannelReport(pdfChannels, detectPDFMetadata(file, signature))
+			color.Magenta("Signature Detected in Metadata (" + report + "): " + name)
+			foundFlag = true
+		} else if metadataFlag {
 			color.Magenta("Signature Detected in Metadata: " + name)
 			foundFlag = true
 		}
-		if watermarkFlag {
+		if watermarkFlag && filepath.Ext(file) == ".pdf" {
+			report := pdfChannelReport(pdfWatermarkChannels, detectWatermarkPDF(file, signature))
+			color.Magenta("Watermark Matched (" + report + "): " + name)
+			foundFlag = true
+		} else if watermarkFlag {
 			color.Magenta("Watermark Matched: " + name)
 			foundFlag = true
 		}
+		if whitespaceVotes.matches(signature) {
+			color.Magenta("Signature Detected in Whitespace: " + name)
+			foundFlag = true
+		}
+		if record, found := homoglyphRecords[signature]; found && homoglyphObserved.matches(record) {
+			color.Magenta("Homoglyphs Matched: " + name)
+			foundFlag = true
+		}
+		if positions := pptxSlidesWithSignature(slides, signature); len(positions) == 1 {
+			color.Magenta("Signature Detected in Slide " + numberRanges(positions) + ": " + name)
+			foundFlag = true
+		} else if len(positions) > 1 {
+			color.Magenta("Signature Detected in Slides " + numberRanges(positions) + ": " + name)
+			foundFlag = true
+		}
+		if lines, score := spacingObserved.score(spacingRecords[signature]); lines >= minSpacingMarks && score >= minSpacingScore(len(targets)) {
+			color.Magenta(fmt.Sprintf("Spacing Fingerprint Matched (%d lines, score %.1f): %s", lines, score, name))
+			foundFlag = true
+		}
+		if fonts, matched := structure.subsetMatches(signature); matched > 0 {
+			color.Magenta(fmt.Sprintf("Font Subset Tags Matched (%d of %d fonts): %s", matched, fonts, name))
+			foundFlag = true
+		}
+		if streams, score := structure.orderScore(signature); score >= minOrder {
+			color.Magenta(fmt.Sprintf("Object Order Matched (%d streams, score %.2f): %s", streams, score, name))
+			foundFlag = true
+		}
+		if imageObserved.lsbMatches(signature) {
+			color.Magenta("Signature Detected in Pixels: " + name)
+			foundFlag = true
+		}
+		if score := imageObserved.score(signature, imageRecords[signature]); score >= minImageMarkScore {
+			color.Magenta(fmt.Sprintf("Image Watermark Matched (score %.1f): %s", score, name))
+			foundFlag = true
+		}
+		if score := audioObserved.score(signature); score >= minAudioMarkScore {
+			color.Magenta(fmt.Sprintf("Audio Watermark Matched (score %.1f): %s", score, name))
+			foundFlag = true
+		}
+		if dots.matches(signature) {
+			color.Magenta(fmt.Sprintf("Dot Pattern Matched (%d tiles): %s", dots.tiles, name))
+			foundFlag = true
+		}
+		if pages := pagesWithSignature(pageMarks, signature); len(pages) == 1 {
+			color.Magenta("Signature Detected in Page " + numberRanges(pages) + " of the Issued Document: " + name)
+			foundFlag = true
+		} else if len(pages) > 1 {
+			color.Magenta("Signature Detected in Pages " + numberRanges(pages) + " of the Issued Document: " + name)
+			foundFlag = true
+		}
 	}
 	if !foundFlag {
-		fmt.Println("No match found.")
+		if diff := nearestIssuedCopy(file, dbPath, targets); diff != nil {
+			reportNearestCopy(diff)
+		} else if ranking := rankIssuedCopies(file, dbPath, targets); ranking != nil && ranking.confidence > 0 {
+			color.Magenta(fmt.Sprintf("Closest Issued Copy (similarity %.2f, confidence %.0f%%): %s", ranking.similarity, 100*ranking.confidence, ranking.names[0]))
+			fmt.Println("Scores of the Issued Copies: " + ranking.report())
+		} else if ranking != nil {
+			fmt.Printf("The file is similar to the issued copies (similarity %.2f), but they can't be told apart.\n", ranking.similarity)
+			fmt.Println("Scores of the Issued Copies: " + ranking.report())
+		} else {
+			fmt.Println("No match found.")
+		}
 	}
 }
 
@@ -231,15 +367,63 @@ func getHash(file string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func applySignature(file, signature string, binaryFlag, metadataFlag, watermarkFlag bool) {
+func applySignature(projectDir, file, signature, name, email string, binaryFlag, metadataFlag, watermarkFlag, homoglyphFlag, stampFlag, coverFlag, dotsFlag bool) {
 	extension := filepath.Ext(file)
+	if extension == ".pdf" && (stampFlag || coverFlag) {
+		addVisiblePDFMarks(file, name, email, stampFlag, coverFlag)
+	}
+	if extension == ".pdf" && dotsFlag {
+		addDotPatternSignature(file, signature)
+	}
+	if homoglyphFlag {
+		addHomoglyphSignature(projectDir, file, signature)
+	}
+	if isPixelImage(extension) && watermarkFlag {
+		addImageWatermark(projectDir, file, signature)
+	}
+	if isAudioFile(extension) && watermarkFlag {
+		addAudioWatermark(file, signature)
+	}
 	if extension == ".pdf" && watermarkFlag {
+		addSpacingSignature(projectDir, file, signature)
 		addWatermarkPDF(file, signature)
 	}
+	if extension == ".pdf" && (watermarkFlag || metadataFlag) {
+		addHiddenPDFChannels(file, signature, name, email, watermarkFlag, metadataFlag)
+	}
+	if isZeroWidthText(extension) && watermarkFlag {
+		addZeroWidthSignature(file, signature)
+	}
+	if extension == ".csv" && watermarkFlag {
+		addCSVSignature(file, signature)
+	}
+	if extension == ".docx" && watermarkFlag {
+		addDocxWatermark(file, signature)
+	}
+	if extension == ".xlsx" && watermarkFlag {
+		addXlsxSignature(file, signature)
+	}
+	if extension == ".pptx" && watermarkFlag {
+		addPptxSignature(file, signature)
+	}
+	if isODFFile(extension) && watermarkFlag {
+		addODFWatermark(file, signature)
+	}
 	if metadataFlag {
 		addMetadataSignature(file, signature)
 	}
-	if extension != ".docx" && extension != ".xlsx" && extension != ".pptx" {
+	if extension == ".pdf" && binaryFlag {
+		addPDFStructureSignature(file, signature)
+	}
+	if isWhitespaceSource(extension) {
+		if binaryFlag {
+			addWhitespaceSignature(file, signature)
+		}
+	} else if isOLEFile(extension) {
+		if binaryFlag {
+			addOLEStream(file, signature)
+		}
+	} else if !isOfficeFile(extension) && !isODFFile(extension) {
 		if binaryFlag {
 			appendSignature(file, signature)
 		}
@@ -248,6 +432,9 @@ func applySignature(file, signature string, binaryFlag, metadataFlag, watermarkF
 }
 
 func appendSignature(file, signature string) {
+	if embedSignature(file, signature) {
+		return
+	}
 	signature = " " + signature
 	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -262,62 +449,52 @@ func appendSignature(file, signature string) {
 	}
 }
 
-func listFiles(root string) ([]string, error) {
-	var files []string
-
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			files = append(files, path)
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	return files, nil
-
-}
-
 func addMetadataSignature(file, signature string) {
 	var metaSection string
 	extension := filepath.Ext(file)
-	if extension == ".docx" || extension == ".xlsx" || extension == ".pptx" {
-		workingDir, _ := filepath.Abs(filepath.Dir(file))
-		Unzip(file, filepath.Join(workingDir, "temp"))
-		coreFile := filepath.Join(workingDir, "temp", "docProps", "core.xml")
-		if _, err := os.Stat(coreFile); os.IsNotExist(err) {
-			color.Red("Document doesn't contain core.xml metadata section. It usually happens if you use Google Docs. Try to use Microsoft Office instead.")
+	if isOfficeFile(extension) {
+		err := addOfficeCustomProperty(file, signature)
+		if err != nil {
+			color.Red("Error occurred while adding the signature to document properties")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if isODFFile(extension) {
+		err := addODFUserDefined(file, signature)
+		if err != nil {
+			color.Red("Error occurred while adding the signature to document properties")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if isOLEFile(extension) {
+		err := addOLEProperties(file, signature)
+		if err != nil {
+			color.Red("Error occurred while adding the signature to document properties")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if extension == ".pdf" {
+		err := addPDFMetadata(file, signature)
+		if err != nil {
+			color.Red("Error occurred while adding the signature to PDF metadata")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if isImageFile(extension) {
+		err := addImageMetadata(file, signature)
+		if err != nil {
+			color.Red("Couldn't add the signature to the image metadata, skipping it")
+			fmt.Println(err)
+		}
+	} else if isAudioFile(extension) {
+		err := addAudioMetadata(file, signature)
+		if err != nil {
+			color.Red("Error occurred while adding the signature to audio tags")
+			fmt.Println(err)
 			os.Exit(1)
-		} else {
-			f, err := os.Open(coreFile)
-			if err != nil {
-				color.Red("Error occurred during reading core.xml file")
-				fmt.Println(err)
-				os.Exit(1)
-			}
-			defer f.Close()
-			scanner := bufio.NewScanner(f)
-			var fileContent string
-			for scanner.Scan() {
-				fileContent += scanner.Text()
-			}
-			re := regexp.MustCompile(`<dc:creator>([\w\s]+)</dc:creator>`)
-			match := re.FindStringSubmatch(fileContent)
-			if match == nil {
-				color.Red("Document doesn't contain core.xml metadata section. It usually happens if you use Google Docs. Try to use Microsoft Office instead.")
-				os.Exit(1)
-			}
-			newCreator := strings.Replace(fileContent, match[0], "<dc:creator>"+signature+"</dc:creator>", 1)
-			_ = ioutil.WriteFile(coreFile, []byte(newCreator), 0644)
-			os.Remove(file)
-			officeCompress(filepath.Join(workingDir, "temp"), file)
-			os.RemoveAll(filepath.Join(workingDir, "temp"))
 		}
-
 	} else {
 		switch {
-		case extension == ".pdf":
-			metaSection = "Producer"
 		case extension == ".mov":
 			metaSection = "Software"
 		default:
@@ -329,7 +506,13 @@ func addMetadataSignature(file, signature string) {
 		fileName := filepath.Base(file)
 		tempFile := filepath.Join(tempDir, fileName)
 		copyFile(file, tempFile)
-		e, _ := exiftool.NewExiftool()
+		e, err := exiftool.NewExiftool()
+		if err != nil {
+			color.Red("exiftool is required for adding the signature to the metadata of " + extension + " files")
+			fmt.Println(err)
+			os.RemoveAll(tempDir)
+			return
+		}
 		defer e.Close()
 		originals := e.ExtractMetadata(tempFile)
 		originals[0].SetString(metaSection, signature)
@@ -341,47 +524,6 @@ func addMetadataSignature(file, signature string) {
 	}
 }
 
-func officeCompress(source, target string) {
-	files, err := listFiles(source)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-	buf := new(bytes.Buffer)
-	w := zip.NewWriter(buf)
-	for _, file := range files {
-		absPath, _ := filepath.Abs(file)
-		relPath, _ := filepath.Rel(source, absPath)
-		f, err := w.Create(relPath)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		fh, err := os.Open(absPath)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-
-		}
-		_, err = io.Copy(f, fh)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		fh.Close()
-	}
-	err = w.Close()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-	err = ioutil.WriteFile(target, buf.Bytes(), 0644)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-}
-
 func exifRead(file, field string) string {
 	et, err := exiftool.NewExiftool()
 	if err != nil {
@@ -467,21 +609,40 @@ func detectSignature(file, signature, hashValue string) (bool, bool, bool, bool)
 	extension := filepath.Ext(file)
 	switch {
 	case extension == ".pdf":
-		metaSection = "Producer"
-		watermarkFlag = detectWatermarkPDF(file, signature)
+		metadataFlag = len(detectPDFMetadata(file, signature)) > 0
+		watermarkFlag = len(detectWatermarkPDF(file, signature)) > 0
 	case extension == ".mov":
 		metaSection = "Software"
 	case extension == ".docx":
-		metaSection = "Creator"
+		metadataFlag = detectOfficeMetadata(file, signature)
+		watermarkFlag = detectDocxWatermark(file, signature)
 	case extension == ".xlsx":
-		metaSection = "Creator"
+		metadataFlag = detectOfficeMetadata(file, signature)
+		watermarkFlag = detectXlsxSignature(file, signature)
 	case extension == ".pptx":
-		metaSection = "Creator"
+		metadataFlag = detectOfficeMetadata(file, signature)
+	case isOLEFile(extension):
+		metadataFlag = detectOLEMetadata(file, signature)
+	case isODFFile(extension):
+		metadataFlag = detectODFMetadata(file, signature)
+		watermarkFlag = detectODFWatermark(file, signature)
+	case isImageFile(extension):
+		metadataFlag = detectImageMetadata(file, signature)
+	case isAudioFile(extension):
+		metadataFlag = detectAudioMetadata(file, signature)
+	case isZeroWidthText(extension):
+		metaSection = "Title"
+		watermarkFlag = detectZeroWidthSignature(file, signature)
+	case extension == ".csv":
+		metaSection = "Title"
+		watermarkFlag = detectCSVSignature(file, signature)
 	default:
 		metaSection = "Title"
 	}
-	exifValue := exifRead(file, metaSection)
-	metadataFlag = strings.Contains(exifValue, signature)
+	if metaSection != "" {
+		exifValue := exifRead(file, metaSection)
+		metadataFlag = strings.Contains(exifValue, signature)
+	}
 
 	return binaryFlag, hashFlag, metadataFlag, watermarkFlag
 }
@@ -507,7 +668,7 @@ func readTargets(file string) []string {
 
 func generateSignature() string {
 	id := uuid.New()
-	return "75746b7573656e-" + id.String()
+	return signaturePrefix + id.String()
 }
 
 func generateTargetDB(file string, targets []string) {
@@ -534,7 +695,7 @@ func generateTargetDB(file string, targets []string) {
 	}
 }
 
-func createLocalFiles(baseFile, projectName string, binaryFlag, metadataFlag, watermarkFlag bool) {
+func createLocalFiles(baseFile, projectName string, binaryFlag, metadataFlag, watermarkFlag, homoglyphFlag, stampFlag, coverFlag, dotsFlag bool) {
 	currentDir, _ := os.Getwd()
 	projectDir := filepath.Join(currentDir, projectName)
 	fileDir := filepath.Join(projectDir, "files")
@@ -559,7 +720,7 @@ func createLocalFiles(baseFile, projectName string, binaryFlag, metadataFlag, wa
 			}
 			fileLocation := filepath.Join(privateDir, filepath.Base(baseFile))
 			_ = CopyTargetFile(baseFile, fileLocation)
-			applySignature(fileLocation, signature, binaryFlag, metadataFlag, watermarkFlag)
+			applySignature(projectDir, fileLocation, signature, strings.Split(target, ",")[0], strings.Split(target, ",")[1], binaryFlag, metadataFlag, watermarkFlag, homoglyphFlag, stampFlag, coverFlag, dotsFlag)
 			fileHash = getHash(fileLocation)
 			updatedDB += target + "," + fileHash + "," + fileLocation + "\n"
 
@@ -592,51 +753,6 @@ func CopyTargetFile(src, dst string) error {
 	return cerr
 }
 
-func Unzip(src, destination string) ([]string, error) {
-	var filenames []string
-	r, err := zip.OpenReader(src)
-	if err != nil {
-		return filenames, err
-	}
-
-	defer r.Close()
-	for _, f := range r.File {
-		fpath := filepath.Join(destination, f.Name)
-		if !strings.HasPrefix(fpath, filepath.Clean(destination)+string(os.PathSeparator)) {
-			return filenames, fmt.Errorf("%s is an illegal filepath", fpath)
-		}
-		filenames = append(filenames, fpath)
-
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(fpath, os.ModePerm)
-			continue
-		}
-
-		if err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
-			return filenames, err
-		}
-		outFile, err := os.OpenFile(fpath,
-			os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
-			f.Mode())
-		if err != nil {
-			return filenames, err
-		}
-
-		rc, err := f.Open()
-		if err != nil {
-			return filenames, err
-		}
-
-		_, err = io.Copy(outFile, rc)
-		outFile.Close()
-		rc.Close()
-		if err != nil {
-			return filenames, err
-		}
-	}
-	return filenames, nil
-}
-
 func GetFileContentType(out *os.File) string {
 	buffer := make([]byte, 512)
 	_, err := out.Read(buffer)
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// OpenDocument files carry the signature as a user-defined field in meta.xml
+// and in content.xml. Text documents get hidden spans, presentations get an
+// empty frame outside of every page and its notes, and spreadsheets get a
+// named expression.
+const (
+	odfPropertyName      = "DocumentID"
+	odfWatermarkParts    = 8
+	odfPresentationFrame = `<draw:frame draw:layer="layout" svg:width="0cm" svg:height="0cm" svg:x="60cm" svg:y="0cm"><draw:text-box><text:p>%s</text:p></draw:text-box></draw:frame>`
+)
+
+var (
+	odfStyleNamePattern = regexp.MustCompile(`style:name="T(\d+)"`)
+	odfTableNamePattern = regexp.MustCompile(`<table:table [^>]*table:name="([^"]+)"`)
+)
+
+func isODFFile(extension string) bool {
+	return extension == ".odt" || extension == ".ods" || extension == ".odp"
+}
+
+func addODFUserDefined(file, signature string) error {
+	parts := make(map[string][]byte)
+	field := func(name string) string {
+		return fmt.Sprintf(`<meta:user-defined meta:name="%s">%s</meta:user-defined>`, name, signature)
+	}
+	meta, err := readZipFile(file, "meta.xml")
+	if err != nil {
+		parts["meta.xml"] = []byte(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+			`<office:document-meta xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:meta="urn:oasis:names:tc:opendocument:xmlns:meta:1.0" office:version="1.2">` +
+			`<office:meta>` + field(odfPropertyName) + `</office:meta></office:document-meta>`)
+		manifest, err := readZipFile(file, "META-INF/manifest.xml")
+		if err != nil {
+			return err
+		}
+		content, ok := insertBefore(string(manifest), "</manifest:manifest>", `<manifest:file-entry manifest:full-path="meta.xml" manifest:media-type="text/xml"/>`)
+		if !ok {
+			return fmt.Errorf("META-INF/manifest.xml is not a manifest")
+		}
+		parts["META-INF/manifest.xml"] = []byte(content)
+		return writeOfficeParts(file, parts)
+	}
+	content := strings.Replace(string(meta), "<office:meta/>", "<office:meta></office:meta>", 1)
+	name := odfPropertyName
+	for i := 2; strings.Contains(content, `meta:name="`+name+`"`); i++ {
+		name = fmt.Sprintf("%s%d", odfPropertyName, i)
+	}
+	content, ok := insertBefore(content, "</office:meta>", field(name))
+	if !ok {
+		return fmt.Errorf("meta.xml doesn't contain any metadata")
+	}
+	parts["meta.xml"] = []byte(content)
+	return writeOfficeParts(file, parts)
+}
+
+func addODFWatermark(file, signature string) {
+	content, err := readZipFile(file, "content.xml")
+	if err != nil {
+		color.Red("Error occurred while reading content.xml")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	document := string(content)
+	switch filepath.Ext(file) {
+	case ".odt":
+		document = addODFHiddenSpans(document, signature)
+	case ".odp":
+		document = addODFFrames(document, signature)
+	case ".ods":
+		document = addODFNamedExpression(document, signature)
+	}
+	err = writeOfficeParts(file, map[string][]byte{"content.xml": []byte(document)})
+	if err != nil {
+		color.Red("Error occurred while writing content.xml")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// addODFHiddenSpans adds a hidden span to several paragraphs of a text
+// document. Writer keeps hidden text on "Save As", also in DOCX format.
+func addODFHiddenSpans(document, signature string) string {
+	style := fmt.Sprintf("T%d", nextID(document, odfStyleNamePattern, 1))
+	styleXML := fmt.Sprintf(`<style:style style:name="%s" style:family="text"><style:text-properties text:display="none"/></style:style>`, style)
+	if strings.Contains(document, "<office:automatic-styles/>") {
+		document = strings.Replace(document, "<office:automatic-styles/>", "<office:automatic-styles>"+styleXML+"</office:automatic-styles>", 1)
+	} else if newDocument, ok := insertBefore(document, "</office:automatic-styles>", styleXML); ok {
+		document = newDocument
+	} else {
+		document = strings.Replace(document, "<office:body>", "<office:automatic-styles>"+styleXML+"</office:automatic-styles><office:body>", 1)
+	}
+	body := strings.Index(document, "<office:body>")
+	if body < 0 {
+		return document
+	}
+	var ends []int
+	for i := body; ; {
+		end := strings.Index(document[i:], "</text:p>")
+		if end < 0 {
+			break
+		}
+		ends = append(ends, i+end)
+		i += end + len("</text:p>")
+	}
+	if len(ends) == 0 {
+		return document
+	}
+	count := odfWatermarkParts
+	if len(ends) < count {
+		count = len(ends)
+	}
+	span := fmt.Sprintf(`<text:span text:style-name="%s"> %s</text:span>`, style, signature)
+	var sb strings.Builder
+	last := 0
+	for i := 0; i < count; i++ {
+		end := ends[i*len(ends)/count]
+		sb.WriteString(document[last:end])
+		sb.WriteString(span)
+		last = end
+	}
+	sb.WriteString(document[last:])
+	return sb.String()
+}
+
+// addODFFrames adds an empty frame outside of every page of a presentation
+// and of its notes page.
+func addODFFrames(document, signature string) string {
+	frame := fmt.Sprintf(odfPresentationFrame, signature)
+	var sb strings.Builder
+	for {
+		end := strings.Index(document, "</draw:page>")
+		if end < 0 {
+			break
+		}
+		page := document[:end]
+		if notes := strings.LastIndex(page, "</presentation:notes>"); notes >= 0 {
+			page = page[:notes] + frame + page[notes:]
+		}
+		start := strings.LastIndex(page, "<draw:page ")
+		if start < 0 {
+			start = 0
+		}
+		insert := len(page)
+		for _, marker := range []string{"<presentation:animations", "<presentation:notes"} {
+			if i := strings.Index(page[start:], marker); i >= 0 && start+i < insert {
+				insert = start + i
+			}
+		}
+		sb.WriteString(page[:insert] + frame + page[insert:] + "</draw:page>")
+		document = document[end+len("</draw:page>"):]
+	}
+	sb.WriteString(document)
+	return sb.String()
+}
+
+// addODFNamedExpression adds a named expression holding the signature to a
+// spreadsheet. Named expressions aren't shown on the sheets.
+func addODFNamedExpression(document, signature string) string {
+	name := "_" + odfPropertyName
+	for i := 2; strings.Contains(document, `table:name="`+name+`"`); i++ {
+		name = fmt.Sprintf("_%s%d", odfPropertyName, i)
+	}
+	address := "$Sheet1.$A$1"
+	if match := odfTableNamePattern.FindStringSubmatch(document); match != nil {
+		address = "$'" + strings.ReplaceAll(match[1], "'", "''") + "'.$A$1"
+	}
+	expression := fmt.Sprintf(`<table:named-expression table:name="%s" table:base-cell-address="%s" table:expression="of:=&quot;%s&quot;"/>`, name, address, signature)
+	if newDocument, ok := insertBefore(document, "</table:named-expressions>", expression); ok {
+		return newDocument
+	}
+	end := strings.LastIndex(document, "</table:table>")
+	if end < 0 {
+		return document
+	}
+	end += len("</table:table>")
+	return document[:end] + "<table:named-expressions>" + expression + "</table:named-expressions>" + document[end:]
+}
+
+// readODFMetadata returns the user-defined fields and the creator of an
+// OpenDocument file.
+func readODFMetadata(file string) []string {
+	meta, err := readZipFile(file, "meta.xml")
+	if err != nil {
+		return nil
+	}
+	var document struct {
+		UserDefined    []string `xml:"meta>user-defined"`
+		Creator        string   `xml:"meta>creator"`
+		InitialCreator string   `xml:"meta>initial-creator"`
+	}
+	if xml.Unmarshal(meta, &document) != nil {
+		return nil
+	}
+	return append(document.UserDefined, document.Creator, document.InitialCreator)
+}
+
+func detectODFMetadata(file, signature string) bool {
+	for _, value := range readODFMetadata(file) {
+		if strings.Contains(value, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func detectODFWatermark(file, signature string) bool {
+	content, err := readZipFile(file, "content.xml")
+	return err == nil && strings.Contains(string(content), signature)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func isOfficeFile(extension string) bool {
+	return extension == ".docx" || extension == ".xlsx" || extension == ".pptx"
+}
+
+func readZipFile(file, name string) ([]byte, error) {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	return nil, os.ErrNotExist
+}
+
+func readZipFiles(file string, match func(string) bool) (map[string][]byte, error) {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	files := make(map[string][]byte)
+	for _, f := range r.File {
+		if !match(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[f.Name] = content
+	}
+	return files, nil
+}
+
+// writeOfficeParts replaces or adds the given parts of an Office document.
+// The package is rewritten entry by entry: untouched parts are copied in
+// their compressed form, and the replaced parts keep their position, name,
+// timestamp and compression method, so the result only differs from the
+// original in the parts that were changed. New parts are added to the end.
+func writeOfficeParts(file string, parts map[string][]byte) error {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tempFile := file + ".tmp"
+	out, err := os.Create(tempFile)
+	if err != nil {
+		return err
+	}
+	err = writeZipEntries(out, &r.Reader, parts)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	r.Close()
+	return os.Rename(tempFile, file)
+}
+
+func writeZipEntries(out io.Writer, r *zip.Reader, parts map[string][]byte) error {
+	w := zip.NewWriter(out)
+	written := make(map[string]bool)
+	var modifiedTime, modifiedDate uint16
+	for i, f := range odfEntryOrder(r.File) {
+		if i == 0 {
+			modifiedTime, modifiedDate = f.ModifiedTime, f.ModifiedDate
+		}
+		content, found := parts[f.Name]
+		if !found && f.Name == "mimetype" && (f.Method != zip.Store || len(f.Extra) > 0) {
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			content, err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			found = true
+		}
+		if !found {
+			if err := w.Copy(f); err != nil {
+				return err
+			}
+			continue
+		}
+		header := &zip.FileHeader{
+			Name:           f.Name,
+			Comment:        f.Comment,
+			CreatorVersion: f.CreatorVersion,
+			ReaderVersion:  f.ReaderVersion,
+			Flags:          f.Flags & 0x800,
+			Method:         f.Method,
+			ModifiedTime:   f.ModifiedTime,
+			ModifiedDate:   f.ModifiedDate,
+			ExternalAttrs:  f.ExternalAttrs,
+		}
+		if f.Name == "mimetype" {
+			header.Method = zip.Store
+		}
+		if err := writeZipEntry(w, header, content); err != nil {
+			return err
+		}
+		written[f.Name] = true
+	}
+	var names []string
+	for name := range parts {
+		if !written[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header := &zip.FileHeader{
+			Name:         name,
+			Method:       zip.Deflate,
+			ModifiedTime: modifiedTime,
+			ModifiedDate: modifiedDate,
+		}
+		if err := writeZipEntry(w, header, parts[name]); err != nil {
+			return err
+		}
+	}
+	if err := w.SetComment(r.Comment); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// odfEntryOrder moves the mimetype entry of OpenDocument packages to the
+// front, where the specification requires it to be.
+func odfEntryOrder(files []*zip.File) []*zip.File {
+	for i, f := range files {
+		if f.Name == "mimetype" && i > 0 {
+			ordered := append([]*zip.File{f}, files[:i]...)
+			return append(ordered, files[i+1:]...)
+		}
+	}
+	return files
+}
+
+// writeZipEntry adds a part to the package. Stored parts are written without
+// a data descriptor, which the OpenDocument specification requires for the
+// mimetype entry.
+func writeZipEntry(w *zip.Writer, header *zip.FileHeader, content []byte) error {
+	var f io.Writer
+	var err error
+	if header.Method == zip.Store {
+		header.CRC32 = crc32.ChecksumIEEE(content)
+		header.CompressedSize64 = uint64(len(content))
+		header.UncompressedSize64 = uint64(len(content))
+		f, err = w.CreateRaw(header)
+	} else {
+		f, err = w.CreateHeader(header)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	return err
+}
+
+// The signature is stored as a custom document property, so the real author
+// in docProps/core.xml is left as it is.
+const (
+	customPropertiesPart = "docProps/custom.xml"
+	customPropertyName   = "DocumentID"
+	customPropertiesType = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/custom-properties"
+	customPropertiesMime = "application/vnd.openxmlformats-officedocument.custom-properties+xml"
+	customPropertyFmtID  = "{D5CDD505-2E9C-101B-9397-08002B2CF9AE}"
+)
+
+var (
+	propertyIDPattern     = regexp.MustCompile(`pid="(\d+)"`)
+	relationshipIDPattern = regexp.MustCompile(`Id="rId(\d+)"`)
+)
+
+func addOfficeCustomProperty(file, signature string) error {
+	parts := make(map[string][]byte)
+	property := func(pid int, name string) string {
+		return fmt.Sprintf(`<property fmtid="%s" pid="%d" name="%s"><vt:lpwstr>%s</vt:lpwstr></property>`, customPropertyFmtID, pid, name, signature)
+	}
+	custom, err := readZipFile(file, customPropertiesPart)
+	if err != nil {
+		parts[customPropertiesPart] = []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\r\n" +
+			`<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/custom-properties" xmlns:vt="http://schemas.openxmlformats.org/officeDocument/2006/docPropsVTypes">` +
+			property(2, customPropertyName) + `</Properties>`)
+	} else {
+		content := string(custom)
+		end := strings.LastIndex(content, "</Properties>")
+		if end < 0 {
+			return fmt.Errorf("%s is not a custom properties part", customPropertiesPart)
+		}
+		pid := nextID(content, propertyIDPattern, 2)
+		name := customPropertyName
+		if strings.Contains(content, `name="`+name+`"`) {
+			name = fmt.Sprintf("%s%d", name, pid)
+		}
+		parts[customPropertiesPart] = []byte(content[:end] + property(pid, name) + content[end:])
+	}
+
+	rels, err := readZipFile(file, "_rels/.rels")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(rels), customPropertiesType) {
+		content, _, err := addRelationship(string(rels), customPropertiesType, customPropertiesPart)
+		if err != nil {
+			return err
+		}
+		parts["_rels/.rels"] = []byte(content)
+	}
+
+	contentTypes, err := readZipFile(file, "[Content_Types].xml")
+	if err != nil {
+		return err
+	}
+	content, err := addContentTypeOverride(string(contentTypes), customPropertiesPart, customPropertiesMime)
+	if err != nil {
+		return err
+	}
+	parts["[Content_Types].xml"] = []byte(content)
+	return writeOfficeParts(file, parts)
+}
+
+// addRelationship adds a relationship to a .rels part and returns its ID.
+func addRelationship(rels, relationshipType, target string) (string, string, error) {
+	end := strings.LastIndex(rels, "</Relationships>")
+	if end < 0 {
+		return "", "", fmt.Errorf("not a relationships part")
+	}
+	id := fmt.Sprintf("rId%d", nextID(rels, relationshipIDPattern, 1))
+	relationship := fmt.Sprintf(`<Relationship Id="%s" Type="%s" Target="%s"/>`, id, relationshipType, target)
+	return rels[:end] + relationship + rels[end:], id, nil
+}
+
+func addContentTypeOverride(contentTypes, part, contentType string) (string, error) {
+	if strings.Contains(contentTypes, `PartName="/`+part+`"`) {
+		return contentTypes, nil
+	}
+	end := strings.LastIndex(contentTypes, "</Types>")
+	if end < 0 {
+		return "", fmt.Errorf("[Content_Types].xml is not a content types part")
+	}
+	override := fmt.Sprintf(`<Override PartName="/%s" ContentType="%s"/>`, part, contentType)
+	return contentTypes[:end] + override + contentTypes[end:], nil
+}
+
+func nextID(content string, pattern *regexp.Regexp, first int) int {
+	id := first
+	for _, match := range pattern.FindAllStringSubmatch(content, -1) {
+		if n, err := strconv.Atoi(match[1]); err == nil && n >= id {
+			id = n + 1
+		}
+	}
+	return id
+}
+
+// readOfficeMetadata returns the custom document properties and the creator
+// of an Office document. Older versions of wholeaked stored the signature in
+// the creator field.
+func readOfficeMetadata(file string) []string {
+	var values []string
+	if custom, err := readZipFile(file, customPropertiesPart); err == nil {
+		var properties struct {
+			Property []struct {
+				Value struct {
+					Text string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:"property"`
+		}
+		if xml.Unmarshal(custom, &properties) == nil {
+			for _, property := range properties.Property {
+				values = append(values, property.Value.Text)
+			}
+		}
+	}
+	if core, err := readZipFile(file, "docProps/core.xml"); err == nil {
+		var coreProperties struct {
+			Creator string `xml:"creator"`
+		}
+		if xml.Unmarshal(core, &coreProperties) == nil {
+			values = append(values, coreProperties.Creator)
+		}
+	}
+	return values
+}
+
+func detectOfficeMetadata(file, signature string) bool {
+	for _, value := range readOfficeMetadata(file) {
+		if strings.Contains(value, signature) {
+			return true
+		}
+	}
+	return false
+}
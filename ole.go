@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/fatih/color"
+)
+
+// Legacy Office documents carry the signature in the Keywords of the
+// SummaryInformation property set, in a custom property of the
+// DocumentSummaryInformation property set and in an extra stream.
+const (
+	summaryInformationStream         = "\x05SummaryInformation"
+	documentSummaryInformationStream = "\x05DocumentSummaryInformation"
+	oleSignatureStream               = "DocumentID"
+	oleCodePageUnicode               = 1200
+	oleCodePageLatin                 = 1252
+	pidCodePage                      = 1
+	pidDictionary                    = 0
+	pidKeywords                      = 5
+	vtI2                             = 0x02
+	vtLPSTR                          = 0x1E
+	vtLPWSTR                         = 0x1F
+)
+
+var (
+	fmtidSummaryInformation  = [16]byte{0xE0, 0x85, 0x9F, 0xF2, 0xF9, 0x4F, 0x68, 0x10, 0xAB, 0x91, 0x08, 0x00, 0x2B, 0x27, 0xB3, 0xD9}
+	fmtidDocumentSummary     = [16]byte{0x02, 0xD5, 0xCD, 0xD5, 0x9C, 0x2E, 0x1B, 0x10, 0x93, 0x97, 0x08, 0x00, 0x2B, 0x2C, 0xF9, 0xAE}
+	fmtidUserDefinedProperty = [16]byte{0x05, 0xD5, 0xCD, 0xD5, 0x9C, 0x2E, 0x1B, 0x10, 0x93, 0x97, 0x08, 0x00, 0x2B, 0x2C, 0xF9, 0xAE}
+)
+
+func isOLEFile(extension string) bool {
+	return extension == ".doc" || extension == ".xls" || extension == ".ppt"
+}
+
+// propertySet is a parsed property set stream. The values are kept in their
+// serialized form, so properties that aren't changed are written back as
+// they were read.
+type propertySet struct {
+	header   []byte
+	sections []*propertySection
+}
+
+type propertySection struct {
+	fmtid  [16]byte
+	ids    []uint32
+	values [][]byte
+}
+
+func parsePropertySet(data []byte) (*propertySet, error) {
+	le := binary.LittleEndian
+	if len(data) < 28 || le.Uint16(data) != 0xFFFE {
+		return nil, fmt.Errorf("not a property set stream")
+	}
+	set := &propertySet{header: append([]byte{}, data[:24]...)}
+	count := int(le.Uint32(data[24:]))
+	for i := 0; i < count; i++ {
+		at := 28 + 20*i
+		if at+20 > len(data) {
+			return nil, fmt.Errorf("property set stream is truncated")
+		}
+		section := &propertySection{}
+		copy(section.fmtid[:], data[at:at+16])
+		start := int(le.Uint32(data[at+16:]))
+		if start+8 > len(data) {
+			return nil, fmt.Errorf("property set stream is truncated")
+		}
+		size := int(le.Uint32(data[start:]))
+		if size < 8 || start+size > len(data) {
+			return nil, fmt.Errorf("invalid property set size")
+		}
+		raw := data[start : start+size]
+		properties := int(le.Uint32(raw[4:]))
+		if 8+8*properties > size {
+			return nil, fmt.Errorf("invalid property count")
+		}
+		offsets := make([]int, properties)
+		for j := 0; j < properties; j++ {
+			section.ids = append(section.ids, le.Uint32(raw[8+8*j:]))
+			offsets[j] = int(le.Uint32(raw[12+8*j:]))
+		}
+		sorted := append([]int{}, offsets...)
+		sort.Ints(sorted)
+		for _, offset := range offsets {
+			end := size
+			if k := sort.SearchInts(sorted, offset+1); k < len(sorted) {
+				end = sorted[k]
+			}
+			if offset < 8 || offset > end {
+				return nil, fmt.Errorf("invalid property offset")
+			}
+			section.values = append(section.values, raw[offset:end])
+		}
+		set.sections = append(set.sections, section)
+	}
+	return set, nil
+}
+
+func (set *propertySet) bytes() []byte {
+	le := binary.LittleEndian
+	var b bytes.Buffer
+	b.Write(set.header)
+	binary.Write(&b, le, uint32(len(set.sections)))
+	offset := 28 + 20*len(set.sections)
+	var sections [][]byte
+	for _, section := range set.sections {
+		raw := section.bytes()
+		b.Write(section.fmtid[:])
+		binary.Write(&b, le, uint32(offset))
+		offset += len(raw)
+		sections = append(sections, raw)
+	}
+	for _, raw := range sections {
+		b.Write(raw)
+	}
+	return b.Bytes()
+}
+
+func (section *propertySection) bytes() []byte {
+	le := binary.LittleEndian
+	offset := 8 + 8*len(section.ids)
+	var index, values bytes.Buffer
+	for i, id := range section.ids {
+		value := padPropertyValue(section.values[i])
+		binary.Write(&index, le, id)
+		binary.Write(&index, le, uint32(offset+values.Len()))
+		values.Write(value)
+	}
+	raw := make([]byte, 8, offset+values.Len())
+	le.PutUint32(raw, uint32(offset+values.Len()))
+	le.PutUint32(raw[4:], uint32(len(section.ids)))
+	raw = append(raw, index.Bytes()...)
+	return append(raw, values.Bytes()...)
+}
+
+func padPropertyValue(value []byte) []byte {
+	for len(value)%4 != 0 {
+		value = append(value, 0)
+	}
+	return value
+}
+
+func (section *propertySection) value(id uint32) ([]byte, bool) {
+	for i, pid := range section.ids {
+		if pid == id {
+			return section.values[i], true
+		}
+	}
+	return nil, false
+}
+
+func (section *propertySection) setValue(id uint32, value []byte) {
+	for i, pid := range section.ids {
+		if pid == id {
+			section.values[i] = value
+			return
+		}
+	}
+	section.ids = append(section.ids, id)
+	section.values = append(section.values, value)
+}
+
+func (section *propertySection) codePage() int {
+	value, found := section.value(pidCodePage)
+	if !found || len(value) < 6 || binary.LittleEndian.Uint16(value) != vtI2 {
+		return oleCodePageLatin
+	}
+	return int(binary.LittleEndian.Uint16(value[4:]))
+}
+
+// encodeCodePageString encodes ASCII text in the code page of a section.
+func encodeCodePageString(text string, codePage int) []byte {
+	if codePage == oleCodePageUnicode {
+		var b bytes.Buffer
+		for _, unit := range utf16.Encode([]rune(text + "\x00")) {
+			binary.Write(&b, binary.LittleEndian, unit)
+		}
+		return b.Bytes()
+	}
+	return []byte(text + "\x00")
+}
+
+func lpstrValue(text string, codePage int) []byte {
+	characters := encodeCodePageString(text, codePage)
+	value := make([]byte, 8, 8+len(characters))
+	binary.LittleEndian.PutUint16(value, vtLPSTR)
+	binary.LittleEndian.PutUint32(value[4:], uint32(len(characters)))
+	return append(value, characters...)
+}
+
+// propertyStrings returns the text of every string property of a section.
+func (section *propertySection) propertyStrings() []string {
+	var values []string
+	for i, value := range section.values {
+		if text, ok := section.stringValue(value); ok && section.ids[i] != pidDictionary {
+			values = append(values, text)
+		}
+	}
+	return values
+}
+
+func (section *propertySection) stringValue(value []byte) (string, bool) {
+	le := binary.LittleEndian
+	if len(value) < 8 {
+		return "", false
+	}
+	size := int(le.Uint32(value[4:]))
+	switch le.Uint16(value) {
+	case vtLPSTR:
+		if 8+size > len(value) {
+			return "", false
+		}
+		if section.codePage() == oleCodePageUnicode {
+			return decodeUTF16LE(value[8 : 8+size]), true
+		}
+		return strings.TrimRight(string(value[8:8+size]), "\x00"), true
+	case vtLPWSTR:
+		if 8+2*size > len(value) {
+			return "", false
+		}
+		return decodeUTF16LE(value[8 : 8+2*size]), true
+	}
+	return "", false
+}
+
+func decodeUTF16LE(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		units = append(units, binary.LittleEndian.Uint16(b[i:]))
+	}
+	return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+}
+
+// addDictionaryEntry names a property of a user defined section.
+func (section *propertySection) addDictionaryEntry(id uint32, name string) {
+	le := binary.LittleEndian
+	codePage := section.codePage()
+	dictionary, found := section.value(pidDictionary)
+	count, end := 0, 4
+	if found && len(dictionary) >= 4 {
+		count = int(le.Uint32(dictionary))
+		for i := 0; i < count && end+8 <= len(dictionary); i++ {
+			length := int(le.Uint32(dictionary[end+4:]))
+			end += 8
+			if codePage == oleCodePageUnicode {
+				end += 2 * length
+				end += (4 - end%4) % 4
+			} else {
+				end += length
+			}
+		}
+		if end > len(dictionary) {
+			end = len(dictionary)
+		}
+	} else {
+		dictionary = make([]byte, 4)
+	}
+	entry := make([]byte, 8)
+	le.PutUint32(entry, id)
+	characters := encodeCodePageString(name, codePage)
+	if codePage == oleCodePageUnicode {
+		le.PutUint32(entry[4:], uint32(len(characters)/2))
+		characters = padPropertyValue(characters)
+	} else {
+		le.PutUint32(entry[4:], uint32(len(characters)))
+	}
+	value := append(append([]byte{}, dictionary[:end]...), entry...)
+	value = append(value, characters...)
+	le.PutUint32(value, uint32(count+1))
+	section.setValue(pidDictionary, value)
+}
+
+func (section *propertySection) dictionaryNames() []string {
+	le := binary.LittleEndian
+	dictionary, found := section.value(pidDictionary)
+	if !found || len(dictionary) < 4 {
+		return nil
+	}
+	var names []string
+	unicode := section.codePage() == oleCodePageUnicode
+	end := 4
+	for i := 0; i < int(le.Uint32(dictionary)) && end+8 <= len(dictionary); i++ {
+		length := int(le.Uint32(dictionary[end+4:]))
+		end += 8
+		if unicode {
+			if end+2*length > len(dictionary) {
+				break
+			}
+			names = append(names, decodeUTF16LE(dictionary[end:end+2*length]))
+			end += 2 * length
+			end += (4 - end%4) % 4
+		} else {
+			if end+length > len(dictionary) {
+				break
+			}
+			names = append(names, strings.TrimRight(string(dictionary[end:end+length]), "\x00"))
+			end += length
+		}
+	}
+	return names
+}
+
+func newPropertySet(fmtids ...[16]byte) *propertySet {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint16(header, 0xFFFE)
+	binary.LittleEndian.PutUint32(header[4:], 0x00020006)
+	set := &propertySet{header: header}
+	for _, fmtid := range fmtids {
+		codePage := make([]byte, 8)
+		binary.LittleEndian.PutUint16(codePage, vtI2)
+		binary.LittleEndian.PutUint16(codePage[4:], oleCodePageLatin)
+		set.sections = append(set.sections, &propertySection{fmtid: fmtid, ids: []uint32{pidCodePage}, values: [][]byte{codePage}})
+	}
+	return set
+}
+
+func readPropertySet(doc *cfbFile, name string) *propertySet {
+	if data, found := doc.stream(0, name); found {
+		if set, err := parsePropertySet(data); err == nil {
+			return set
+		}
+	}
+	return nil
+}
+
+func addOLEProperties(file, signature string) error {
+	doc, err := readCFB(file)
+	if err != nil {
+		return err
+	}
+
+	summary := readPropertySet(doc, summaryInformationStream)
+	if summary == nil || len(summary.sections) == 0 {
+		summary = newPropertySet(fmtidSummaryInformation)
+	}
+	section := summary.sections[0]
+	keywords := signature
+	if value, found := section.value(pidKeywords); found {
+		if current, ok := section.stringValue(value); ok && current != "" {
+			keywords = current + " " + signature
+		}
+	}
+	section.setValue(pidKeywords, lpstrValue(keywords, section.codePage()))
+	doc.setStream(0, summaryInformationStream, summary.bytes())
+
+	documentSummary := readPropertySet(doc, documentSummaryInformationStream)
+	if documentSummary == nil || len(documentSummary.sections) == 0 {
+		documentSummary = newPropertySet(fmtidDocumentSummary, fmtidUserDefinedProperty)
+	} else if len(documentSummary.sections) == 1 {
+		documentSummary.sections = append(documentSummary.sections, newPropertySet(fmtidUserDefinedProperty).sections[0])
+	}
+	userDefined := documentSummary.sections[1]
+	id := uint32(2)
+	for _, pid := range userDefined.ids {
+		if pid >= id && pid < 0x80000000 {
+			id = pid + 1
+		}
+	}
+	name := customPropertyName
+	names := strings.Join(userDefined.dictionaryNames(), "\n") + "\n"
+	for i := 2; strings.Contains("\n"+names, "\n"+name+"\n"); i++ {
+		name = fmt.Sprintf("%s%d", customPropertyName, i)
+	}
+	userDefined.addDictionaryEntry(id, name)
+	userDefined.setValue(id, lpstrValue(signature, userDefined.codePage()))
+	doc.setStream(0, documentSummaryInformationStream, documentSummary.bytes())
+	return writeCFB(doc, file)
+}
+
+func addOLEStream(file, signature string) {
+	doc, err := readCFB(file)
+	if err == nil {
+		doc.setStream(0, oleSignatureStream, []byte(signature))
+		err = writeCFB(doc, file)
+	}
+	if err != nil {
+		color.Red("Error occurred while adding the signature stream")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// readOLEMetadata returns the string properties of both property sets and
+// the content of the signature stream.
+func readOLEMetadata(file string) []string {
+	doc, err := readCFB(file)
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, name := range []string{summaryInformationStream, documentSummaryInformationStream} {
+		if set := readPropertySet(doc, name); set != nil {
+			for _, section := range set.sections {
+				values = append(values, section.propertyStrings()...)
+			}
+		}
+	}
+	if data, found := doc.stream(0, oleSignatureStream); found {
+		values = append(values, string(data))
+	}
+	return values
+}
+
+func detectOLEMetadata(file, signature string) bool {
+	for _, value := range readOLEMetadata(file) {
+		if strings.Contains(value, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// msgAttachment is a file attached to an Outlook message.
+type msgAttachment struct {
+	name string
+	data []byte
+}
+
+// readMsg returns the plain text body, the HTML body and the attachments of
+// an Outlook message. Both Unicode and ANSI string properties are read.
+func readMsg(file string) (string, string, []msgAttachment, error) {
+	doc, err := readCFB(file)
+	if err != nil {
+		return "", "", nil, err
+	}
+	property := func(storage int, tag string) string {
+		if data, found := doc.stream(storage, "__substg1.0_"+tag+"001F"); found {
+			return decodeUTF16LE(data)
+		}
+		if data, found := doc.stream(storage, "__substg1.0_"+tag+"001E"); found {
+			return strings.TrimRight(string(data), "\x00")
+		}
+		return ""
+	}
+	text := property(0, "0037") + "\n\n" + property(0, "1000")
+	html, _ := doc.stream(0, "__substg1.0_10130102")
+	var attachments []msgAttachment
+	for _, id := range doc.children(0) {
+		entry := doc.entries[id]
+		if entry.kind != cfbTypeStorage || !strings.HasPrefix(entry.name, "__attach_version1.0_") {
+			continue
+		}
+		data, found := doc.stream(id, "__substg1.0_37010102")
+		if !found {
+			continue
+		}
+		name := property(id, "3707")
+		if name == "" {
+			name = property(id, "3704")
+		}
+		// The name comes from the sender, it must not point outside of the
+		// directory the attachment is extracted to.
+		name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+		if name == "." || name == ".." || name == "/" || strings.Trim(name, ". ") == "" {
+			name = "attachment"
+		}
+		attachments = append(attachments, msgAttachment{name: name, data: data})
+	}
+	return text, string(html), attachments, nil
+}
+
+// detectMsgLeak validates the body and every attachment of an Outlook
+// message. They are extracted to a temporary directory, the message itself
+// is left as it is.
+func detectMsgLeak(file, dbPath string) {
+	text, html, attachments, err := readMsg(file)
+	if err != nil {
+		color.Red("Couldn't read the Outlook message")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tempDir, err := ioutil.TempDir("", "wholeaked")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(tempDir)
+	parts := []msgAttachment{{name: "body.txt", data: []byte(text)}}
+	if html != "" {
+		parts = append(parts, msgAttachment{name: "body.html", data: []byte(html)})
+	}
+	for i, attachment := range attachments {
+		attachment.name = filepath.Join(strconv.Itoa(i), attachment.name)
+		parts = append(parts, attachment)
+	}
+	for i, part := range parts {
+		partPath := filepath.Join(tempDir, part.name)
+		os.MkdirAll(filepath.Dir(partPath), 0700)
+		if err := ioutil.WriteFile(partPath, part.data, 0600); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if i < len(parts)-len(attachments) {
+			fmt.Println("Checking the message body (" + filepath.Ext(part.name)[1:] + ")")
+		} else {
+			fmt.Println("Checking the attachment: " + filepath.Base(part.name))
+		}
+		detectLeak(partPath, dbPath)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+func utf16Bytes(s string) []byte {
+	var out []byte
+	for _, unit := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(unit), byte(unit>>8))
+	}
+	return out
+}
+
+func TestMsgAttachmentNames(t *testing.T) {
+	names := []string{"report.pdf", "..", `..\..`, "", "...", "../../etc/passwd"}
+	doc := &cfbFile{sectorSize: 512, entries: []*cfbEntry{
+		{name: "Root Entry", kind: cfbTypeRoot, left: cfbNoStream, right: cfbNoStream, child: cfbNoStream},
+	}}
+	var storages []int
+	for i, name := range names {
+		doc.entries = append(doc.entries, &cfbEntry{name: "__attach_version1.0_#0000000" + string(rune('0'+i)), kind: cfbTypeStorage,
+			left: cfbNoStream, right: cfbNoStream, child: cfbNoStream})
+		id := len(doc.entries) - 1
+		storages = append(storages, id)
+		doc.setStream(id, "__substg1.0_37010102", []byte("data"))
+		doc.setStream(id, "__substg1.0_3707001F", utf16Bytes(name))
+	}
+	doc.linkChildren(0, storages)
+	file := filepath.Join(t.TempDir(), "message.msg")
+	if err := writeCFB(doc, file); err != nil {
+		t.Fatal(err)
+	}
+	_, _, attachments, err := readMsg(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != len(names) {
+		t.Fatalf("got %d attachments", len(attachments))
+	}
+	want := map[string]bool{"report.pdf": true, "attachment": true, "passwd": true}
+	for _, attachment := range attachments {
+		if !want[attachment.name] {
+			t.Errorf("unsafe attachment name %q", attachment.name)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"hash/crc32"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const signaturePrefix = "75746b7573656e-"
+
+// Channels that can only carry a few bits at a time split the 16 byte UUID of a
+// signature into chunks. Every chunk holds the byte, its position and a check
+// nibble, so a chunk can be decoded on its own and an excerpt of the file is
+// enough to recover the bytes it contains.
+const (
+	payloadSize      = 16
+	payloadChunkBits = 16
+	minPayloadMatch  = 4
+)
+
+func signatureBytes(signature string) []byte {
+	id, err := uuid.Parse(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil {
+		return nil
+	}
+	return id[:]
+}
+
+func payloadCheck(index int, value byte) uint16 {
+	return uint16(crc32.ChecksumIEEE([]byte{byte(index), value}) & 0xF)
+}
+
+func payloadChunk(index int, value byte) uint16 {
+	return uint16(index&0xF)<<12 | uint16(value)<<4 | payloadCheck(index, value)
+}
+
+func parsePayloadChunk(chunk uint16) (int, byte, bool) {
+	index := int(chunk >> 12)
+	value := byte(chunk >> 4)
+	return index, value, payloadCheck(index, value) == chunk&0xF
+}
+
+type payloadVotes map[int]map[byte]int
+
+func (v payloadVotes) add(index int, value byte) {
+	if v[index] == nil {
+		v[index] = make(map[byte]int)
+	}
+	v[index][value]++
+}
+
+// matches reports whether the recovered bytes agree with the signature. Every
+// position that was recovered has to match and at least minPayloadMatch
+// positions must be present.
+func (v payloadVotes) matches(signature string) bool {
+	payload := signatureBytes(signature)
+	if payload == nil || len(v) < minPayloadMatch {
+		return false
+	}
+	for index, counts := range v {
+		var best byte
+		bestCount := 0
+		for value, count := range counts {
+			if count > bestCount || (count == bestCount && value < best) {
+				best, bestCount = value, count
+			}
+		}
+		if index >= len(payload) || payload[index] != best {
+			return false
+		}
+	}
+	return true
+}
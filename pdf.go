@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// writePDFContext writes the modified document next to the original first, so
+// that the file is never left half written.
+func writePDFContext(ctx *pdfcpu.Context, file string) error {
+	tempFile := file + ".tmp"
+	if err := api.WriteContextFile(ctx, tempFile); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return os.Rename(tempFile, file)
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"math/cmplx"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// Screenshots and photos of a page keep nothing but the pixels. The dot
+// pattern is a grid of faint yellow dots over every page, like the tracking
+// dots of color printers. The grid is made of tiles that all hold the first
+// bytes of the signature and Reed-Solomon parity bytes, so the recipient can
+// be read from a screenshot of a part of a page. The dots are drawn with the
+// Multiply blend mode, so they disappear under text and images and only show
+// on the paper. They are far enough apart to keep their color in compressed
+// JPEG screenshots, and photos can be turned by a few degrees.
+//
+// The first column of a tile has a dot in every row and the first row has
+// dots in the cells of dotSyncRow, which tells where the tiles start and
+// which side is up: turned upside down, the full column would still be a
+// full column, but no shift of the first row read backwards matches more
+// than 10 of its 16 cells. The other cells hold the bits of the bytes, row by
+// row.
+const (
+	dotPitch       = 9.0
+	dotSize        = 2.4
+	dotColumns     = 16
+	dotRows        = 8
+	dotIDBytes     = 6
+	dotParityBytes = 7
+	dotColor       = "1 1 0.7"
+	dotMinPixels   = 3.0
+	dotMaxAngle    = 5 * math.Pi / 180
+	dotAngleStep   = 0.25 * math.Pi / 180
+	dotMinSync     = 0.3
+	dotMinContrast = 12.0
+)
+
+var dotSyncRow = [dotColumns]bool{0: true, 1: true, 2: true, 3: true, 5: true, 11: true, 12: true}
+
+// addDotPatternSignature covers the pages of a PDF file with the dot pattern
+// of the recipient.
+func addDotPatternSignature(file, signature string) {
+	if err := addDotPattern(file, signature); err != nil {
+		color.Red("Error occurred while adding the dot pattern to the PDF file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func addDotPattern(file, signature string) error {
+	ctx, err := readPDFContext(file)
+	if err != nil {
+		return err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+	var cells strings.Builder
+	cells.WriteString(dotColor + " rg\n")
+	for row, bits := range dotTile(signature) {
+		for column, dot := range bits {
+			if !dot {
+				continue
+			}
+			// Rows are counted from the top of the tile.
+			x := (float64(column)+0.5)*dotPitch - dotSize/2
+			y := (float64(dotRows-row)-0.5)*dotPitch - dotSize/2
+			cells.WriteString(fmt.Sprintf("%s %s %s %s re\n", pdfNumberText(x), pdfNumberText(y), pdfNumberText(dotSize), pdfNumberText(dotSize)))
+		}
+	}
+	cells.WriteString("f\n")
+	sd, err := ctx.NewStreamDictForBuf([]byte(cells.String()))
+	if err != nil {
+		return err
+	}
+	width, height := dotColumns*dotPitch, dotRows*dotPitch
+	sd.Dict["Type"] = pdfcpu.Name("Pattern")
+	sd.Dict["PatternType"] = pdfcpu.Integer(1)
+	sd.Dict["PaintType"] = pdfcpu.Integer(1)
+	sd.Dict["TilingType"] = pdfcpu.Integer(1)
+	sd.Dict["BBox"] = pdfcpu.Array{pdfcpu.Integer(0), pdfcpu.Integer(0), pdfcpu.Float(width), pdfcpu.Float(height)}
+	sd.Dict["XStep"] = pdfcpu.Float(width)
+	sd.Dict["YStep"] = pdfcpu.Float(height)
+	sd.Dict["Resources"] = pdfcpu.Dict{}
+	if err := sd.Encode(); err != nil {
+		return err
+	}
+	pattern, err := ctx.IndRefForNewObject(*sd)
+	if err != nil {
+		return err
+	}
+	state, err := ctx.IndRefForNewObject(pdfcpu.Dict{
+		"Type": pdfcpu.Name("ExtGState"),
+		"BM":   pdfcpu.Name("Multiply"),
+	})
+	if err != nil {
+		return err
+	}
+	pages := make([]pdfcpu.Dict, ctx.PageCount+1)
+	attributes := make([]*pdfcpu.InheritedPageAttrs, ctx.PageCount+1)
+	used := make(map[string]bool)
+	for page := 1; page <= ctx.PageCount; page++ {
+		d, _, attrs, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		pages[page], attributes[page] = d, attrs
+		for _, category := range []string{"Pattern", "ExtGState"} {
+			if d, err := ctx.DereferenceDict(attrs.Resources[category]); err == nil {
+				for name := range d {
+					used[name] = true
+				}
+			}
+		}
+	}
+	patternName, stateName := unusedPDFName(used, "P"), unusedPDFName(used, "GS")
+	patched := make(map[int]bool)
+	for page := 1; page <= ctx.PageCount; page++ {
+		copied := pdfcpu.Dict{}
+		for key, value := range attributes[page].Resources {
+			copied[key] = value
+		}
+		if err := addPDFResource(ctx, copied, "Pattern", patternName, *pattern); err != nil {
+			return err
+		}
+		if err := addPDFResource(ctx, copied, "ExtGState", stateName, *state); err != nil {
+			return err
+		}
+		pages[page]["Resources"] = copied
+		box := attributes[page].MediaBox
+		if box == nil {
+			box = pdfcpu.RectForFormat("Letter")
+		}
+		dots := fmt.Sprintf(" Q\nq\n/%s gs\n/Pattern cs\n/%s scn\n%s %s %s %s re\nf\nQ\n", stateName, patternName,
+			pdfNumberText(box.LL.X), pdfNumberText(box.LL.Y), pdfNumberText(box.Width()), pdfNumberText(box.Height()))
+		if err := addPDFLayerContent(ctx, pages[page], dots, patched); err != nil {
+			return err
+		}
+	}
+	return writePDFContext(ctx, file)
+}
+
+// dotCodeword returns the ID bytes of a signature followed by their parity
+// bytes.
+func dotCodeword(signature string) []byte {
+	id := signatureBytes(signature)
+	if id == nil {
+		return nil
+	}
+	return reedSolomonEncode(id[:dotIDBytes], dotParityBytes)
+}
+
+// dotTile returns the cells of the tile of a recipient that have a dot.
+func dotTile(signature string) [][]bool {
+	tile := make([][]bool, dotRows)
+	for row := range tile {
+		tile[row] = make([]bool, dotColumns)
+		tile[row][0] = true
+	}
+	copy(tile[0], dotSyncRow[:])
+	codeword := dotCodeword(signature)
+	for i := 0; i < len(codeword)*8; i++ {
+		row, column := dotDataCell(i)
+		tile[row][column] = codeword[i/8]>>(7-i%8)&1 == 1
+	}
+	return tile
+}
+
+// dotDataCell returns the cell of the i-th bit of the codeword.
+func dotDataCell(i int) (int, int) {
+	return 1 + i/(dotColumns-1), 1 + i%(dotColumns-1)
+}
+
+// dotReading is what was read from the dot pattern of a screenshot: the
+// bytes of the codeword, which of them were seen at all and the number of
+// tiles they were read from.
+type dotReading struct {
+	codeword []byte
+	known    []bool
+	tiles    int
+}
+
+// matches reports whether the reading is the codeword of the recipient with
+// no more wrong and missing bytes than the parity bytes can correct.
+func (r *dotReading) matches(signature string) bool {
+	codeword := dotCodeword(signature)
+	if r == nil || codeword == nil {
+		return false
+	}
+	errors, erasures := 0, 0
+	for i := range codeword {
+		if !r.known[i] {
+			erasures++
+		} else if r.codeword[i] != codeword[i] {
+			errors++
+		}
+	}
+	return 2*errors+erasures <= dotParityBytes && erasures < len(codeword)-dotIDBytes
+}
+
+// readDotPattern finds the dot grid in a picture of a page and reads the
+// tiles in it.
+func readDotPattern(file string) *dotReading {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	// Yellow dots take away blue and leave red and green. Text and gray
+	// areas don't, however dark they are.
+	yellow := make([]float64, width*height)
+	light := make([]float64, width*height)
+	var points []dotPoint
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			l := math.Min(float64(r), float64(g)) / 257
+			value := math.Max(l-float64(bl)/257-4, 0)
+			yellow[y*width+x], light[y*width+x] = value, l
+			if value > 0 {
+				points = append(points, dotPoint{float64(x), float64(y), value})
+			}
+		}
+	}
+	grid := findDotGrid(points)
+	if grid == nil {
+		return nil
+	}
+	values := sampleDots(yellow, light, width, height, grid)
+	if values == nil {
+		return nil
+	}
+	// The picture can be turned any number of quarter turns, the one where
+	// the tiles are the most clearly in sync is upright.
+	var best *dotReading
+	bestSync := dotMinSync
+	for turn := 0; turn < 4; turn++ {
+		if reading, sync := readDotTiles(values); reading != nil && sync > bestSync {
+			best, bestSync = reading, sync
+		}
+		values = rotateDots(values)
+	}
+	return best
+}
+
+// dotPoint is a yellow pixel of a picture.
+type dotPoint struct {
+	x, y, value float64
+}
+
+// dotGrid is where the dots are in a picture. Photos are seldom straight, so
+// the grid is placed along two axes turned by an angle: u to the right and v
+// down.
+type dotGrid struct {
+	cos, sin        float64
+	uOrigin, uPitch float64
+	vOrigin, vPitch float64
+	uEnd, vEnd      float64
+}
+
+// at returns the pixel of the dot in the k-th column and j-th row.
+func (g *dotGrid) at(k, j float64) (float64, float64) {
+	u, v := g.uOrigin+k*g.uPitch, g.vOrigin+j*g.vPitch
+	return u*g.cos - v*g.sin, u*g.sin + v*g.cos
+}
+
+// dotProfiles sums the yellow pixels along the axes turned by an angle and
+// returns the sums and where they start.
+func dotProfiles(points []dotPoint, angle float64) ([2][]float64, [2]float64) {
+	cos, sin := math.Cos(angle), math.Sin(angle)
+	var start, end [2]float64
+	for i := range start {
+		start[i], end[i] = math.Inf(1), math.Inf(-1)
+	}
+	for _, p := range points {
+		u, v := p.x*cos+p.y*sin, -p.x*sin+p.y*cos
+		start[0], end[0] = math.Min(start[0], u), math.Max(end[0], u)
+		start[1], end[1] = math.Min(start[1], v), math.Max(end[1], v)
+	}
+	var profiles [2][]float64
+	for i := range profiles {
+		start[i] = math.Floor(start[i])
+		profiles[i] = make([]float64, int(end[i]-start[i])+1)
+	}
+	for _, p := range points {
+		u, v := p.x*cos+p.y*sin, -p.x*sin+p.y*cos
+		profiles[0][int(u-start[0])] += p.value
+		profiles[1][int(v-start[1])] += p.value
+	}
+	return profiles, start
+}
+
+// dotPeriodicity tells how periodic a profile is: the largest share of it at
+// a frequency of the dots.
+func dotPeriodicity(profile []float64) float64 {
+	n := 1
+	for n < len(profile) {
+		n <<= 1
+	}
+	spectrum := make([]complex128, n)
+	total := 0.0
+	for i, value := range profile {
+		spectrum[i] = complex(value, 0)
+		total += value
+	}
+	if total == 0 {
+		return 0
+	}
+	fft(spectrum, false)
+	best := 0.0
+	for k := 1; k < n/2; k++ {
+		if period := float64(n) / float64(k); period >= dotMinPixels && period <= float64(len(profile))/4 {
+			best = math.Max(best, cmplx.Abs(spectrum[k])/total)
+		}
+	}
+	return best
+}
+
+// findDotGrid finds the angle at which the profiles of the yellow pixels are
+// the most periodic, first roughly and then finely, and the dots along it.
+func findDotGrid(points []dotPoint) *dotGrid {
+	if len(points) == 0 {
+		return nil
+	}
+	angle, best := 0.0, -1.0
+	for a := -dotMaxAngle; a <= dotMaxAngle+dotAngleStep/2; a += dotAngleStep {
+		profiles, _ := dotProfiles(points, a)
+		if score := dotPeriodicity(profiles[0]) + dotPeriodicity(profiles[1]); score > best {
+			angle, best = a, score
+		}
+	}
+	// The spectrum is too coarse for the last bit of the angle, which is
+	// found at the distances between the dots.
+	profiles, _ := dotProfiles(points, angle)
+	uPitch, _ := dotPeriod(profiles[0])
+	vPitch, _ := dotPeriod(profiles[1])
+	if uPitch == 0 || vPitch == 0 {
+		return nil
+	}
+	coarse, best := angle, -1.0
+	for a := coarse - dotAngleStep; a <= coarse+dotAngleStep; a += dotAngleStep / 10 {
+		profiles, _ := dotProfiles(points, a)
+		uCoherence, _ := dotCoherence(profiles[0], uPitch)
+		vCoherence, _ := dotCoherence(profiles[1], vPitch)
+		if uCoherence+vCoherence > best {
+			angle, best = a, uCoherence+vCoherence
+		}
+	}
+	profiles, start := dotProfiles(points, angle)
+	_, uOffset := dotCoherence(profiles[0], uPitch)
+	_, vOffset := dotCoherence(profiles[1], vPitch)
+	return &dotGrid{
+		cos: math.Cos(angle), sin: math.Sin(angle),
+		uOrigin: start[0] + uOffset, uPitch: uPitch, uEnd: start[0] + float64(len(profiles[0])),
+		vOrigin: start[1] + vOffset, vPitch: vPitch, vEnd: start[1] + float64(len(profiles[1])),
+	}
+}
+
+// dotPeriod returns the distance between the dots along a profile of the
+// image and the position of the first dot. The distance is the period at
+// which the profile is most concentrated. Half the distance is less
+// concentrated because the dots are wide, and multiples of it aren't
+// concentrated because the dots of every other column are in between.
+func dotPeriod(profile []float64) (float64, float64) {
+	n := float64(len(profile))
+	total := 0.0
+	for _, value := range profile {
+		total += value
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	bestPeriod, bestCoherence := 0.0, 0.0
+	for period := dotMinPixels; period <= n/4; period *= 1 + period/(8*n) {
+		if coherence, _ := dotCoherence(profile, period); coherence > bestCoherence {
+			bestPeriod, bestCoherence = period, coherence
+		}
+	}
+	_, offset := dotCoherence(profile, bestPeriod)
+	return bestPeriod, offset
+}
+
+// dotCoherence returns the share of a profile at a period and the position
+// of its first peak.
+func dotCoherence(profile []float64, period float64) (float64, float64) {
+	var sum complex128
+	total := 0.0
+	for x, value := range profile {
+		if value != 0 {
+			sum += complex(value, 0) * cmplx.Rect(1, -2*math.Pi*float64(x)/period)
+			total += value
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return cmplx.Abs(sum) / total, math.Mod(-cmplx.Phase(sum)/(2*math.Pi)*period+period, period)
+}
+
+// sampleDots reads how yellow the grid is point by point. It's NaN where the
+// paper is covered or the grid can't be seen.
+func sampleDots(yellow, light []float64, width, height int, grid *dotGrid) [][]float64 {
+	radius := int(math.Max(1, math.Min(grid.uPitch, grid.vPitch)/5))
+	window := func(values []float64, cx, cy float64, pick func(a, b float64) float64) float64 {
+		x0, y0 := int(math.Round(cx)), int(math.Round(cy))
+		result := math.NaN()
+		for y := y0 - radius; y <= y0+radius; y++ {
+			for x := x0 - radius; x <= x0+radius; x++ {
+				if x < 0 || y < 0 || x >= width || y >= height {
+					return math.NaN()
+				}
+				if math.IsNaN(result) {
+					result = values[y*width+x]
+				} else {
+					result = pick(result, values[y*width+x])
+				}
+			}
+		}
+		return result
+	}
+	var values, gaps [][]float64
+	var readable []float64
+	for j := 0.0; grid.vOrigin+j*grid.vPitch < grid.vEnd; j++ {
+		var line, gapLine []float64
+		for k := 0.0; grid.uOrigin+k*grid.uPitch < grid.uEnd; k++ {
+			cx, cy := grid.at(k, j)
+			gx, gy := grid.at(k+0.5, j+0.5)
+			value := window(yellow, cx, cy, math.Max)
+			paper := window(light, cx, cy, math.Min)
+			gap := window(yellow, gx, gy, math.Max)
+			if math.IsNaN(value) || math.IsNaN(gap) || paper < 160 {
+				value = math.NaN()
+			} else {
+				readable = append(readable, value)
+			}
+			line = append(line, value)
+			gapLine = append(gapLine, gap)
+		}
+		values = append(values, line)
+		gaps = append(gaps, gapLine)
+	}
+	if len(readable) < dotRows*dotColumns {
+		return nil
+	}
+	low, high, ok := splitDots(readable)
+	if !ok || high-low < dotMinContrast {
+		return nil
+	}
+	// The values are scaled so that paper is 0 and a dot is 1. Yellow between
+	// the dots is part of a picture.
+	for j, line := range values {
+		for k, value := range line {
+			if gaps[j][k] > (low+high)/2 {
+				value = math.NaN()
+			}
+			line[k] = (value - low) / (high - low)
+		}
+	}
+	return values
+}
+
+// splitDots splits the values into two groups with two means and returns the
+// means.
+func splitDots(values []float64) (float64, float64, bool) {
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, value := range values {
+		low, high = math.Min(low, value), math.Max(high, value)
+	}
+	for i := 0; i < 20; i++ {
+		threshold := (low + high) / 2
+		var sums [2]float64
+		var counts [2]int
+		for _, value := range values {
+			k := 0
+			if value > threshold {
+				k = 1
+			}
+			sums[k] += value
+			counts[k]++
+		}
+		if counts[0] == 0 || counts[1] == 0 {
+			return 0, 0, false
+		}
+		low, high = sums[0]/float64(counts[0]), sums[1]/float64(counts[1])
+	}
+	return low, high, true
+}
+
+// rotateDots turns the grid a quarter turn clockwise.
+func rotateDots(grid [][]float64) [][]float64 {
+	rotated := make([][]float64, len(grid[0]))
+	for k := range rotated {
+		rotated[k] = make([]float64, len(grid))
+		for j := range grid {
+			rotated[k][len(grid)-1-j] = grid[j][k]
+		}
+	}
+	return rotated
+}
+
+// readDotTiles finds where the tiles start from the first column, which is
+// full of dots, and the first row, which has the dots of dotSyncRow. Then every bit is decided by its mean over the tiles it
+// was seen in. It also returns how clearly the tiles were found.
+func readDotTiles(grid [][]float64) (*dotReading, float64) {
+	bestColumn, bestRow, bestScore := 0, 0, 0.0
+	for column := 0; column < dotColumns; column++ {
+		for row := 0; row < dotRows; row++ {
+			var sums, counts [3]float64
+			for j, line := range grid {
+				for k, value := range line {
+					if math.IsNaN(value) {
+						continue
+					}
+					// 0 is the full column, 1 the dots of the first row
+					// and 2 its empty cells.
+					part := -1
+					switch offset := (k - column + dotColumns) % dotColumns; {
+					case offset == 0:
+						part = 0
+					case (j-row+dotRows)%dotRows != 0:
+					case dotSyncRow[offset]:
+						part = 1
+					default:
+						part = 2
+					}
+					if part >= 0 {
+						sums[part] += value
+						counts[part]++
+					}
+				}
+			}
+			if counts[0] == 0 || counts[1] == 0 || counts[2] == 0 {
+				continue
+			}
+			score := (sums[0]/counts[0]+sums[1]/counts[1])/2 - sums[2]/counts[2]
+			if score > bestScore {
+				bestColumn, bestRow, bestScore = column, row, score
+			}
+		}
+	}
+	if bestScore < dotMinSync {
+		return nil, 0
+	}
+	size := dotIDBytes + dotParityBytes
+	sums := make([]float64, size*8)
+	seen := make([]int, size*8)
+	tiles := make(map[[2]int]bool)
+	for j, line := range grid {
+		for k, value := range line {
+			row, column := (j-bestRow+dotRows)%dotRows, (k-bestColumn+dotColumns)%dotColumns
+			if math.IsNaN(value) || row == 0 || column == 0 {
+				continue
+			}
+			i := (row-1)*(dotColumns-1) + column - 1
+			if i >= size*8 {
+				continue
+			}
+			seen[i]++
+			sums[i] += value
+			tiles[[2]int{(j - bestRow + dotRows) / dotRows, (k - bestColumn + dotColumns) / dotColumns}] = true
+		}
+	}
+	var means []float64
+	for i := range sums {
+		if seen[i] > 0 {
+			sums[i] /= float64(seen[i])
+			means = append(means, sums[i])
+		}
+	}
+	// The means of the bits that are 0 are all close to 0, while those of
+	// the bits that are 1 depend on the neighbours of the dots. They are split
+	// at the widest gap between them.
+	sort.Float64s(means)
+	threshold, gap := 0.5, 0.0
+	for i := 1; i < len(means); i++ {
+		if means[i]-means[i-1] > gap {
+			threshold, gap = (means[i]+means[i-1])/2, means[i]-means[i-1]
+		}
+	}
+	reading := &dotReading{codeword: make([]byte, size), known: make([]bool, size), tiles: len(tiles)}
+	for i := range reading.known {
+		reading.known[i] = true
+	}
+	for i := range seen {
+		if seen[i] == 0 {
+			reading.known[i/8] = false
+		} else if sums[i] > threshold {
+			reading.codeword[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return reading, bestScore
+}
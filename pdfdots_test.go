@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// writeTestPDF writes a PDF file with a page of Helvetica text for every
+// entry of pages.
+func writeTestPDF(t *testing.T, file string, pages [][]string) {
+	t.Helper()
+	objects := []string{"<< /Type /Catalog /Pages 2 0 R >>", "", "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>"}
+	var kids []string
+	for _, lines := range pages {
+		var content strings.Builder
+		content.WriteString("BT /F1 11 Tf\n")
+		for i, line := range lines {
+			fmt.Fprintf(&content, "1 0 0 1 72 %d Tm (%s) Tj\n", 760-17*i, line)
+		}
+		content.WriteString("ET")
+		kids = append(kids, fmt.Sprintf("%d 0 R", len(objects)+1))
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", len(objects)+2),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+	out := "%PDF-1.4\n"
+	var offsets []int
+	for i, object := range objects {
+		offsets = append(offsets, len(out))
+		out += fmt.Sprintf("%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := len(out)
+	out += fmt.Sprintf("xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		out += fmt.Sprintf("%010d 00000 n \n", offset)
+	}
+	out += fmt.Sprintf("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	if err := ioutil.WriteFile(file, []byte(out), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pdfDotTile reads the cells of the dot pattern back from the rectangles of
+// the tiling pattern of a PDF file, rows counted from the top.
+func pdfDotTile(t *testing.T, file string) [][]bool {
+	t.Helper()
+	ctx, err := readPDFContext(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range ctx.XRefTable.Table {
+		sd, ok := entry.Object.(pdfcpu.StreamDict)
+		if !ok || sd.Dict["PatternType"] == nil || sd.Decode() != nil {
+			continue
+		}
+		tile := make([][]bool, dotRows)
+		for row := range tile {
+			tile[row] = make([]bool, dotColumns)
+		}
+		fields := strings.Fields(string(sd.Content))
+		for i, field := range fields {
+			if field != "re" || i < 4 {
+				continue
+			}
+			x, _ := strconv.ParseFloat(fields[i-4], 64)
+			y, _ := strconv.ParseFloat(fields[i-3], 64)
+			column := int((x + dotSize/2) / dotPitch)
+			row := dotRows - 1 - int((y+dotSize/2)/dotPitch)
+			tile[row][column] = true
+		}
+		return tile
+	}
+	t.Fatal("no dot pattern in the PDF file")
+	return nil
+}
+
+// renderDotPage rasterises a part of a page with the dot pattern like a
+// screenshot would, at scale pixels per point and turned
+// by angle. A dark block stands for the text of the page.
+func renderDotPage(tile [][]bool, width, height int, scale, angle float64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	cos, sin := math.Cos(angle), math.Sin(angle)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// The point of the page under the pixel, measured from the top
+			// left corner of a tile.
+			px, py := float64(x)-float64(width)/2, float64(y)-float64(height)/2
+			u := (px*cos+py*sin)/scale + 1000*dotColumns*dotPitch
+			v := (-px*sin+py*cos)/scale + 1000*dotRows*dotPitch
+			column := int(u/dotPitch) % dotColumns
+			row := int(v/dotPitch) % dotRows
+			cu := math.Mod(u, dotPitch) - dotPitch/2
+			cv := math.Mod(v, dotPitch) - dotPitch/2
+			c := color.RGBA{255, 255, 255, 255}
+			if tile[row][column] && math.Abs(cu) <= dotSize/2 && math.Abs(cv) <= dotSize/2 {
+				c = color.RGBA{255, 255, 178, 255}
+			}
+			if x > width/5 && x < width/3 && y > height/4 && y < height/2 {
+				c = color.RGBA{30, 30, 30, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// turnImage turns an image a quarter turn clockwise.
+func turnImage(img *image.RGBA) *image.RGBA {
+	b := img.Bounds()
+	turned := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			turned.Set(b.Dy()-1-y, x, img.At(x, y))
+		}
+	}
+	return turned
+}
+
+func readDotImage(t *testing.T, img image.Image) *dotReading {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "screenshot.png")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return readDotPattern(file)
+}
+
+func TestDotPatternRead(t *testing.T) {
+	other := "75746b7573656e-220a09c3-9f0a-4bdf-b552-1a38b530103e"
+	file := filepath.Join(t.TempDir(), "page.pdf")
+	writeTestPDF(t, file, [][]string{{"A page of text."}})
+	if err := addDotPattern(file, testSignature); err != nil {
+		t.Fatal(err)
+	}
+	tile := pdfDotTile(t, file)
+	if !reflect.DeepEqual(tile, dotTile(testSignature)) {
+		t.Fatal("the dots of the PDF file aren't the tile of the recipient")
+	}
+	for _, angle := range []float64{0, 3} {
+		img := renderDotPage(tile, 520, 380, 2, angle*math.Pi/180)
+		for turn := 0; turn < 4; turn++ {
+			reading := readDotImage(t, img)
+			if !reading.matches(testSignature) {
+				t.Errorf("turned by %g degrees and %d quarter turns: signature not read", angle, turn)
+			}
+			if reading.matches(other) {
+				t.Errorf("turned by %g degrees and %d quarter turns: another signature matched", angle, turn)
+			}
+			img = turnImage(img)
+		}
+	}
+}
+
+func TestDotTileIsNotSymmetric(t *testing.T) {
+	tile := dotTile(testSignature)
+	upright := make([][]float64, 2*dotRows)
+	turned := make([][]float64, 2*dotRows)
+	for j := range upright {
+		upright[j] = make([]float64, 2*dotColumns)
+		turned[j] = make([]float64, 2*dotColumns)
+		for k := range upright[j] {
+			if tile[j%dotRows][k%dotColumns] {
+				upright[j][k] = 1
+			}
+			if tile[dotRows-1-j%dotRows][dotColumns-1-k%dotColumns] {
+				turned[j][k] = 1
+			}
+		}
+	}
+	_, uprightSync := readDotTiles(upright)
+	_, turnedSync := readDotTiles(turned)
+	if uprightSync < 1 || turnedSync >= uprightSync {
+		t.Errorf("upright tiles are in sync by %.2f, upside down by %.2f", uprightSync, turnedSync)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// fontUnicode maps the character codes of a PDF font to the text they stand
+// for. codeLength is the number of bytes of a character code.
+type fontUnicode struct {
+	codeLength int
+	text       map[int]string
+}
+
+var glyphNames = map[string]string{
+	"space": " ", "exclam": "!", "quotedbl": "\"", "numbersign": "#", "dollar": "$", "percent": "%",
+	"ampersand": "&", "quotesingle": "'", "quoteright": "’", "quoteleft": "‘", "parenleft": "(",
+	"parenright": ")", "asterisk": "*", "plus": "+", "comma": ",", "hyphen": "-", "period": ".",
+	"slash": "/", "zero": "0", "one": "1", "two": "2", "three": "3", "four": "4", "five": "5",
+	"six": "6", "seven": "7", "eight": "8", "nine": "9", "colon": ":", "semicolon": ";", "less": "<",
+	"equal": "=", "greater": ">", "question": "?", "at": "@", "bracketleft": "[", "backslash": "\\",
+	"bracketright": "]", "asciicircum": "^", "underscore": "_", "grave": "`", "braceleft": "{",
+	"bar": "|", "braceright": "}", "asciitilde": "~", "endash": "–", "emdash": "—",
+	"bullet": "•", "quotedblleft": "“", "quotedblright": "”", "ellipsis": "…",
+	"fi": "fi", "fl": "fl", "ff": "ff", "ffi": "ffi", "ffl": "ffl",
+}
+
+func glyphNameText(name string) (string, bool) {
+	if text, ok := glyphNames[name]; ok {
+		return text, true
+	}
+	if len(name) == 1 {
+		return name, true
+	}
+	for _, prefix := range []string{"uni", "u"} {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		value, err := strconv.ParseUint(name[len(prefix):], 16, 32)
+		if err == nil && len(name)-len(prefix) >= 4 {
+			return string(rune(value)), true
+		}
+	}
+	return "", false
+}
+
+// readFontUnicode returns the text mapping of a font. The ToUnicode CMap is
+// used when present, otherwise the mapping is built from the encoding of
+// simple fonts. ok is false for fonts whose text can't be known.
+func readFontUnicode(ctx *pdfcpu.Context, font pdfcpu.Dict) (fontUnicode, bool) {
+	if obj, found := font.Find("ToUnicode"); found {
+		sd, _, err := ctx.DereferenceStreamDict(obj)
+		if err == nil && sd != nil && sd.Decode() == nil {
+			if mapping := parseToUnicode(sd.Content); len(mapping.text) > 0 {
+				return mapping, true
+			}
+		}
+	}
+	subtype := font.Subtype()
+	if subtype == nil || (*subtype != "Type1" && *subtype != "TrueType" && *subtype != "MMType1") {
+		return fontUnicode{}, false
+	}
+	mapping := fontUnicode{codeLength: 1, text: make(map[int]string)}
+	baseEncoding := "StandardEncoding"
+	var differences pdfcpu.Array
+	encoding, _ := ctx.Dereference(font["Encoding"])
+	switch encoding := encoding.(type) {
+	case pdfcpu.Name:
+		baseEncoding = string(encoding)
+	case pdfcpu.Dict:
+		if name := encoding.NameEntry("BaseEncoding"); name != nil {
+			baseEncoding = *name
+		}
+		differences, _ = ctx.DereferenceArray(encoding["Differences"])
+	case nil:
+		if isSymbolicFont(ctx, font) {
+			return fontUnicode{}, false
+		}
+	}
+	for code := 0x20; code < 0x100; code++ {
+		var r rune
+		switch baseEncoding {
+		case "MacRomanEncoding":
+			r = charmap.Macintosh.DecodeByte(byte(code))
+		case "WinAnsiEncoding":
+			r = charmap.Windows1252.DecodeByte(byte(code))
+		default:
+			if code >= 0x7F {
+				continue
+			}
+			r = rune(code)
+			switch code {
+			case 0x27:
+				r = '\u2019'
+			case 0x60:
+				r = '\u2018'
+			}
+		}
+		if r != utf8.RuneError && r != 0x7F {
+			mapping.text[code] = string(r)
+		}
+	}
+	code := 0
+	for _, obj := range differences {
+		switch obj := obj.(type) {
+		case pdfcpu.Integer:
+			code = obj.Value()
+		case pdfcpu.Name:
+			if text, ok := glyphNameText(string(obj)); ok {
+				mapping.text[code] = text
+			} else {
+				delete(mapping.text, code)
+			}
+			code++
+		}
+	}
+	return mapping, true
+}
+
+func isSymbolicFont(ctx *pdfcpu.Context, font pdfcpu.Dict) bool {
+	descriptor, err := ctx.DereferenceDict(font["FontDescriptor"])
+	if err != nil || descriptor == nil {
+		return false
+	}
+	flags := descriptor.IntEntry("Flags")
+	return flags != nil && *flags&4 != 0
+}
+
+func parseToUnicode(content []byte) fontUnicode {
+	mapping := fontUnicode{codeLength: 1, text: make(map[int]string)}
+	tokens := cmapTokens(content)
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "begincodespacerange":
+			if i+1 < len(tokens) && strings.HasPrefix(tokens[i+1], "<") {
+				mapping.codeLength = (len(tokens[i+1]) - 2 + 1) / 2
+			}
+		case "beginbfchar":
+			for i++; i+1 < len(tokens) && tokens[i] != "endbfchar"; i += 2 {
+				code, ok := cmapCode(tokens[i])
+				if ok {
+					mapping.text[code] = cmapText(tokens[i+1])
+				}
+			}
+		case "beginbfrange":
+			for i++; i+2 < len(tokens) && tokens[i] != "endbfrange"; i += 3 {
+				low, okLow := cmapCode(tokens[i])
+				high, okHigh := cmapCode(tokens[i+1])
+				if tokens[i+2] == "[" {
+					j := i + 3
+					for code := low; j < len(tokens) && tokens[j] != "]"; code, j = code+1, j+1 {
+						if okLow && okHigh && code <= high {
+							mapping.text[code] = cmapText(tokens[j])
+						}
+					}
+					i = j - 2
+					continue
+				}
+				if !okLow || !okHigh || high-low > 0xFFFF {
+					continue
+				}
+				start := []rune(cmapText(tokens[i+2]))
+				if len(start) == 0 {
+					continue
+				}
+				for code := low; code <= high; code++ {
+					text := append([]rune{}, start...)
+					text[len(text)-1] += rune(code - low)
+					mapping.text[code] = string(text)
+				}
+			}
+		}
+	}
+	return mapping
+}
+
+func cmapTokens(content []byte) []string {
+	var tokens []string
+	for i := 0; i < len(content); {
+		switch c := content[i]; {
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return tokens
+			}
+			tokens = append(tokens, string(content[i:i+end+1]))
+			i += end + 1
+		case c == '[' || c == ']':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case isPDFWhitespace(c):
+			i++
+		default:
+			start := i
+			for i < len(content) && !isPDFWhitespace(content[i]) && !strings.ContainsRune("<>[]%", rune(content[i])) {
+				i++
+			}
+			if i == start {
+				i++
+				continue
+			}
+			tokens = append(tokens, string(content[start:i]))
+		}
+	}
+	return tokens
+}
+
+func isPDFWhitespace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func cmapHex(token string) ([]byte, bool) {
+	if !strings.HasPrefix(token, "<") || !strings.HasSuffix(token, ">") {
+		return nil, false
+	}
+	digits := strings.Join(strings.Fields(token[1:len(token)-1]), "")
+	if len(digits)%2 == 1 {
+		digits += "0"
+	}
+	b, err := hex.DecodeString(digits)
+	return b, err == nil
+}
+
+func cmapCode(token string) (int, bool) {
+	b, ok := cmapHex(token)
+	if !ok || len(b) == 0 || len(b) > 4 {
+		return 0, false
+	}
+	code := 0
+	for _, c := range b {
+		code = code<<8 | int(c)
+	}
+	return code, true
+}
+
+func cmapText(token string) string {
+	b, ok := cmapHex(token)
+	if !ok {
+		return ""
+	}
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// toUnicodeCMap serializes a text mapping as a ToUnicode CMap stream.
+func toUnicodeCMap(mapping fontUnicode) []byte {
+	codes := make([]int, 0, len(mapping.text))
+	for code := range mapping.text {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	codeFormat := fmt.Sprintf("<%%0%dX>", mapping.codeLength*2)
+	var b bytes.Buffer
+	b.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n")
+	b.WriteString("/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n")
+	b.WriteString("/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n")
+	b.WriteString("1 begincodespacerange\n")
+	fmt.Fprintf(&b, codeFormat+" "+codeFormat+"\n", 0, 1<<(8*uint(mapping.codeLength))-1)
+	b.WriteString("endcodespacerange\n")
+	for len(codes) > 0 {
+		n := len(codes)
+		if n > 100 {
+			n = 100
+		}
+		fmt.Fprintf(&b, "%d beginbfchar\n", n)
+		for _, code := range codes[:n] {
+			fmt.Fprintf(&b, codeFormat+" <", code)
+			for _, unit := range utf16.Encode([]rune(mapping.text[code])) {
+				fmt.Fprintf(&b, "%04X", unit)
+			}
+			b.WriteString(">\n")
+		}
+		b.WriteString("endbfchar\n")
+		codes = codes[n:]
+	}
+	b.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+	return b.Bytes()
+}
+
+// pdfFonts returns every font dictionary of the document.
+func pdfFonts(ctx *pdfcpu.Context) []pdfcpu.Dict {
+	var fonts []pdfcpu.Dict
+	for _, entry := range ctx.Table {
+		if entry == nil || entry.Free {
+			continue
+		}
+		if d, ok := entry.Object.(pdfcpu.Dict); ok && d.Type() != nil && *d.Type() == "Font" {
+			fonts = append(fonts, d)
+		}
+	}
+	return fonts
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/fatih/color"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// The hidden layer and the attachment are independent of the text watermark.
+// The layer is an optional content group that is off when the document is
+// opened, with the words of the text watermark as invisible text on every
+// page, so text extractors that ignore the layers don't show the signature
+// itself. pdfcpu only removes the watermark layers it creates itself, so the
+// layer is left when the watermark is removed. The attachment holds a token
+// with the name and the e-mail address of the recipient. It's encrypted with a key derived from
+// the signature, so it can only be read with the project database.
+const (
+	pdfLayerName         = "Layer 1"
+	pdfTokenFileName     = "document.dat"
+	pdfChannelText       = "text"
+	pdfChannelLayer      = "hidden layer"
+	pdfChannelAttachment = "attachment"
+)
+
+var pdfWatermarkChannels = []string{pdfChannelText, pdfChannelLayer}
+
+// addHiddenPDFChannels adds the hidden layer with the watermarks and the
+// attachment with the metadata.
+func addHiddenPDFChannels(file, signature, name, email string, watermarkFlag, metadataFlag bool) {
+	err := addPDFLayerAndToken(file, signature, name, email, watermarkFlag, metadataFlag)
+	if err != nil {
+		color.Red("Error occurred while adding the hidden layer and the attachment to the PDF file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func addPDFLayerAndToken(file, signature, name, email string, layerFlag, tokenFlag bool) error {
+	ctx, err := readPDFContext(file)
+	if err != nil {
+		return err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+	if layerFlag {
+		if err := addPDFLayer(ctx, signature); err != nil {
+			return err
+		}
+	}
+	if tokenFlag {
+		token, err := sealPDFToken(signature, name+","+email)
+		if err != nil {
+			return err
+		}
+		attachment := pdfcpu.Attachment{Reader: bytes.NewReader(token), ID: pdfTokenFileName, FileName: pdfTokenFileName}
+		if err := ctx.AddAttachment(attachment, false); err != nil {
+			return err
+		}
+	}
+	return writePDFContext(ctx, file)
+}
+
+// addPDFLayer adds the optional content group after the existing ones, since
+// pdfcpu draws its watermarks in the first group of the document.
+func addPDFLayer(ctx *pdfcpu.Context, signature string) error {
+	group, err := ctx.IndRefForNewObject(pdfcpu.Dict{
+		"Type": pdfcpu.Name("OCG"),
+		"Name": pdfcpu.StringLiteral(pdfLayerName),
+	})
+	if err != nil {
+		return err
+	}
+	catalog, err := ctx.Catalog()
+	if err != nil {
+		return err
+	}
+	properties := pdfcpu.Dict{}
+	if d, err := ctx.DereferenceDict(catalog["OCProperties"]); err == nil && d != nil {
+		properties = d
+	}
+	groups, _ := ctx.DereferenceArray(properties["OCGs"])
+	properties["OCGs"] = append(groups, *group)
+	config, err := ctx.DereferenceDict(properties["D"])
+	if err != nil || config == nil {
+		config = pdfcpu.Dict{}
+	}
+	off, _ := ctx.DereferenceArray(config["OFF"])
+	config["OFF"] = append(off, *group)
+	properties["D"] = config
+	catalog["OCProperties"] = properties
+
+	font, err := ctx.IndRefForNewObject(pdfcpu.Dict{
+		"Type":     pdfcpu.Name("Font"),
+		"Subtype":  pdfcpu.Name("Type1"),
+		"BaseFont": pdfcpu.Name(stampFont),
+		"Encoding": pdfcpu.Name("WinAnsiEncoding"),
+	})
+	if err != nil {
+		return err
+	}
+	// The same names are used on every page, since pages may share their
+	// content streams.
+	pages := make([]pdfcpu.Dict, ctx.PageCount+1)
+	resources := make([]pdfcpu.Dict, ctx.PageCount+1)
+	used := make(map[string]bool)
+	for page := 1; page <= ctx.PageCount; page++ {
+		d, _, attrs, err := ctx.PageDict(page, false)
+		if err != nil {
+			return err
+		}
+		pages[page], resources[page] = d, attrs.Resources
+		for _, category := range []string{"Properties", "Font"} {
+			if d, err := ctx.DereferenceDict(attrs.Resources[category]); err == nil {
+				for name := range d {
+					used[name] = true
+				}
+			}
+		}
+	}
+	propertyName, fontName := unusedPDFName(used, "OC"), unusedPDFName(used, "F")
+	patched := make(map[int]bool)
+	for page := 1; page <= ctx.PageCount; page++ {
+		// The resources may be shared with other pages, they are copied
+		// before the names are added.
+		copied := pdfcpu.Dict{}
+		for key, value := range resources[page] {
+			copied[key] = value
+		}
+		if err := addPDFResource(ctx, copied, "Properties", propertyName, *group); err != nil {
+			return err
+		}
+		if err := addPDFResource(ctx, copied, "Font", fontName, *font); err != nil {
+			return err
+		}
+		pages[page]["Resources"] = copied
+		layer := fmt.Sprintf(" Q\n/OC /%s BDC\nBT\n/%s 1 Tf\n3 Tr\n0 0 Td\n(%s) Tj\nET\nEMC\n", propertyName, fontName, pageWatermarkWords(signature, page))
+		if err := addPDFLayerContent(ctx, pages[page], layer, patched); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addPDFLayerContent draws the page between q and Q, so that the layer starts
+// from the initial graphics state. The first and the last content stream are
+// changed in place, like pdfcpu adds its watermarks, so that pdfcpu can still
+// find them.
+func addPDFLayerContent(ctx *pdfcpu.Context, page pdfcpu.Dict, layer string, patched map[int]bool) error {
+	contents := page["Contents"]
+	if ref, ok := contents.(pdfcpu.IndirectRef); ok {
+		if entry, found := ctx.FindTableEntryForIndRef(&ref); found && entry != nil {
+			if array, ok := entry.Object.(pdfcpu.Array); ok {
+				contents = array
+			}
+		}
+	}
+	streams, ok := contents.(pdfcpu.Array)
+	if !ok {
+		streams = pdfcpu.Array{contents}
+	}
+	if len(streams) == 0 || streams[0] == nil {
+		sd, err := ctx.NewStreamDictForBuf([]byte("q" + layer))
+		if err != nil {
+			return err
+		}
+		if err := sd.Encode(); err != nil {
+			return err
+		}
+		ref, err := ctx.IndRefForNewObject(*sd)
+		if err != nil {
+			return err
+		}
+		page["Contents"] = *ref
+		return nil
+	}
+	first, _ := streams[0].(pdfcpu.IndirectRef)
+	last, _ := streams[len(streams)-1].(pdfcpu.IndirectRef)
+	if patched[first.ObjectNumber.Value()] || patched[last.ObjectNumber.Value()] {
+		return nil
+	}
+	if err := patchPDFStream(ctx, first, func(content []byte) []byte {
+		return append([]byte("q\n"), content...)
+	}); err != nil {
+		return err
+	}
+	if err := patchPDFStream(ctx, last, func(content []byte) []byte {
+		return append(content, layer...)
+	}); err != nil {
+		return err
+	}
+	patched[first.ObjectNumber.Value()] = true
+	patched[last.ObjectNumber.Value()] = true
+	return nil
+}
+
+func patchPDFStream(ctx *pdfcpu.Context, ref pdfcpu.IndirectRef, patch func([]byte) []byte) error {
+	entry, found := ctx.FindTableEntryForIndRef(&ref)
+	if !found || entry == nil {
+		return fmt.Errorf("invalid page content: %s", ref)
+	}
+	sd, ok := entry.Object.(pdfcpu.StreamDict)
+	if !ok {
+		return fmt.Errorf("invalid page content: %s", ref)
+	}
+	if err := sd.Decode(); err != nil {
+		return err
+	}
+	sd.Content = patch(sd.Content)
+	if err := sd.Encode(); err != nil {
+		return err
+	}
+	entry.Object = sd
+	return nil
+}
+
+func unusedPDFName(used map[string]bool, prefix string) string {
+	name := prefix
+	for i := 1; used[name]; i++ {
+		name = prefix + strconv.Itoa(i)
+	}
+	return name
+}
+
+// addPDFResource adds the object to a copy of a resource category.
+func addPDFResource(ctx *pdfcpu.Context, resources pdfcpu.Dict, category, name string, o pdfcpu.Object) error {
+	entries := pdfcpu.Dict{}
+	if d, err := ctx.DereferenceDict(resources[category]); err != nil {
+		return err
+	} else if d != nil {
+		for key, value := range d {
+			entries[key] = value
+		}
+	}
+	entries[name] = o
+	resources[category] = entries
+	return nil
+}
+
+// hiddenContentGroups returns the object numbers of the optional content
+// groups that are off when the document is opened.
+func hiddenContentGroups(ctx *pdfcpu.Context) map[int]bool {
+	groups := make(map[int]bool)
+	catalog, err := ctx.Catalog()
+	if err != nil {
+		return groups
+	}
+	properties, err := ctx.DereferenceDict(catalog["OCProperties"])
+	if err != nil || properties == nil {
+		return groups
+	}
+	config, err := ctx.DereferenceDict(properties["D"])
+	if err != nil || config == nil {
+		return groups
+	}
+	off, _ := ctx.DereferenceArray(config["OFF"])
+	for _, o := range off {
+		if ref, ok := o.(pdfcpu.IndirectRef); ok {
+			groups[ref.ObjectNumber.Value()] = true
+		}
+	}
+	return groups
+}
+
+// pdfTokenKey derives the key of the recipient token from the signature.
+func pdfTokenKey(signature string) []byte {
+	key := sha256.Sum256([]byte("wholeaked token " + signature))
+	return key[:]
+}
+
+// sealPDFToken encrypts the token with AES-GCM. The nonce is written before
+// the encrypted token.
+func sealPDFToken(signature, token string) ([]byte, error) {
+	block, err := aes.NewCipher(pdfTokenKey(signature))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, []byte(token), nil), nil
+}
+
+// openPDFToken decrypts a token. It only succeeds with the key of the
+// recipient the token was sealed for.
+func openPDFToken(signature string, sealed []byte) (string, bool) {
+	block, err := aes.NewCipher(pdfTokenKey(signature))
+	if err != nil {
+		return "", false
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", false
+	}
+	token, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", false
+	}
+	return string(token), true
+}
+
+// detectPDFToken reports whether an attachment of the document holds a token
+// of the signature.
+func detectPDFToken(ctx *pdfcpu.Context, signature string) bool {
+	catalog, err := ctx.Catalog()
+	if err != nil {
+		return false
+	}
+	names, err := ctx.DereferenceDict(catalog["Names"])
+	if err != nil || names == nil {
+		return false
+	}
+	for _, sealed := range pdfEmbeddedFiles(ctx, names["EmbeddedFiles"], 0) {
+		if _, ok := openPDFToken(signature, sealed); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pdfEmbeddedFiles returns the content of the files of an embedded files name
+// tree. pdfcpu only reads name trees when it validates the whole document.
+func pdfEmbeddedFiles(ctx *pdfcpu.Context, node pdfcpu.Object, depth int) [][]byte {
+	d, err := ctx.DereferenceDict(node)
+	if err != nil || d == nil || depth > pdfMaxFormDepth {
+		return nil
+	}
+	var files [][]byte
+	kids, _ := ctx.DereferenceArray(d["Kids"])
+	for _, kid := range kids {
+		files = append(files, pdfEmbeddedFiles(ctx, kid, depth+1)...)
+	}
+	entries, _ := ctx.DereferenceArray(d["Names"])
+	for i := 1; i < len(entries); i += 2 {
+		spec, err := ctx.DereferenceDict(entries[i])
+		if err != nil || spec == nil {
+			continue
+		}
+		ef, err := ctx.DereferenceDict(spec["EF"])
+		if err != nil || ef == nil {
+			continue
+		}
+		sd, _, err := ctx.DereferenceStreamDict(ef["F"])
+		if err != nil || sd == nil || sd.Decode() != nil {
+			continue
+		}
+		files = append(files, sd.Content)
+	}
+	return files
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+func TestPDFLayerHidesSignature(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "document.pdf")
+	writeTestPDF(t, file, [][]string{{"The first page."}, {"The second page."}})
+	if err := addPDFLayerAndToken(file, testSignature, "Alice", "alice@example.com", true, false); err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := readPDFContext(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range ctx.XRefTable.Table {
+		if sd, ok := entry.Object.(pdfcpu.StreamDict); ok && sd.Decode() == nil && strings.Contains(string(sd.Content), testSignature) {
+			t.Error("the signature is in the content of the document")
+		}
+	}
+	pages, err := extractPDFHiddenText(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 || !decodeWatermarkWords(strings.Join(pages, "\n")).matches(testSignature) {
+		t.Errorf("the signature wasn't read from the hidden layer: %q", pages)
+	}
+	if pages, _ := extractPDFText(file); decodeWatermarkWords(strings.Join(pages, "\n")).matches(testSignature) {
+		t.Error("the hidden layer is in the visible text")
+	}
+}
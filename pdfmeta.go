@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// PDF metadata channels. PDF tools differ in what they keep when they save a
+// file again, so validation reports each channel that still holds the
+// signature.
+const (
+	pdfChannelInfo    = "Info dictionary"
+	pdfChannelXMP     = "XMP"
+	pdfChannelCatalog = "catalog"
+	pdfChannelID      = "trailer ID"
+	pdfDocumentIDKey  = "DocumentID"
+)
+
+var pdfChannels = []string{pdfChannelInfo, pdfChannelXMP, pdfChannelCatalog, pdfChannelID, pdfChannelAttachment}
+
+// pdfFileID derives the file identifier of a recipient's copy from the
+// signature. It has the length of the MD5 identifiers PDF writers create.
+func pdfFileID(signature string) string {
+	sum := md5.Sum([]byte(signature))
+	return hex.EncodeToString(sum[:])
+}
+
+// addPDFMetadata adds the signature to the keywords and a custom entry of the
+// Info dictionary, to the XMP metadata, to a custom entry of the catalog, and
+// makes the first trailer ID element derive from it.
+func addPDFMetadata(file, signature string) error {
+	ctx, err := readPDFContext(file)
+	if err != nil {
+		return err
+	}
+	if ctx.Info == nil {
+		ir, err := ctx.IndRefForNewObject(pdfcpu.NewDict())
+		if err != nil {
+			return err
+		}
+		ctx.Info = ir
+	}
+	info, err := ctx.DereferenceDict(*ctx.Info)
+	if err != nil || info == nil {
+		return fmt.Errorf("invalid Info dictionary")
+	}
+	keywords, err := ctx.Dereference(info["Keywords"])
+	if err != nil {
+		return err
+	}
+	info["Keywords"] = appendPDFText(keywords, signature)
+	info[pdfDocumentIDKey] = pdfcpu.StringLiteral(signature)
+	catalog, err := ctx.Catalog()
+	if err != nil {
+		return err
+	}
+	catalog[pdfDocumentIDKey] = pdfcpu.StringLiteral(signature)
+	if err := addPDFXMP(ctx, catalog, signature); err != nil {
+		return err
+	}
+	// The ID of an encrypted file is part of its key.
+	if ctx.Encrypt == nil {
+		id := pdfcpu.HexLiteral(pdfFileID(signature))
+		if len(ctx.ID) == 2 {
+			ctx.ID[0] = id
+		} else {
+			ctx.ID = pdfcpu.Array{id, id}
+		}
+	}
+	return writePDFContext(ctx, file)
+}
+
+func readPDFContext(file string) (*pdfcpu.Context, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return api.ReadContext(f, pdfcpu.NewDefaultConfiguration())
+}
+
+// appendPDFText adds the signature to the end of a text string, keeping its
+// encoding.
+func appendPDFText(o pdfcpu.Object, signature string) pdfcpu.Object {
+	switch o := o.(type) {
+	case pdfcpu.StringLiteral:
+		if o != "" {
+			return pdfcpu.StringLiteral(string(o) + " " + signature)
+		}
+	case pdfcpu.HexLiteral:
+		b, err := o.Bytes()
+		if err != nil || len(b) == 0 {
+			break
+		}
+		if bytes.HasPrefix(b, []byte{0xFE, 0xFF}) {
+			for _, unit := range utf16.Encode([]rune(" " + signature)) {
+				b = append(b, byte(unit>>8), byte(unit))
+			}
+		} else {
+			b = append(b, " "+signature...)
+		}
+		return pdfcpu.HexLiteral(hex.EncodeToString(b))
+	}
+	return pdfcpu.StringLiteral(signature)
+}
+
+// addPDFXMP adds the dc:identifier to the XMP metadata of the document. The
+// metadata stream is stored uncompressed, like most writers do.
+func addPDFXMP(ctx *pdfcpu.Context, catalog pdfcpu.Dict, signature string) error {
+	var packet []byte
+	if o, found := catalog.Find("Metadata"); found {
+		if sd, _, err := ctx.DereferenceStreamDict(o); err == nil && sd != nil && sd.Decode() == nil {
+			packet = sd.Content
+		}
+	}
+	d := pdfcpu.NewDict()
+	d.InsertName("Type", "Metadata")
+	d.InsertName("Subtype", "XML")
+	sd := pdfcpu.NewStreamDict(d, 0, nil, nil, nil)
+	sd.Content = addXMPIdentifier(packet, signature)
+	if err := sd.Encode(); err != nil {
+		return err
+	}
+	if ir, ok := catalog["Metadata"].(pdfcpu.IndirectRef); ok {
+		if entry, found := ctx.FindTableEntryForIndRef(&ir); found {
+			entry.Object = sd
+			return nil
+		}
+	}
+	ir, err := ctx.IndRefForNewObject(sd)
+	if err != nil {
+		return err
+	}
+	catalog["Metadata"] = *ir
+	return nil
+}
+
+// detectPDFMetadata returns the metadata channels of a PDF file that hold the
+// signature.
+func detectPDFMetadata(file, signature string) []string {
+	ctx, err := readPDFContext(file)
+	if err != nil {
+		return nil
+	}
+	found := make(map[string]bool)
+	if ctx.Info != nil {
+		if info, err := ctx.DereferenceDict(*ctx.Info); err == nil {
+			for _, o := range info {
+				if pdfTextContains(pdfObjectText(ctx, o), signature) {
+					found[pdfChannelInfo] = true
+				}
+			}
+		}
+	}
+	if catalog, err := ctx.Catalog(); err == nil {
+		if o, ok := catalog.Find("Metadata"); ok {
+			if sd, _, err := ctx.DereferenceStreamDict(o); err == nil && sd != nil && sd.Decode() == nil {
+				found[pdfChannelXMP] = bytes.Contains(sd.Content, []byte(signature))
+			}
+		}
+		found[pdfChannelCatalog] = pdfTextContains(pdfObjectText(ctx, catalog[pdfDocumentIDKey]), signature)
+	}
+	for _, o := range ctx.ID {
+		if hexLiteral, ok := o.(pdfcpu.HexLiteral); ok && strings.EqualFold(string(hexLiteral), pdfFileID(signature)) {
+			found[pdfChannelID] = true
+		}
+	}
+	found[pdfChannelAttachment] = detectPDFToken(ctx, signature)
+	var channels []string
+	for _, channel := range pdfChannels {
+		if found[channel] {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// pdfObjectText returns the text of a string object.
+func pdfObjectText(ctx *pdfcpu.Context, o pdfcpu.Object) string {
+	o, err := ctx.Dereference(o)
+	if err != nil {
+		return ""
+	}
+	switch o := o.(type) {
+	case pdfcpu.StringLiteral:
+		if text, err := pdfcpu.StringLiteralToString(o); err == nil {
+			return text
+		}
+	case pdfcpu.HexLiteral:
+		if text, err := pdfcpu.HexLiteralToString(o); err == nil {
+			return text
+		}
+	}
+	return ""
+}
+
+// pdfChannelReport lists the channels that were found and the ones that are
+// missing.
+func pdfChannelReport(all, channels []string) string {
+	report := strings.Join(channels, ", ")
+	if missing := missingPDFChannels(all, channels); len(missing) > 0 {
+		report += "; removed: " + strings.Join(missing, ", ")
+	}
+	return report
+}
+
+// missingPDFChannels returns the channels of all that aren't in the list.
+func missingPDFChannels(all, channels []string) []string {
+	var missing []string
+	for _, channel := range all {
+		found := false
+		for _, c := range channels {
+			found = found || c == channel
+		}
+		if !found {
+			missing = append(missing, channel)
+		}
+	}
+	return missing
+}
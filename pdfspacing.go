@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/fatih/color"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// Spacing marks move the first glyphs of selected lines of a PDF file by a
+// fraction of a point: along the line with a kerning adjustment in front of
+// them, and across it with the text rise. Every recipient gets different
+// directions. The shifts become part of the glyph positions when the file is
+// printed to PDF again or flattened, so the lines of a leaked copy are found
+// again by their text and their positions are compared with the marks that
+// are stored in the project. Printing may scale and move the pages, so the
+// positions are compared after fitting the pages onto each other.
+const (
+	spacingShift     = 0.25
+	spacingKeyLength = 10
+	maxSpacingMarks  = 24
+	minSpacingMarks  = 12
+	// A match needs a score of at least minSpacingZ, and more with many
+	// recipients, so that a false match happens less than once in a
+	// thousand validations.
+	minSpacingZ          = 4.0
+	maxSpacingFalseMatch = 0.001
+)
+
+// spacingMark is a marked line: its page, the text it starts with, the
+// position of its first glyph before the shift and the shift on the page.
+type spacingMark struct {
+	page   int
+	key    string
+	x, y   float64
+	dx, dy float64
+}
+
+type spacingLocation struct {
+	page  int
+	x, y  float64
+	count int
+}
+
+// spacingObservation holds the text of the pages of a leaked file, the
+// positions of its letters by offset and the lines that were looked up.
+type spacingObservation struct {
+	pages     []string
+	positions [][][2]float64
+	found     map[string]spacingLocation
+}
+
+func addSpacingSignature(projectDir, file, signature string) {
+	marks, err := addSpacingPDF(file, signature)
+	if err != nil {
+		color.Red("Error occurred while adding the spacing marks to the PDF file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(marks) == 0 {
+		return
+	}
+	var entries []string
+	for _, mark := range marks {
+		entries = append(entries, fmt.Sprintf("%d:%s:%s:%s:%s:%s", mark.page, pdfNumberText(mark.x), pdfNumberText(mark.y), pdfNumberText(mark.dx), pdfNumberText(mark.dy), hex.EncodeToString([]byte(mark.key))))
+	}
+	f, err := os.OpenFile(filepath.Join(projectDir, "spacing.csv"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		color.Red("Can't write to the spacing database")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	_, err = f.WriteString(signature + "," + strings.Join(entries, " ") + "\n")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// spacingText returns the letters of the glyphs that a line is found by.
+// Homoglyphs are read as the letters they stand for.
+func spacingText(glyphs []pdfGlyph) ([]rune, []int) {
+	var text []rune
+	var index []int
+	for i, glyph := range glyphs {
+		for _, r := range glyph.text {
+			if unicode.IsSpace(r) {
+				continue
+			}
+			if l, found := homoglyphLatin[r]; found {
+				r = l
+			}
+			text = append(text, r)
+			index = append(index, i)
+		}
+	}
+	return text, index
+}
+
+// addSpacingPDF marks the lines of the pages and returns the marks. Only
+// lines that start where the text position was set and whose text is unique
+// in the document are used.
+func addSpacingPDF(file, signature string) ([]spacingMark, error) {
+	ctx, err := api.ReadContextFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return nil, err
+	}
+	e := newPDFTextExtractor(ctx)
+	type candidate struct {
+		run  pdfTextRun
+		key  string
+		x, y float64
+	}
+	contents := make([][]byte, ctx.PageCount+1)
+	candidates := make([][]candidate, ctx.PageCount+1)
+	var document []rune
+	for page := 1; page <= ctx.PageCount; page++ {
+		if contents[page], err = e.processPage(page); err != nil {
+			return nil, err
+		}
+		text, _ := spacingText(e.glyphs)
+		document = append(append(document, text...), '\n')
+		for _, run := range e.runs {
+			glyphs := e.glyphs[run.glyphs[0]:run.glyphs[1]]
+			key, index := spacingText(glyphs)
+			if run.positioned && len(key) >= spacingKeyLength && run.state.fontSize*run.state.scale != 0 {
+				first := glyphs[index[0]]
+				candidates[page] = append(candidates[page], candidate{run, string(key[:spacingKeyLength]), first.x, first.y})
+			}
+		}
+	}
+	counts := make(map[string]int)
+	for _, page := range candidates {
+		for _, c := range page {
+			counts[c.key] = 0
+		}
+	}
+	for i := 0; i+spacingKeyLength <= len(document); i++ {
+		if count, found := counts[string(document[i:i+spacingKeyLength])]; found {
+			counts[string(document[i:i+spacingKeyLength])] = count + 1
+		}
+	}
+	var marks []spacingMark
+	for page := 1; page <= ctx.PageCount; page++ {
+		var unique []candidate
+		for _, c := range candidates[page] {
+			if counts[c.key] == 1 {
+				unique = append(unique, c)
+			}
+		}
+		if len(unique) == 0 {
+			continue
+		}
+		var edits []pdfEdit
+		step := 1.0
+		if len(unique) > maxSpacingMarks {
+			step = float64(len(unique)) / maxSpacingMarks
+		}
+		for i := 0.0; int(i) < len(unique); i += step {
+			c := unique[int(i)]
+			mark, edit, ok := spacingEdit(c.run, page, c.key, signature)
+			if !ok {
+				continue
+			}
+			mark.x, mark.y = c.x, c.y
+			marks = append(marks, mark)
+			edits = append(edits, edit...)
+		}
+		if err := replacePageContent(ctx, page, applyPDFEdits(contents[page], edits)); err != nil {
+			return nil, err
+		}
+	}
+	if len(marks) == 0 {
+		return nil, nil
+	}
+	return marks, writePDFContext(ctx, file)
+}
+
+type pdfEdit struct {
+	offset int
+	text   string
+}
+
+// spacingEdit returns the shift of a line and the operators that make it. The
+// shifts have the same length on the page whatever the size of the text.
+func spacingEdit(run pdfTextRun, page int, key, signature string) (spacingMark, []pdfEdit, bool) {
+	m := run.textMatrix.multiply(run.state.ctm)
+	along := math.Hypot(m[0], m[1])
+	across := math.Hypot(m[2], m[3])
+	if along == 0 || across == 0 {
+		return spacingMark{}, nil, false
+	}
+	sum := sha256.Sum256([]byte(signature + ":" + strconv.Itoa(page) + ":" + key))
+	alongShift, acrossShift := spacingShift, spacingShift
+	if sum[0]&1 == 1 {
+		alongShift = -alongShift
+	}
+	if sum[0]&2 == 2 {
+		acrossShift = -acrossShift
+	}
+	tx := alongShift / along
+	rise := acrossShift / across
+	adjustment := -tx * 1000 / (run.state.fontSize * run.state.scale)
+	mark := spacingMark{page: page, key: key, dx: tx*m[0] + rise*m[2], dy: tx*m[1] + rise*m[3]}
+	edits := []pdfEdit{
+		{run.start, pdfNumberText(run.state.rise+rise) + " Ts [" + pdfNumberText(adjustment) + "] TJ "},
+		{run.end, " " + pdfNumberText(run.state.rise) + " Ts"},
+	}
+	return mark, edits, true
+}
+
+func readSpacingRecords(file string) map[string][]spacingMark {
+	records := make(map[string][]spacingMark)
+	f, err := os.Open(file)
+	if err != nil {
+		return records
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ",", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		for _, entry := range strings.Fields(fields[1]) {
+			parts := strings.Split(entry, ":")
+			if len(parts) != 6 {
+				continue
+			}
+			var mark spacingMark
+			var values [4]float64
+			var err error
+			if mark.page, err = strconv.Atoi(parts[0]); err != nil {
+				continue
+			}
+			for i := range values {
+				if values[i], err = strconv.ParseFloat(parts[i+1], 64); err != nil {
+					break
+				}
+			}
+			key, keyErr := hex.DecodeString(parts[5])
+			if err != nil || keyErr != nil {
+				continue
+			}
+			mark.x, mark.y, mark.dx, mark.dy, mark.key = values[0], values[1], values[2], values[3], string(key)
+			records[fields[0]] = append(records[fields[0]], mark)
+		}
+	}
+	return records
+}
+
+// observeSpacing reads the glyphs of a leaked PDF file.
+func observeSpacing(file string) *spacingObservation {
+	pages, err := extractPDFGlyphs(file)
+	if err != nil {
+		return nil
+	}
+	o := &spacingObservation{found: make(map[string]spacingLocation)}
+	for _, glyphs := range pages {
+		text, index := spacingText(glyphs)
+		positions := make([][2]float64, len(string(text)))
+		offset := 0
+		for i, r := range text {
+			positions[offset] = [2]float64{glyphs[index[i]].x, glyphs[index[i]].y}
+			offset += len(string(r))
+		}
+		o.pages = append(o.pages, string(text))
+		o.positions = append(o.positions, positions)
+	}
+	return o
+}
+
+// locate finds the line that starts with the key. count is the number of
+// times the key was found in the document.
+func (o *spacingObservation) locate(key string) spacingLocation {
+	if location, found := o.found[key]; found {
+		return location
+	}
+	var location spacingLocation
+	for page, text := range o.pages {
+		for start := 0; ; {
+			i := strings.Index(text[start:], key)
+			if i < 0 {
+				break
+			}
+			if location.count == 0 {
+				position := o.positions[page][start+i]
+				location = spacingLocation{page + 1, position[0], position[1], 0}
+			}
+			location.count++
+			start += i + 1
+		}
+	}
+	o.found[key] = location
+	return location
+}
+
+// score compares the positions of the lines in the leaked file with the
+// marks of a recipient. Each page of the leaked file is fitted onto the
+// marked lines with a scale, a rotation and a move, and what remains of the
+// position of every line is compared with the shift of the recipient. The
+// shifts of other recipients point in random directions, so the score is in
+// standard deviations of their sum: about the square root of twice the
+// number of lines for the recipient's copy, and close to 0 for other copies.
+func (o *spacingObservation) score(marks []spacingMark) (int, float64) {
+	if o == nil {
+		return 0, 0
+	}
+	type pair struct {
+		original, shifted, observed [2]float64
+	}
+	pages := make(map[int][]pair)
+	for _, mark := range marks {
+		location := o.locate(mark.key)
+		if location.count != 1 {
+			continue
+		}
+		pages[location.page] = append(pages[location.page], pair{
+			[2]float64{mark.x, mark.y},
+			[2]float64{mark.x + mark.dx, mark.y + mark.dy},
+			[2]float64{location.x, location.y},
+		})
+	}
+	lines := 0
+	var correlation, power float64
+	for _, pairs := range pages {
+		var original, shifted, observed [][2]float64
+		for _, p := range pairs {
+			original = append(original, p.original)
+			shifted = append(shifted, p.shifted)
+			observed = append(observed, p.observed)
+		}
+		// Lines that are far off with and without the shifts were found in
+		// the wrong place, they are left out before fitting again.
+		if len(pairs) >= 3 {
+			withShifts := similarityResiduals(shifted, observed)
+			withoutShifts := similarityResiduals(original, observed)
+			var kept []int
+			for i := range pairs {
+				if math.Min(withShifts[i], withoutShifts[i]) <= 4*spacingShift*spacingShift {
+					kept = append(kept, i)
+				}
+			}
+			original, shifted, observed = nil, nil, nil
+			for _, i := range kept {
+				original = append(original, pairs[i].original)
+				shifted = append(shifted, pairs[i].shifted)
+				observed = append(observed, pairs[i].observed)
+			}
+		}
+		// A page fit takes four lines' worth of freedom, pages with fewer
+		// lines than that say nothing.
+		if len(observed) < 5 {
+			continue
+		}
+		lines += len(observed)
+		// The leaked positions are mapped back onto the issued page, where
+		// they are off from the original positions by the shifts.
+		for i, offset := range similarityFit(observed, original) {
+			shift := [2]float64{shifted[i][0] - original[i][0], shifted[i][1] - original[i][1]}
+			correlation -= offset[0]*shift[0] + offset[1]*shift[1]
+			power += offset[0]*offset[0] + offset[1]*offset[1]
+		}
+	}
+	// Without shifts in the leaked file there is nothing to compare.
+	if lines == 0 || power < float64(lines)*spacingShift*spacingShift/10 {
+		return lines, 0
+	}
+	return lines, correlation / (spacingShift * math.Sqrt(power))
+}
+
+// minSpacingScore returns the score that a recipient needs, which grows with
+// the number of recipients, so that the chance that any other recipient
+// reaches it stays below maxSpacingFalseMatch.
+func minSpacingScore(recipients int) float64 {
+	if recipients < 1 {
+		recipients = 1
+	}
+	return math.Max(minSpacingZ, math.Sqrt2*math.Erfcinv(2*maxSpacingFalseMatch/float64(recipients)))
+}
+
+// similarityResiduals fits the points onto the observed points with a scale,
+// a rotation and a move and returns the squared distances that remain.
+func similarityResiduals(points, observed [][2]float64) []float64 {
+	offsets := similarityFit(points, observed)
+	residuals := make([]float64, len(points))
+	for i, offset := range offsets {
+		residuals[i] = offset[0]*offset[0] + offset[1]*offset[1]
+	}
+	return residuals
+}
+
+// similarityFit fits the points onto the observed points with a scale, a
+// rotation and a move and returns how far every observed point is from its
+// fitted point.
+func similarityFit(points, observed [][2]float64) [][2]float64 {
+	var mean, observedMean [2]float64
+	for i := range points {
+		for j := 0; j < 2; j++ {
+			mean[j] += points[i][j] / float64(len(points))
+			observedMean[j] += observed[i][j] / float64(len(points))
+		}
+	}
+	var norm, a, b float64
+	for i := range points {
+		x, y := points[i][0]-mean[0], points[i][1]-mean[1]
+		u, v := observed[i][0]-observedMean[0], observed[i][1]-observedMean[1]
+		norm += x*x + y*y
+		a += x*u + y*v
+		b += x*v - y*u
+	}
+	if norm != 0 {
+		a, b = a/norm, b/norm
+	}
+	offsets := make([][2]float64, len(points))
+	for i := range points {
+		x, y := points[i][0]-mean[0], points[i][1]-mean[1]
+		u, v := observed[i][0]-observedMean[0], observed[i][1]-observedMean[1]
+		offsets[i] = [2]float64{u - (a*x - b*y), v - (b*x + a*y)}
+	}
+	return offsets
+}
+
+func pdfNumberText(f float64) string {
+	return strconv.FormatFloat(math.Round(f*10000)/10000, 'f', -1, 64)
+}
+
+func applyPDFEdits(content []byte, edits []pdfEdit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].offset < edits[j].offset })
+	var out []byte
+	last := 0
+	for _, edit := range edits {
+		out = append(append(out, content[last:edit.offset]...), edit.text...)
+		last = edit.offset
+	}
+	return append(out, content[last:]...)
+}
+
+// replacePageContent writes the content of a page to a new stream.
+func replacePageContent(ctx *pdfcpu.Context, page int, content []byte) error {
+	d, _, _, err := ctx.PageDict(page, false)
+	if err != nil {
+		return err
+	}
+	sd, err := ctx.NewStreamDictForBuf(content)
+	if err != nil {
+		return err
+	}
+	if err := sd.Encode(); err != nil {
+		return err
+	}
+	ir, err := ctx.IndRefForNewObject(*sd)
+	if err != nil {
+		return err
+	}
+	d.Update("Contents", *ir)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testSpacingMarks returns the marks of a recipient on lines at the
+// positions, with the shifts picked like spacingEdit does for upright text.
+func testSpacingMarks(signature string, keys []string, positions [][2]float64, pages []int) []spacingMark {
+	var marks []spacingMark
+	for i, key := range keys {
+		sum := sha256.Sum256([]byte(signature + ":" + fmt.Sprint(pages[i]) + ":" + key))
+		dx, dy := spacingShift, spacingShift
+		if sum[0]&1 == 1 {
+			dx = -dx
+		}
+		if sum[0]&2 == 2 {
+			dy = -dy
+		}
+		marks = append(marks, spacingMark{pages[i], key, positions[i][0], positions[i][1], dx, dy})
+	}
+	return marks
+}
+
+// testSpacingLeak returns the observation of the recipient's copy after it
+// was printed: scaled, turned a little, moved and rounded to a tenth of a
+// point.
+func testSpacingLeak(marks []spacingMark) *spacingObservation {
+	o := &spacingObservation{found: make(map[string]spacingLocation)}
+	scale, angle := 0.94, 0.004
+	for _, mark := range marks {
+		x, y := mark.x+mark.dx, mark.y+mark.dy
+		u := scale*(x*math.Cos(angle)-y*math.Sin(angle)) + 18
+		v := scale*(x*math.Sin(angle)+y*math.Cos(angle)) - 7
+		o.found[mark.key] = spacingLocation{mark.page, math.Round(u*10) / 10, math.Round(v*10) / 10, 1}
+	}
+	return o
+}
+
+func TestSpacingScore(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, count := range []int{minSpacingMarks, 24, 60} {
+		var keys []string
+		var positions [][2]float64
+		var pages []int
+		for i := 0; i < count; i++ {
+			keys = append(keys, fmt.Sprintf("line %05d", i))
+			positions = append(positions, [2]float64{72 + rng.Float64()*40, 72 + float64(i%30)*22})
+			pages = append(pages, 1+i/30)
+		}
+		signature := signaturePrefix + uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprint("recipient", count))).String()
+		leak := testSpacingLeak(testSpacingMarks(signature, keys, positions, pages))
+		recipients := 2000
+		threshold := minSpacingScore(recipients)
+		if count >= 24 {
+			if lines, score := leak.score(testSpacingMarks(signature, keys, positions, pages)); lines != count || score < threshold {
+				t.Errorf("%d lines: the recipient scored %.1f on %d lines, needs %.1f", count, score, lines, threshold)
+			}
+		}
+		matched := 0
+		for i := 0; i < recipients; i++ {
+			other := signaturePrefix + uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprint(count, i))).String()
+			if _, score := leak.score(testSpacingMarks(other, keys, positions, pages)); score >= threshold {
+				matched++
+			}
+		}
+		if matched > 0 {
+			t.Errorf("%d lines: %d of %d other recipients matched", count, matched, recipients)
+		}
+	}
+}
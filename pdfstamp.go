@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/font"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// The visible stamp and the cover page are configured in the CONFIG file. The
+// fields of the recipient are filled in like in the e-mail templates.
+const (
+	defaultStampText = "Confidential - issued to {{Name}} {{Email}} on {{Date}}"
+	stampFont        = "Helvetica"
+	stampMargin      = 24
+	coverFontSize    = 12
+	coverMargin      = 72
+)
+
+type pdfStamp struct {
+	text      string
+	fontSize  int
+	opacity   float64
+	rotation  float64
+	position  string
+	firstPage bool
+}
+
+// readPDFStamp returns the stamp settings of the CONFIG file. Missing settings
+// get the default values.
+func readPDFStamp(configs map[string]string) (pdfStamp, error) {
+	stamp := pdfStamp{text: defaultStampText, fontSize: 9, opacity: 0.6, position: "bc"}
+	if configs["STAMP_TEXT"] != "" {
+		stamp.text = configs["STAMP_TEXT"]
+	}
+	var err error
+	if value := configs["STAMP_FONT_SIZE"]; value != "" {
+		if stamp.fontSize, err = strconv.Atoi(value); err != nil || stamp.fontSize <= 0 {
+			return stamp, fmt.Errorf("invalid STAMP_FONT_SIZE: %s", value)
+		}
+	}
+	if value := configs["STAMP_OPACITY"]; value != "" {
+		if stamp.opacity, err = strconv.ParseFloat(value, 64); err != nil || stamp.opacity <= 0 || stamp.opacity > 1 {
+			return stamp, fmt.Errorf("invalid STAMP_OPACITY: %s", value)
+		}
+	}
+	if value := configs["STAMP_ROTATION"]; value != "" {
+		if stamp.rotation, err = strconv.ParseFloat(value, 64); err != nil || stamp.rotation < -180 || stamp.rotation > 180 {
+			return stamp, fmt.Errorf("invalid STAMP_ROTATION: %s", value)
+		}
+	}
+	if value := configs["STAMP_POSITION"]; value != "" {
+		stamp.position = value
+	}
+	if _, _, err := stampOffset(stamp.position); err != nil {
+		return stamp, err
+	}
+	switch configs["STAMP_PAGES"] {
+	case "", "all":
+	case "first":
+		stamp.firstPage = true
+	default:
+		return stamp, fmt.Errorf("invalid STAMP_PAGES: %s (should be all or first)", configs["STAMP_PAGES"])
+	}
+	return stamp, nil
+}
+
+// stampOffset returns the pdfcpu anchor of a position and moves the stamp
+// away from the edges of the page.
+func stampOffset(position string) (string, string, error) {
+	directions := map[string][2]int{
+		"tl": {1, -1}, "tc": {0, -1}, "tr": {-1, -1},
+		"l": {1, 0}, "c": {0, 0}, "r": {-1, 0},
+		"bl": {1, 1}, "bc": {0, 1}, "br": {-1, 1},
+	}
+	names := map[string]string{
+		"top-left": "tl", "top-center": "tc", "top-right": "tr",
+		"left": "l", "center": "c", "right": "r",
+		"bottom-left": "bl", "bottom-center": "bc", "bottom-right": "br",
+	}
+	if anchor, found := names[position]; found {
+		position = anchor
+	}
+	direction, found := directions[position]
+	if !found {
+		return "", "", fmt.Errorf("invalid STAMP_POSITION: %s", position)
+	}
+	return position, fmt.Sprintf("%d %d", direction[0]*stampMargin, direction[1]*stampMargin), nil
+}
+
+// recipientText fills the fields of the recipient into a template.
+func recipientText(template, name, email string) string {
+	replacer := strings.NewReplacer(
+		"{{Name}}", name,
+		"{{Email}}", email,
+		"{{Date}}", time.Now().Format("2006-01-02"),
+	)
+	return replacer.Replace(template)
+}
+
+// winAnsiText prepares the text for pdfcpu, which writes the character codes
+// of the standard fonts as they are given.
+func winAnsiText(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		if c, ok := charmap.Windows1252.EncodeRune(r); ok {
+			b.WriteRune(rune(c))
+		} else {
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// wrapCoverText breaks the lines of the cover page so that they fit into the
+// width. Empty lines are kept as a space, pdfcpu skips them otherwise.
+func wrapCoverText(text string, width float64) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			if line != "" && font.TextWidth(line+" "+word, stampFont, coverFontSize) > width {
+				lines = append(lines, line)
+				line = word
+			} else if line != "" {
+				line += " " + word
+			} else {
+				line = word
+			}
+		}
+		if line == "" {
+			line = " "
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == " " {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// addVisiblePDFMarks inserts the cover page of the recipient and stamps the
+// pages of the document with the recipient's name.
+func addVisiblePDFMarks(file, name, email string, stampFlag, coverFlag bool) {
+	if err := stampPDF(file, parseConfigFile(), name, email, stampFlag, coverFlag); err != nil {
+		color.Red("Error occurred while adding the visible stamp to the PDF file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func stampPDF(file string, configs map[string]string, name, email string, stampFlag, coverFlag bool) error {
+	var stamp pdfStamp
+	var err error
+	if stampFlag {
+		if stamp, err = readPDFStamp(configs); err != nil {
+			return err
+		}
+	}
+	ctx, err := api.ReadContextFile(file)
+	if err != nil {
+		return err
+	}
+	if err := api.ValidateContext(ctx); err != nil {
+		return err
+	}
+	if err := api.OptimizeContext(ctx); err != nil {
+		return err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+	firstPage := 1
+	if coverFlag {
+		if err := addCoverPage(ctx, configs["COVER_TEMPLATE_PATH"], name, email); err != nil {
+			return err
+		}
+		firstPage = 2
+	}
+	if stampFlag {
+		position, offset, _ := stampOffset(stamp.position)
+		description := fmt.Sprintf("font:%s, points:%d, sc:1 abs, rot:%g, op:%g, pos:%s, off:%s", stampFont, stamp.fontSize, stamp.rotation, stamp.opacity, position, offset)
+		wm, err := api.TextWatermark(winAnsiText(recipientText(stamp.text, name, email)), description, true, false, pdfcpu.POINTS)
+		if err != nil {
+			return err
+		}
+		pages := pdfcpu.IntSet{}
+		for page := firstPage; page <= ctx.PageCount; page++ {
+			pages[page] = !stamp.firstPage || page == firstPage
+		}
+		if err := ctx.AddWatermarks(pages, wm); err != nil {
+			return err
+		}
+	}
+	return writePDFContext(ctx, file)
+}
+
+// addCoverPage inserts a page before the first page and writes the template
+// filled with the fields of the recipient on it.
+func addCoverPage(ctx *pdfcpu.Context, template, name, email string) error {
+	if template == "" {
+		return fmt.Errorf("no COVER_TEMPLATE_PATH is set in the CONFIG file")
+	}
+	content, err := ioutil.ReadFile(template)
+	if err != nil {
+		return err
+	}
+	if err := ctx.InsertBlankPages(pdfcpu.IntSet{1: true}, true); err != nil {
+		return err
+	}
+	ctx.PageCount++
+	dims, err := ctx.PageDims()
+	if err != nil {
+		return err
+	}
+	lines := wrapCoverText(winAnsiText(recipientText(string(content), name, email)), dims[0].Width-2*coverMargin)
+	description := fmt.Sprintf("font:%s, points:%d, sc:1 abs, rot:0, op:1, fillcolor:0 0 0, aligntext:l, pos:tl, off:%d -%d", stampFont, coverFontSize, coverMargin, coverMargin)
+	wm, err := api.TextWatermark(strings.Join(lines, "\n"), description, true, false, pdfcpu.POINTS)
+	if err != nil {
+		return err
+	}
+	return ctx.AddWatermarks(pdfcpu.IntSet{1: true}, wm)
+}
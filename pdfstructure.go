@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/fatih/color"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// The structure of a PDF file can be changed without changing how it looks.
+// The six letter tags of subset fonts (ABCDEF+Arial) only need to differ
+// between subsets, and the objects can have any numbers. Every recipient gets
+// their own tags and their own order of the objects. Both are derived from
+// the signature, so they are recognized without the issued copies. Tools
+// that rewrite a document usually copy the fonts as they are, even when they
+// strip the metadata.
+//
+// The order of the objects matches if at least minOrderShare of the
+// neighbouring streams are in the order of the recipient, and more with many
+// recipients, so that the chance that any other recipient matches stays below
+// maxOrderFalseMatch.
+const (
+	maxSubsetsPerFont  = 16
+	minOrderPairs      = 8
+	minOrderShare      = 0.9
+	maxOrderFalseMatch = 0.001
+	maxExactOrderPairs = 200
+)
+
+var subsetFontName = regexp.MustCompile(`^([A-Z]{6})\+(.+)$`)
+
+// addPDFStructureSignature changes the subset tags of the fonts and the
+// numbers of the objects of a PDF file.
+func addPDFStructureSignature(file, signature string) {
+	if err := addPDFStructure(file, signature); err != nil {
+		color.Red("Error occurred while adding the signature to the structure of the PDF file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func addPDFStructure(file, signature string) error {
+	ctx, err := readPDFContext(file)
+	if err != nil {
+		return err
+	}
+	retagPDFFonts(ctx, signature)
+	// The numbers of the objects are part of the key of encrypted files.
+	if ctx.Encrypt == nil {
+		renumberPDFObjects(ctx, signature)
+	}
+	return writePDFContext(ctx, file)
+}
+
+// subsetTag returns the tag of the k-th subset of a font for a recipient.
+func subsetTag(signature, name string, k int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%d", signature, name, k)))
+	tag := make([]byte, 6)
+	for i := range tag {
+		tag[i] = 'A' + sum[i]%26
+	}
+	return string(tag)
+}
+
+// pdfFontDescriptors returns the descriptors of the fonts of a document.
+func pdfFontDescriptors(ctx *pdfcpu.Context) []pdfcpu.Dict {
+	var descriptors []pdfcpu.Dict
+	for _, entry := range ctx.Table {
+		if entry == nil || entry.Free {
+			continue
+		}
+		if d, ok := entry.Object.(pdfcpu.Dict); ok && d.Type() != nil && *d.Type() == "FontDescriptor" {
+			descriptors = append(descriptors, d)
+		}
+	}
+	return descriptors
+}
+
+// retagPDFFonts replaces the subset tags. The subsets of a font are counted
+// in the order of their original tags, and a composite font and its
+// descendant font get the same tag as the descriptor.
+func retagPDFFonts(ctx *pdfcpu.Context, signature string) {
+	subsets := make(map[string][]string)
+	names := make(map[string]string)
+	for _, d := range pdfFontDescriptors(ctx) {
+		if name := d.NameEntry("FontName"); name != nil {
+			if m := subsetFontName.FindStringSubmatch(*name); m != nil && names[m[1]] == "" {
+				names[m[1]] = m[2]
+				subsets[m[2]] = append(subsets[m[2]], m[1])
+			}
+		}
+	}
+	tags := make(map[string]string)
+	for name, original := range subsets {
+		sort.Strings(original)
+		for k, tag := range original {
+			tags[tag] = subsetTag(signature, name, k)
+		}
+	}
+	retag := func(d pdfcpu.Dict, key string) {
+		if name := d.NameEntry(key); name != nil {
+			if m := subsetFontName.FindStringSubmatch(*name); m != nil && tags[m[1]] != "" {
+				d[key] = pdfcpu.Name(tags[m[1]] + "+" + m[2])
+			}
+		}
+	}
+	for _, d := range pdfFontDescriptors(ctx) {
+		retag(d, "FontName")
+	}
+	for _, d := range pdfFonts(ctx) {
+		retag(d, "BaseFont")
+	}
+}
+
+// pdfObjectKey is the value the objects are sorted by. Streams are keyed by
+// their content, so that their order can be checked in a leaked file.
+func pdfObjectKey(signature string, content [32]byte) [32]byte {
+	return sha256.Sum256(append([]byte(signature), content[:]...))
+}
+
+func pdfStreamDigest(sd pdfcpu.StreamDict) [32]byte {
+	if sd.Raw != nil {
+		return sha256.Sum256(sd.Raw)
+	}
+	return sha256.Sum256(sd.Content)
+}
+
+// renumberPDFObjects numbers the objects in the order of their keys.
+func renumberPDFObjects(ctx *pdfcpu.Context, signature string) {
+	type object struct {
+		number int
+		key    [32]byte
+	}
+	var objects []object
+	for number, entry := range ctx.Table {
+		if number == 0 || entry == nil || entry.Free || entry.Object == nil {
+			continue
+		}
+		var content [32]byte
+		switch o := entry.Object.(type) {
+		case pdfcpu.ObjectStreamDict, pdfcpu.XRefStreamDict:
+			// The writer creates its own.
+			continue
+		case pdfcpu.StreamDict:
+			content = pdfStreamDigest(o)
+		default:
+			content = sha256.Sum256([]byte(fmt.Sprintf("object %d", number)))
+		}
+		objects = append(objects, object{number, pdfObjectKey(signature, content)})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if c := compareKeys(objects[i].key, objects[j].key); c != 0 {
+			return c < 0
+		}
+		return objects[i].number < objects[j].number
+	})
+	// References to missing objects point past the last object, which reads
+	// as null.
+	numbers := make(map[int]int)
+	for i, o := range objects {
+		numbers[o.number] = i + 1
+	}
+	renumber := func(ref pdfcpu.IndirectRef) pdfcpu.IndirectRef {
+		number, found := numbers[ref.ObjectNumber.Value()]
+		if !found {
+			number = len(objects) + 1
+		}
+		return *pdfcpu.NewIndirectRef(number, 0)
+	}
+	zero, head, lastGeneration := 0, int64(0), 65535
+	table := map[int]*pdfcpu.XRefTableEntry{0: {Free: true, Offset: &head, Generation: &lastGeneration}}
+	for i, o := range objects {
+		entry := ctx.Table[o.number]
+		table[i+1] = &pdfcpu.XRefTableEntry{
+			Generation: &zero,
+			Object:     renumberPDFObject(entry.Object, renumber),
+			Valid:      entry.Valid,
+		}
+	}
+	ctx.Table = table
+	size := len(objects) + 1
+	ctx.Size = &size
+	for _, ref := range []**pdfcpu.IndirectRef{&ctx.Root, &ctx.Info} {
+		if *ref != nil {
+			renumbered := renumber(**ref)
+			*ref = &renumbered
+		}
+	}
+	if ctx.AdditionalStreams != nil {
+		streams := renumberPDFObject(*ctx.AdditionalStreams, renumber).(pdfcpu.Array)
+		ctx.AdditionalStreams = &streams
+	}
+	ctx.RootDict = nil
+}
+
+// renumberPDFObject returns a copy of the object with new references.
+func renumberPDFObject(o pdfcpu.Object, renumber func(pdfcpu.IndirectRef) pdfcpu.IndirectRef) pdfcpu.Object {
+	switch o := o.(type) {
+	case pdfcpu.IndirectRef:
+		return renumber(o)
+	case pdfcpu.Dict:
+		d := pdfcpu.Dict{}
+		for key, value := range o {
+			d[key] = renumberPDFObject(value, renumber)
+		}
+		return d
+	case pdfcpu.Array:
+		a := make(pdfcpu.Array, len(o))
+		for i, value := range o {
+			a[i] = renumberPDFObject(value, renumber)
+		}
+		return a
+	case pdfcpu.StreamDict:
+		o.Dict = renumberPDFObject(o.Dict, renumber).(pdfcpu.Dict)
+		return o
+	}
+	return o
+}
+
+func compareKeys(a, b [32]byte) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// pdfStructure is what the detection needs of a leaked file: the subset
+// fonts and the streams in the order of their numbers.
+type pdfStructure struct {
+	subsets [][2]string
+	streams [][32]byte
+}
+
+func observePDFStructure(file string) *pdfStructure {
+	ctx, err := readPDFContext(file)
+	if err != nil {
+		return nil
+	}
+	s := &pdfStructure{}
+	seen := make(map[string]bool)
+	for _, d := range pdfFontDescriptors(ctx) {
+		if name := d.NameEntry("FontName"); name != nil {
+			if m := subsetFontName.FindStringSubmatch(*name); m != nil && !seen[*name] {
+				seen[*name] = true
+				s.subsets = append(s.subsets, [2]string{m[1], m[2]})
+			}
+		}
+	}
+	var numbers []int
+	for number, entry := range ctx.Table {
+		if entry != nil && !entry.Free {
+			if _, ok := entry.Object.(pdfcpu.StreamDict); ok {
+				numbers = append(numbers, number)
+			}
+		}
+	}
+	sort.Ints(numbers)
+	for _, number := range numbers {
+		s.streams = append(s.streams, pdfStreamDigest(ctx.Table[number].Object.(pdfcpu.StreamDict)))
+	}
+	return s
+}
+
+// subsetMatches returns the number of subset fonts and the number of them
+// that have a tag of the recipient.
+func (s *pdfStructure) subsetMatches(signature string) (int, int) {
+	if s == nil {
+		return 0, 0
+	}
+	matched := 0
+	for _, subset := range s.subsets {
+		for k := 0; k < maxSubsetsPerFont; k++ {
+			if subsetTag(signature, subset[1], k) == subset[0] {
+				matched++
+				break
+			}
+		}
+	}
+	return len(s.subsets), matched
+}
+
+// orderScore returns the number of streams and the share of neighbouring
+// streams that are in the order of the recipient's keys. It's close to 1 for
+// the recipient's copy and around 0.5 for other files.
+func (s *pdfStructure) orderScore(signature string) (int, float64) {
+	if s == nil {
+		return 0, 0
+	}
+	pairs, ordered := 0, 0
+	for i := 1; i < len(s.streams); i++ {
+		c := compareKeys(pdfObjectKey(signature, s.streams[i-1]), pdfObjectKey(signature, s.streams[i]))
+		if c != 0 {
+			pairs++
+		}
+		if c < 0 {
+			ordered++
+		}
+	}
+	if pairs < minOrderPairs {
+		return len(s.streams), 0
+	}
+	return len(s.streams), float64(ordered) / float64(pairs)
+}
+
+// minOrderScore returns the score that a recipient needs. For any other
+// recipient, the ordered neighbours are the ascents of a random permutation,
+// whose chances are given by the Eulerian numbers. With more pairs than
+// maxExactOrderPairs, minOrderShare is far beyond the chance of any number of
+// recipients.
+func (s *pdfStructure) minOrderScore(recipients int) float64 {
+	if s == nil {
+		return minOrderShare
+	}
+	pairs := 0
+	for i := 1; i < len(s.streams); i++ {
+		if s.streams[i-1] != s.streams[i] {
+			pairs++
+		}
+	}
+	if pairs < minOrderPairs || pairs > maxExactOrderPairs {
+		return minOrderShare
+	}
+	if recipients < 1 {
+		recipients = 1
+	}
+	// chances[k] is the chance of k ascents in a permutation of n items.
+	chances := []float64{1}
+	for n := 2; n <= pairs+1; n++ {
+		next := make([]float64, n)
+		for k := range next {
+			if k < n-1 {
+				next[k] += float64(k+1) * chances[k]
+			}
+			if k > 0 {
+				next[k] += float64(n-k) * chances[k-1]
+			}
+			next[k] /= float64(n)
+		}
+		chances = next
+	}
+	needed, tail := pairs+1, 0.0
+	for k := pairs; k >= 0; k-- {
+		tail += chances[k]
+		if tail > maxOrderFalseMatch/float64(recipients) {
+			break
+		}
+		needed = k
+	}
+	return math.Max(minOrderShare, float64(needed)/float64(pairs))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestOrderScoreRecipients(t *testing.T) {
+	s := &pdfStructure{}
+	for i := 0; i < 11; i++ {
+		s.streams = append(s.streams, sha256.Sum256([]byte(fmt.Sprint("stream", i))))
+	}
+	// 10 pairs: 2037 of the 11! orders have 9 or 10 ascents, 152637 have 8.
+	if score := s.minOrderScore(1); score != 0.9 {
+		t.Errorf("one recipient needs %.2f", score)
+	}
+	if score := s.minOrderScore(1000); score != 1 {
+		t.Errorf("1000 recipients need %.2f", score)
+	}
+	signature := signaturePrefix + uuid.NewSHA1(uuid.NameSpaceOID, []byte("recipient")).String()
+	sort.Slice(s.streams, func(i, j int) bool {
+		return compareKeys(pdfObjectKey(signature, s.streams[i]), pdfObjectKey(signature, s.streams[j])) < 0
+	})
+	recipients := 20000
+	threshold := s.minOrderScore(recipients)
+	if _, score := s.orderScore(signature); score < threshold {
+		t.Errorf("the recipient scored %.2f, needs %.2f", score, threshold)
+	}
+	matched := 0
+	for i := 0; i < recipients; i++ {
+		other := signaturePrefix + uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprint(i))).String()
+		if _, score := s.orderScore(other); score >= threshold {
+			matched++
+		}
+	}
+	if matched > 0 {
+		t.Errorf("%d of %d other recipients matched", matched, recipients)
+	}
+}
+
+func TestOrderScoreChances(t *testing.T) {
+	// From maxExactOrderPairs on, minOrderShare is enough for any project.
+	s := &pdfStructure{}
+	for i := 0; i < 2*maxExactOrderPairs; i++ {
+		s.streams = append(s.streams, sha256.Sum256([]byte(fmt.Sprint("stream", i))))
+	}
+	if score := s.minOrderScore(1000000); score != minOrderShare {
+		t.Errorf("%d pairs need %.2f", len(s.streams)-1, score)
+	}
+	s.streams = s.streams[:maxExactOrderPairs+1]
+	if score := s.minOrderScore(1000000); math.Abs(score-minOrderShare) > 1e-9 {
+		t.Errorf("%d pairs need %.2f", len(s.streams)-1, score)
+	}
+}
@@ -0,0 +1,805 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/font"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// The text of a PDF file is read from the content streams of its pages and
+// of the forms they draw, the way pdfcpu stamps watermarks. Glyph codes are
+// mapped to text with the ToUnicode map of the font, or with the encoding of
+// simple fonts. The position of every glyph on the page is tracked as well,
+// with the text state and the glyph widths of the fonts.
+
+const pdfMaxFormDepth = 8
+
+// pdfFont is the text mapping and the glyph widths of a font, in text space
+// units. known is false for fonts whose text can't be read.
+type pdfFont struct {
+	fontUnicode
+	known        bool
+	widths       map[int]float64
+	defaultWidth float64
+}
+
+// pdfMatrix is a transformation matrix [a b c d e f].
+type pdfMatrix [6]float64
+
+var identityMatrix = pdfMatrix{1, 0, 0, 1, 0, 0}
+
+// multiply returns the transformation m followed by n.
+func (m pdfMatrix) multiply(n pdfMatrix) pdfMatrix {
+	return pdfMatrix{
+		m[0]*n[0] + m[1]*n[2], m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2], m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4], m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func (m pdfMatrix) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+func translateMatrix(x, y float64) pdfMatrix {
+	return pdfMatrix{1, 0, 0, 1, x, y}
+}
+
+// pdfTextState is the part of the graphics state that places text.
+type pdfTextState struct {
+	ctm         pdfMatrix
+	font        *pdfFont
+	fontSize    float64
+	charSpacing float64
+	wordSpacing float64
+	scale       float64
+	leading     float64
+	rise        float64
+}
+
+// pdfGlyph is a character of a page and the position of its origin.
+type pdfGlyph struct {
+	text string
+	x, y float64
+}
+
+// pdfTextRun is a text showing operator of a page content stream. start and
+// end are the offsets of its operands and of the end of the operator, glyphs
+// the range of the glyphs it draws. positioned is set for the first operator
+// after the text position was set.
+type pdfTextRun struct {
+	start, end int
+	glyphs     [2]int
+	positioned bool
+	state      pdfTextState
+	textMatrix pdfMatrix
+}
+
+// pdfTextExtractor reads the text of the pages. The text of optional content
+// that is hidden when the document is opened goes to hiddenText instead, like
+// viewers leave it out.
+type pdfTextExtractor struct {
+	ctx          *pdfcpu.Context
+	fonts        map[int]*pdfFont
+	text         strings.Builder
+	glyphs       []pdfGlyph
+	runs         []pdfTextRun
+	hiddenGroups map[int]bool
+	hidden       int
+	hiddenText   strings.Builder
+}
+
+func newPDFTextExtractor(ctx *pdfcpu.Context) *pdfTextExtractor {
+	return &pdfTextExtractor{ctx: ctx, fonts: make(map[int]*pdfFont), hiddenGroups: hiddenContentGroups(ctx)}
+}
+
+// output returns where the text that is shown now goes.
+func (e *pdfTextExtractor) output() *strings.Builder {
+	if e.hidden > 0 {
+		return &e.hiddenText
+	}
+	return &e.text
+}
+
+func (e *pdfTextExtractor) isHiddenGroup(o pdfcpu.Object) bool {
+	ref, ok := o.(pdfcpu.IndirectRef)
+	return ok && e.hiddenGroups[ref.ObjectNumber.Value()]
+}
+
+// extractPDFText returns the text of each page of a PDF file.
+func extractPDFText(file string) ([]string, error) {
+	var pages []string
+	err := processPDFPages(file, func(e *pdfTextExtractor, page int, content []byte) {
+		pages = append(pages, e.text.String())
+	})
+	return pages, err
+}
+
+// extractPDFHiddenText returns the text of the hidden optional content of
+// each page of a PDF file.
+func extractPDFHiddenText(file string) ([]string, error) {
+	var pages []string
+	err := processPDFPages(file, func(e *pdfTextExtractor, page int, content []byte) {
+		pages = append(pages, e.hiddenText.String())
+	})
+	return pages, err
+}
+
+// extractPDFGlyphs returns the glyphs of each page of a PDF file.
+func extractPDFGlyphs(file string) ([][]pdfGlyph, error) {
+	var pages [][]pdfGlyph
+	err := processPDFPages(file, func(e *pdfTextExtractor, page int, content []byte) {
+		pages = append(pages, e.glyphs)
+	})
+	return pages, err
+}
+
+// processPDFPages runs the content of every page and calls done with the
+// results of the page.
+func processPDFPages(file string, done func(e *pdfTextExtractor, page int, content []byte)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ctx, err := api.ReadContext(f, pdfcpu.NewDefaultConfiguration())
+	if err != nil {
+		return err
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return err
+	}
+	e := newPDFTextExtractor(ctx)
+	for i := 1; i <= ctx.PageCount; i++ {
+		content, err := e.processPage(i)
+		if err != nil {
+			return err
+		}
+		done(e, i, content)
+	}
+	return nil
+}
+
+// processPage runs the content of a page and returns it.
+func (e *pdfTextExtractor) processPage(page int) ([]byte, error) {
+	d, _, attrs, err := e.ctx.PageDict(page, false)
+	if err != nil {
+		return nil, err
+	}
+	content, err := pdfPageContent(e.ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	e.text.Reset()
+	e.hiddenText.Reset()
+	e.hidden = 0
+	e.glyphs = nil
+	e.runs = nil
+	e.processContent(content, attrs.Resources, 0, identityMatrix)
+	return content, nil
+}
+
+// pdfPageContent returns the content of a page. The streams of a page are
+// joined with a line break, since a token may end at the end of a stream.
+func pdfPageContent(ctx *pdfcpu.Context, page pdfcpu.Dict) ([]byte, error) {
+	o, err := ctx.Dereference(page["Contents"])
+	if err != nil || o == nil {
+		return nil, err
+	}
+	streams := pdfcpu.Array{o}
+	if array, ok := o.(pdfcpu.Array); ok {
+		streams = array
+	}
+	var content []byte
+	for _, o := range streams {
+		sd, _, err := ctx.DereferenceStreamDict(o)
+		if err != nil {
+			return nil, err
+		}
+		if sd == nil {
+			continue
+		}
+		if err := sd.Decode(); err != nil {
+			return nil, err
+		}
+		content = append(append(content, sd.Content...), '\n')
+	}
+	return content, nil
+}
+
+// processContent runs the text operators of a content stream.
+func (e *pdfTextExtractor) processContent(content []byte, resources pdfcpu.Dict, depth int, ctm pdfMatrix) {
+	var (
+		operands     []pdfToken
+		operandStart int
+		states       []pdfTextState
+		marked       []bool
+	)
+	state := pdfTextState{ctm: ctm, scale: 1}
+	textMatrix, lineMatrix := identityMatrix, identityMatrix
+	positioned := false
+	nextLine := func(x, y float64) {
+		lineMatrix = translateMatrix(x, y).multiply(lineMatrix)
+		textMatrix = lineMatrix
+		positioned = true
+	}
+	lexer := &pdfLexer{data: content}
+	for {
+		lexer.skipWhitespace()
+		offset := lexer.pos
+		token, ok := lexer.next()
+		if !ok {
+			for _, hidden := range marked {
+				if hidden {
+					e.hidden--
+				}
+			}
+			return
+		}
+		if token.kind != pdfOperator {
+			if len(operands) == 0 {
+				operandStart = offset
+			}
+			operands = append(operands, token)
+			continue
+		}
+		numbers := pdfNumbers(operands)
+		run := pdfTextRun{start: operandStart, end: lexer.pos, glyphs: [2]int{len(e.glyphs), len(e.glyphs)}, positioned: positioned, state: state, textMatrix: textMatrix}
+		if len(operands) == 0 {
+			run.start = offset
+		}
+		switch token.text {
+		case "q":
+			states = append(states, state)
+		case "Q":
+			if len(states) > 0 {
+				state, states = states[len(states)-1], states[:len(states)-1]
+			}
+		case "cm":
+			if len(numbers) == 6 {
+				state.ctm = pdfMatrix{numbers[0], numbers[1], numbers[2], numbers[3], numbers[4], numbers[5]}.multiply(state.ctm)
+			}
+		case "BT":
+			textMatrix, lineMatrix = identityMatrix, identityMatrix
+			positioned = true
+		case "Tf":
+			if len(operands) >= 2 && operands[len(operands)-2].kind == pdfName {
+				state.font = e.font(resources, operands[len(operands)-2].text)
+				state.fontSize = operands[len(operands)-1].number
+			}
+		case "Tc", "Tw", "Tz", "TL", "Ts":
+			if len(numbers) == 1 {
+				switch token.text {
+				case "Tc":
+					state.charSpacing = numbers[0]
+				case "Tw":
+					state.wordSpacing = numbers[0]
+				case "Tz":
+					state.scale = numbers[0] / 100
+				case "TL":
+					state.leading = numbers[0]
+				case "Ts":
+					state.rise = numbers[0]
+				}
+			}
+		case "Td", "TD":
+			if len(numbers) == 2 {
+				if token.text == "TD" {
+					state.leading = -numbers[1]
+				}
+				nextLine(numbers[0], numbers[1])
+			}
+			e.output().WriteString("\n")
+		case "Tm":
+			if len(numbers) == 6 {
+				lineMatrix = pdfMatrix{numbers[0], numbers[1], numbers[2], numbers[3], numbers[4], numbers[5]}
+				textMatrix = lineMatrix
+				positioned = true
+			}
+			e.output().WriteString("\n")
+		case "T*":
+			nextLine(0, -state.leading)
+			e.output().WriteString("\n")
+		case "ET":
+			e.output().WriteString("\n")
+		case "Tj", "'", "\"":
+			if token.text == "\"" && len(numbers) == 3 {
+				state.wordSpacing, state.charSpacing = numbers[0], numbers[1]
+			}
+			if token.text != "Tj" {
+				nextLine(0, -state.leading)
+				e.output().WriteString("\n")
+			}
+			if len(operands) > 0 && operands[len(operands)-1].kind == pdfString {
+				e.show(&state, &textMatrix, operands[len(operands)-1].text)
+			}
+			positioned = false
+		case "TJ":
+			if len(operands) > 0 && operands[len(operands)-1].kind == pdfArray {
+				for _, element := range operands[len(operands)-1].elements {
+					if element.kind == pdfNumber {
+						if element.number < -200 {
+							e.output().WriteString(" ")
+						}
+						textMatrix = translateMatrix(-element.number/1000*state.fontSize*state.scale, 0).multiply(textMatrix)
+					} else if element.kind == pdfString {
+						e.show(&state, &textMatrix, element.text)
+					}
+				}
+			}
+			positioned = false
+		case "Do":
+			if len(operands) > 0 && operands[len(operands)-1].kind == pdfName && depth < pdfMaxFormDepth {
+				e.processForm(resources, operands[len(operands)-1].text, depth, state.ctm)
+			}
+		case "BMC", "BDC":
+			hidden := token.text == "BDC" && len(operands) == 2 && operands[0].kind == pdfName && operands[0].text == "OC" &&
+				operands[1].kind == pdfName && e.isHiddenGroup(e.resourceDict(resources, "Properties")[operands[1].text])
+			if hidden {
+				e.hidden++
+			}
+			marked = append(marked, hidden)
+		case "EMC":
+			if len(marked) > 0 {
+				if marked[len(marked)-1] {
+					e.hidden--
+				}
+				marked = marked[:len(marked)-1]
+			}
+		case "BI":
+			lexer.skipInlineImage()
+		}
+		if depth == 0 && (token.text == "Tj" || token.text == "TJ") {
+			run.glyphs[1] = len(e.glyphs)
+			e.runs = append(e.runs, run)
+		}
+		operands = operands[:0]
+	}
+}
+
+// pdfNumbers returns the operands if all of them are numbers.
+func pdfNumbers(operands []pdfToken) []float64 {
+	var numbers []float64
+	for _, operand := range operands {
+		if operand.kind != pdfNumber {
+			return nil
+		}
+		numbers = append(numbers, operand.number)
+	}
+	return numbers
+}
+
+// show adds the glyphs of a string and moves the text matrix past them.
+func (e *pdfTextExtractor) show(state *pdfTextState, textMatrix *pdfMatrix, s string) {
+	codeLength := 1
+	if state.font != nil {
+		codeLength = state.font.codeLength
+	}
+	for i := 0; i+codeLength <= len(s); i += codeLength {
+		code := 0
+		for _, c := range []byte(s[i : i+codeLength]) {
+			code = code<<8 | int(c)
+		}
+		text := state.font.decode(s[i : i+codeLength])
+		e.output().WriteString(text)
+		x, y := textMatrix.multiply(state.ctm).apply(0, state.rise)
+		if text != "" && e.hidden == 0 {
+			e.glyphs = append(e.glyphs, pdfGlyph{text, x, y})
+		}
+		advance := state.font.width(code)*state.fontSize + state.charSpacing
+		if code == ' ' && codeLength == 1 {
+			advance += state.wordSpacing
+		}
+		*textMatrix = translateMatrix(advance*state.scale, 0).multiply(*textMatrix)
+	}
+}
+
+// processForm runs the content of a form XObject with its own resources.
+func (e *pdfTextExtractor) processForm(resources pdfcpu.Dict, name string, depth int, ctm pdfMatrix) {
+	xObjects := e.resourceDict(resources, "XObject")
+	if xObjects == nil {
+		return
+	}
+	form, _, err := e.ctx.DereferenceStreamDict(xObjects[name])
+	if err != nil || form == nil || form.Subtype() == nil || *form.Subtype() != "Form" {
+		return
+	}
+	if err := form.Decode(); err != nil {
+		return
+	}
+	formResources := resources
+	if o, found := form.Find("Resources"); found {
+		if d, err := e.ctx.DereferenceDict(o); err == nil && d != nil {
+			formResources = d
+		}
+	}
+	if matrix, err := e.ctx.DereferenceArray(form.Dict["Matrix"]); err == nil && len(matrix) == 6 {
+		var m pdfMatrix
+		for i, o := range matrix {
+			m[i] = pdfNumberValue(o)
+		}
+		ctm = m.multiply(ctm)
+	}
+	if e.isHiddenGroup(form.Dict["OC"]) {
+		e.hidden++
+		defer func() { e.hidden-- }()
+	}
+	e.output().WriteString("\n")
+	e.processContent(form.Content, formResources, depth+1, ctm)
+}
+
+func pdfNumberValue(o pdfcpu.Object) float64 {
+	switch o := o.(type) {
+	case pdfcpu.Integer:
+		return float64(o.Value())
+	case pdfcpu.Float:
+		return o.Value()
+	}
+	return 0
+}
+
+func (e *pdfTextExtractor) resourceDict(resources pdfcpu.Dict, key string) pdfcpu.Dict {
+	if resources == nil {
+		return nil
+	}
+	o, found := resources.Find(key)
+	if !found {
+		return nil
+	}
+	d, err := e.ctx.DereferenceDict(o)
+	if err != nil {
+		return nil
+	}
+	return d
+}
+
+// font returns the text mapping of a font resource. Fonts are cached by
+// object number, since pages usually share them.
+func (e *pdfTextExtractor) font(resources pdfcpu.Dict, name string) *pdfFont {
+	fonts := e.resourceDict(resources, "Font")
+	if fonts == nil {
+		return nil
+	}
+	o := fonts[name]
+	objectNumber := -1
+	if ref, ok := o.(pdfcpu.IndirectRef); ok {
+		objectNumber = ref.ObjectNumber.Value()
+		if font, found := e.fonts[objectNumber]; found {
+			return font
+		}
+	}
+	d, err := e.ctx.DereferenceDict(o)
+	if err != nil || d == nil {
+		return nil
+	}
+	mapping, known := readFontUnicode(e.ctx, d)
+	if mapping.codeLength < 1 {
+		mapping.codeLength = 1
+		if subtype := d.Subtype(); subtype != nil && *subtype == "Type0" {
+			mapping.codeLength = 2
+		}
+	}
+	font := &pdfFont{fontUnicode: mapping, known: known}
+	font.widths, font.defaultWidth = readFontWidths(e.ctx, d)
+	if objectNumber >= 0 {
+		e.fonts[objectNumber] = font
+	}
+	return font
+}
+
+// readFontWidths returns the glyph widths of a font in text space units: the
+// W array of the descendant font of composite fonts, and the Widths array of
+// simple fonts, or the metrics of the standard fonts.
+func readFontWidths(ctx *pdfcpu.Context, d pdfcpu.Dict) (map[int]float64, float64) {
+	widths := make(map[int]float64)
+	subtype := d.Subtype()
+	if subtype != nil && *subtype == "Type0" {
+		descendants, _ := ctx.DereferenceArray(d["DescendantFonts"])
+		if len(descendants) == 0 {
+			return widths, 1
+		}
+		descendant, err := ctx.DereferenceDict(descendants[0])
+		if err != nil || descendant == nil {
+			return widths, 1
+		}
+		defaultWidth := 1000.0
+		if o, err := ctx.Dereference(descendant["DW"]); err == nil && o != nil {
+			defaultWidth = pdfNumberValue(o)
+		}
+		w, _ := ctx.DereferenceArray(descendant["W"])
+		for i := 0; i+1 < len(w); {
+			first := int(pdfNumberValue(w[i]))
+			if list, err := ctx.DereferenceArray(w[i+1]); err == nil && list != nil {
+				for j, o := range list {
+					widths[first+j] = pdfNumberValue(o) / 1000
+				}
+				i += 2
+				continue
+			}
+			if i+2 >= len(w) {
+				break
+			}
+			last := int(pdfNumberValue(w[i+1]))
+			for code := first; code <= last && code-first < 0x10000; code++ {
+				widths[code] = pdfNumberValue(w[i+2]) / 1000
+			}
+			i += 3
+		}
+		return widths, defaultWidth / 1000
+	}
+	unit := 0.001
+	if subtype != nil && *subtype == "Type3" {
+		if matrix, err := ctx.DereferenceArray(d["FontMatrix"]); err == nil && len(matrix) == 6 {
+			unit = pdfNumberValue(matrix[0])
+		}
+	}
+	defaultWidth := 0.0
+	if descriptor, err := ctx.DereferenceDict(d["FontDescriptor"]); err == nil && descriptor != nil {
+		if o, err := ctx.Dereference(descriptor["MissingWidth"]); err == nil && o != nil {
+			defaultWidth = pdfNumberValue(o) * unit
+		}
+	}
+	list, _ := ctx.DereferenceArray(d["Widths"])
+	if list == nil {
+		if name := d.NameEntry("BaseFont"); name != nil && font.IsCoreFont(*name) {
+			for code := 0; code < 0x100; code++ {
+				widths[code] = float64(font.CharWidth(*name, rune(code))) / 1000
+			}
+		}
+		return widths, defaultWidth
+	}
+	first := 0
+	if i := d.IntEntry("FirstChar"); i != nil {
+		first = *i
+	}
+	for i, o := range list {
+		widths[first+i] = pdfNumberValue(o) * unit
+	}
+	return widths, defaultWidth
+}
+
+// width returns the width of a glyph. Text without a font is measured with
+// an average width.
+func (font *pdfFont) width(code int) float64 {
+	if font == nil {
+		return 0.5
+	}
+	if w, found := font.widths[code]; found {
+		return w
+	}
+	return font.defaultWidth
+}
+
+// decode maps the codes of a string to text. Text without a font is read as
+// Windows-1252.
+func (font *pdfFont) decode(s string) string {
+	if font == nil {
+		var b strings.Builder
+		for i := 0; i < len(s); i++ {
+			b.WriteRune(charmap.Windows1252.DecodeByte(s[i]))
+		}
+		return b.String()
+	}
+	if !font.known {
+		return ""
+	}
+	var b strings.Builder
+	for i := 0; i+font.codeLength <= len(s); i += font.codeLength {
+		code := 0
+		for _, c := range []byte(s[i : i+font.codeLength]) {
+			code = code<<8 | int(c)
+		}
+		b.WriteString(font.text[code])
+	}
+	return b.String()
+}
+
+type pdfTokenKind int
+
+const (
+	pdfOperator pdfTokenKind = iota
+	pdfNumber
+	pdfString
+	pdfName
+	pdfArray
+	pdfDict
+	pdfOther
+)
+
+type pdfToken struct {
+	kind     pdfTokenKind
+	text     string
+	number   float64
+	elements []pdfToken
+}
+
+// pdfLexer reads the tokens of a content stream or a CMap.
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func (l *pdfLexer) skipWhitespace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		} else if !isPDFWhitespace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+func (l *pdfLexer) next() (pdfToken, bool) {
+	l.skipWhitespace()
+	if l.pos >= len(l.data) {
+		return pdfToken{}, false
+	}
+	switch c := l.data[l.pos]; {
+	case c == '(':
+		return pdfToken{kind: pdfString, text: l.literalString()}, true
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		l.pos += 2
+		for {
+			token, ok := l.next()
+			if !ok || token.kind == pdfOther && token.text == ">>" {
+				return pdfToken{kind: pdfDict}, true
+			}
+		}
+	case c == '<':
+		end := bytes.IndexByte(l.data[l.pos:], '>')
+		if end < 0 {
+			end = len(l.data) - l.pos
+		}
+		digits := strings.Map(func(r rune) rune {
+			if isPDFWhitespace(byte(r)) {
+				return -1
+			}
+			return r
+		}, string(l.data[l.pos+1:l.pos+end]))
+		if len(digits)%2 == 1 {
+			digits += "0"
+		}
+		decoded, _ := hex.DecodeString(digits)
+		l.pos += end + 1
+		return pdfToken{kind: pdfString, text: string(decoded)}, true
+	case c == '>' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '>':
+		l.pos += 2
+		return pdfToken{kind: pdfOther, text: ">>"}, true
+	case c == '[':
+		l.pos++
+		array := pdfToken{kind: pdfArray}
+		for {
+			token, ok := l.next()
+			if !ok || token.kind == pdfOther && token.text == "]" {
+				return array, true
+			}
+			array.elements = append(array.elements, token)
+		}
+	case c == ']' || c == '{' || c == '}' || c == '>' || c == ')':
+		l.pos++
+		return pdfToken{kind: pdfOther, text: string(c)}, true
+	case c == '/':
+		l.pos++
+		return pdfToken{kind: pdfName, text: l.name()}, true
+	}
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFWhitespace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	word := string(l.data[start:l.pos])
+	if number, err := strconv.ParseFloat(word, 64); err == nil {
+		return pdfToken{kind: pdfNumber, number: number}, true
+	}
+	return pdfToken{kind: pdfOperator, text: word}, true
+}
+
+func (l *pdfLexer) name() string {
+	var b strings.Builder
+	for l.pos < len(l.data) && !isPDFWhitespace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		c := l.data[l.pos]
+		if c == '#' && l.pos+2 < len(l.data) {
+			if value, err := strconv.ParseUint(string(l.data[l.pos+1:l.pos+3]), 16, 8); err == nil {
+				b.WriteByte(byte(value))
+				l.pos += 3
+				continue
+			}
+		}
+		b.WriteByte(c)
+		l.pos++
+	}
+	return b.String()
+}
+
+func (l *pdfLexer) literalString() string {
+	var b strings.Builder
+	depth := 0
+	for l.pos++; l.pos < len(l.data); l.pos++ {
+		c := l.data[l.pos]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				l.pos++
+				return b.String()
+			}
+			depth--
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.data) {
+				return b.String()
+			}
+			c = l.data[l.pos]
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos+1 < len(l.data) && l.data[l.pos+1] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					value := 0
+					for i := 0; i < 3 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						value = value*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					l.pos--
+					c = byte(value)
+				}
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// skipInlineImage moves past the data of an inline image, which ends with EI
+// between whitespace.
+func (l *pdfLexer) skipInlineImage() {
+	start := bytes.Index(l.data[l.pos:], []byte("ID"))
+	if start < 0 {
+		l.pos = len(l.data)
+		return
+	}
+	for i := l.pos + start + 3; i+2 <= len(l.data); i++ {
+		if l.data[i] == 'E' && l.data[i+1] == 'I' && isPDFWhitespace(l.data[i-1]) && (i+2 == len(l.data) || isPDFWhitespace(l.data[i+2])) {
+			l.pos = i + 2
+			return
+		}
+	}
+	l.pos = len(l.data)
+}
+
+// pdfTextContains reports whether the text contains the signature. White
+// space is ignored, since the layout of the text may break it up.
+func pdfTextContains(text, signature string) bool {
+	compact := strings.Join(strings.Fields(text), "")
+	return strings.Contains(compact, signature)
+}
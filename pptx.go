@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Every slide and every notes page gets a text box of zero size that is placed
+// right of the slide canvas. It isn't visible in the editor, the slide show or
+// the exported PDF, but it is copied together with the slide, so slides that
+// are pasted into another presentation still carry the signature.
+const (
+	pptxNotesType      = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/notesSlide"
+	pptxNotesMasterRel = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/notesMaster"
+	pptxSlideType      = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/slide"
+	pptxNotesMime      = "application/vnd.openxmlformats-officedocument.presentationml.notesSlide+xml"
+	pptxSlideWidth     = 12192000
+	pptxShape          = `<p:sp><p:nvSpPr><p:cNvPr id="%d" name="TextBox %d"/><p:cNvSpPr txBox="1"/><p:nvPr/></p:nvSpPr>` +
+		`<p:spPr><a:xfrm><a:off x="%d" y="0"/><a:ext cx="0" cy="0"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom></p:spPr>` +
+		`<p:txBody><a:bodyPr wrap="none"/><a:lstStyle/><a:p><a:r><a:rPr lang="en-US" sz="100"/><a:t>%s</a:t></a:r></a:p></p:txBody></p:sp>`
+)
+
+var (
+	shapeIDPattern         = regexp.MustCompile(`cNvPr id="(\d+)"`)
+	slidePartPattern       = regexp.MustCompile(`^ppt/slides/slide(\d+)\.xml$`)
+	notesPartPattern       = regexp.MustCompile(`^ppt/notesSlides/notesSlide(\d+)\.xml$`)
+	slideWidthPattern      = regexp.MustCompile(`<p:sldSz[^>]*cx="(\d+)"`)
+	slideIDPattern         = regexp.MustCompile(`<p:sldId [^>]*r:id="([^"]+)"`)
+	relationshipRegexp     = regexp.MustCompile(`<Relationship [^>]*>`)
+	idAttributePattern     = regexp.MustCompile(`Id="([^"]+)"`)
+	typeAttributePattern   = regexp.MustCompile(`Type="([^"]+)"`)
+	targetAttributePattern = regexp.MustCompile(`Target="([^"]+)"`)
+)
+
+func addPptxSignature(file, signature string) {
+	err := addPptxShapes(file, signature)
+	if err != nil {
+		color.Red("Error occurred while adding the signature to the slides")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func addPptxShapes(file, signature string) error {
+	files, err := readZipFiles(file, func(name string) bool {
+		return strings.HasPrefix(name, "ppt/") || name == "[Content_Types].xml"
+	})
+	if err != nil {
+		return err
+	}
+	x := pptxSlideWidth
+	if match := slideWidthPattern.FindSubmatch(files["ppt/presentation.xml"]); match != nil {
+		x, _ = strconv.Atoi(string(match[1]))
+	}
+	x += 914400
+	addShape := func(part string) error {
+		content := string(files[part])
+		id := nextID(content, shapeIDPattern, 2)
+		content, ok := insertBefore(content, "</p:spTree>", fmt.Sprintf(pptxShape, id, id, x, signature))
+		if !ok {
+			return fmt.Errorf("%s doesn't contain a shape tree", part)
+		}
+		files[part] = []byte(content)
+		return nil
+	}
+
+	parts := make(map[string][]byte)
+	notesMaster := ""
+	notesNumber := 1
+	var slides []string
+	slideNumbers := make(map[string]int)
+	for name := range files {
+		if strings.HasPrefix(name, "ppt/notesMasters/") && strings.HasSuffix(name, ".xml") && (notesMaster == "" || name < notesMaster) {
+			notesMaster = name
+		}
+		if match := notesPartPattern.FindStringSubmatch(name); match != nil {
+			if n, _ := strconv.Atoi(match[1]); n >= notesNumber {
+				notesNumber = n + 1
+			}
+		}
+		if match := slidePartPattern.FindStringSubmatch(name); match != nil {
+			slides = append(slides, name)
+			slideNumbers[name], _ = strconv.Atoi(match[1])
+		}
+	}
+	// The new notes pages are numbered in the order of the slides, so that
+	// every copy gets the same parts.
+	sort.Slice(slides, func(i, j int) bool { return slideNumbers[slides[i]] < slideNumbers[slides[j]] })
+	contentTypes := string(files["[Content_Types].xml"])
+	for _, name := range slides {
+		if err := addShape(name); err != nil {
+			return err
+		}
+		parts[name] = files[name]
+
+		relsPart := relationshipsPart(name)
+		rels, found := files[relsPart]
+		if !found {
+			rels = []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\r\n" +
+				`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"></Relationships>`)
+		}
+		if notes := relationshipTarget(name, string(rels), pptxNotesType); notes != "" {
+			if _, found := files[notes]; found {
+				if err := addShape(notes); err != nil {
+					return err
+				}
+				parts[notes] = files[notes]
+			}
+			continue
+		}
+		if notesMaster == "" {
+			continue
+		}
+		notes := fmt.Sprintf("ppt/notesSlides/notesSlide%d.xml", notesNumber)
+		notesNumber++
+		newRels, _, err := addRelationship(string(rels), pptxNotesType, "../notesSlides/"+path.Base(notes))
+		if err != nil {
+			return err
+		}
+		parts[relsPart] = []byte(newRels)
+		if contentTypes, err = addContentTypeOverride(contentTypes, notes, pptxNotesMime); err != nil {
+			return err
+		}
+		parts[relationshipsPart(notes)] = []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\r\n" +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="` + pptxNotesMasterRel + `" Target="../notesMasters/` + path.Base(notesMaster) + `"/>` +
+			`<Relationship Id="rId2" Type="` + pptxSlideType + `" Target="../slides/` + path.Base(name) + `"/></Relationships>`)
+		files[notes] = []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\r\n" +
+			`<p:notes xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main">` +
+			`<p:cSld><p:spTree><p:nvGrpSpPr><p:cNvPr id="1" name=""/><p:cNvGrpSpPr/><p:nvPr/></p:nvGrpSpPr><p:grpSpPr/></p:spTree></p:cSld>` +
+			`<p:clrMapOvr><a:masterClrMapping/></p:clrMapOvr></p:notes>`)
+		if err := addShape(notes); err != nil {
+			return err
+		}
+		parts[notes] = files[notes]
+	}
+	if contentTypes != string(files["[Content_Types].xml"]) {
+		parts["[Content_Types].xml"] = []byte(contentTypes)
+	}
+	return writeOfficeParts(file, parts)
+}
+
+// relationshipsPart returns the name of the .rels part of a package part.
+func relationshipsPart(part string) string {
+	return path.Join(path.Dir(part), "_rels", path.Base(part)+".rels")
+}
+
+// relationshipTarget returns the part that the first relationship of the
+// given type points to.
+func relationshipTarget(part, rels, relationshipType string) string {
+	for _, relationship := range relationshipRegexp.FindAllString(rels, -1) {
+		match := typeAttributePattern.FindStringSubmatch(relationship)
+		if match != nil && match[1] == relationshipType {
+			return resolveTarget(part, relationship)
+		}
+	}
+	return ""
+}
+
+// relationshipTargets maps the relationship IDs of a .rels part to the parts
+// they point to.
+func relationshipTargets(part, rels string) map[string]string {
+	targets := make(map[string]string)
+	for _, relationship := range relationshipRegexp.FindAllString(rels, -1) {
+		if id := idAttributePattern.FindStringSubmatch(relationship); id != nil {
+			targets[id[1]] = resolveTarget(part, relationship)
+		}
+	}
+	return targets
+}
+
+func resolveTarget(part, relationship string) string {
+	match := targetAttributePattern.FindStringSubmatch(relationship)
+	if match == nil {
+		return ""
+	}
+	if strings.HasPrefix(match[1], "/") {
+		return strings.TrimPrefix(match[1], "/")
+	}
+	return path.Join(path.Dir(part), match[1])
+}
+
+// readPptxSlides returns the content of every slide together with its notes
+// page, keyed by the position of the slide in the presentation.
+func readPptxSlides(file string) map[int]string {
+	slides := make(map[int]string)
+	files, err := readZipFiles(file, func(name string) bool {
+		return strings.HasPrefix(name, "ppt/")
+	})
+	if err != nil {
+		return slides
+	}
+	positions := make(map[string]int)
+	presentation := "ppt/presentation.xml"
+	targets := relationshipTargets(presentation, string(files[relationshipsPart(presentation)]))
+	for i, match := range slideIDPattern.FindAllStringSubmatch(string(files[presentation]), -1) {
+		positions[targets[match[1]]] = i + 1
+	}
+	for name, content := range files {
+		match := slidePartPattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		position, found := positions[name]
+		if !found {
+			position, _ = strconv.Atoi(match[1])
+		}
+		slides[position] += string(content)
+		if notes := relationshipTarget(name, string(files[relationshipsPart(name)]), pptxNotesType); notes != "" {
+			slides[position] += string(files[notes])
+		}
+	}
+	return slides
+}
+
+// pptxSlidesWithSignature returns the positions of the slides that carry the
+// signature.
+func pptxSlidesWithSignature(slides map[int]string, signature string) []int {
+	var positions []int
+	for position, content := range slides {
+		if strings.Contains(content, signature) {
+			positions = append(positions, position)
+		}
+	}
+	sort.Ints(positions)
+	return positions
+}
+
+// numberRanges formats sorted numbers as a list like "1, 3, 5-7".
+func numberRanges(numbers []int) string {
+	var ranges []string
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+		switch {
+		case j == i:
+			ranges = append(ranges, strconv.Itoa(numbers[i]))
+		case j == i+1:
+			ranges = append(ranges, strconv.Itoa(numbers[i]), strconv.Itoa(numbers[j]))
+		default:
+			ranges = append(ranges, fmt.Sprintf("%d-%d", numbers[i], numbers[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ", ")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeTestZip(t *testing.T, file string, parts map[string]string) {
+	t.Helper()
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	for name := range parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := zip.NewWriter(f)
+	for _, name := range names {
+		entry, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Write([]byte(parts[name]))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPptxNotesOrder(t *testing.T) {
+	const tree = `<p:sld xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main"><p:cSld><p:spTree>` +
+		`<p:nvGrpSpPr><p:cNvPr id="1" name=""/></p:nvGrpSpPr></p:spTree></p:cSld></p:sld>`
+	parts := map[string]string{
+		"[Content_Types].xml":               `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"></Types>`,
+		"ppt/presentation.xml":              `<p:presentation><p:sldSz cx="9144000" cy="6858000"/></p:presentation>`,
+		"ppt/notesMasters/notesMaster1.xml": `<p:notesMaster/>`,
+	}
+	for i := 1; i <= 12; i++ {
+		parts[fmt.Sprintf("ppt/slides/slide%d.xml", i)] = tree
+	}
+	file := filepath.Join(t.TempDir(), "deck.pptx")
+	writeTestZip(t, file, parts)
+	if err := addPptxShapes(file, testSignature); err != nil {
+		t.Fatal(err)
+	}
+	files, err := readZipFiles(file, func(name string) bool { return strings.HasPrefix(name, "ppt/") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 12; i++ {
+		rels := string(files[fmt.Sprintf("ppt/slides/_rels/slide%d.xml.rels", i)])
+		if !strings.Contains(rels, fmt.Sprintf(`Target="../notesSlides/notesSlide%d.xml"`, i)) {
+			t.Errorf("slide %d: %s", i, rels)
+		}
+		if notes := string(files[fmt.Sprintf("ppt/notesSlides/notesSlide%d.xml", i)]); !strings.Contains(notes, testSignature) {
+			t.Errorf("notes page %d has no signature", i)
+		}
+	}
+}
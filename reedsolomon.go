@@ -0,0 +1,52 @@
+package main
+
+// Reed-Solomon codes over GF(256) with the polynomial x^8+x^4+x^3+x^2+1. Only
+// the encoder is needed: readings are compared with the codewords of the
+// recipients in the database, which corrects as many errors as a decoder.
+var gfExp, gfLog = func() ([512]byte, [256]byte) {
+	var exp [512]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+func gfMultiply(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// reedSolomonEncode returns the data followed by its parity bytes.
+func reedSolomonEncode(data []byte, parity int) []byte {
+	generator := []byte{1}
+	for i := 0; i < parity; i++ {
+		next := make([]byte, len(generator)+1)
+		for j, coefficient := range generator {
+			next[j] ^= coefficient
+			next[j+1] ^= gfMultiply(coefficient, gfExp[i])
+		}
+		generator = next
+	}
+	remainder := make([]byte, len(data)+parity)
+	copy(remainder, data)
+	for i := range data {
+		if factor := remainder[i]; factor != 0 {
+			for j, coefficient := range generator {
+				remainder[i+j] ^= gfMultiply(coefficient, factor)
+			}
+		}
+	}
+	return append(append([]byte{}, data...), remainder[len(data):]...)
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// When none of the signatures are left in a leaked file, it can still be
+// compared with the copies that were issued, which are kept in the files
+// folder of the project. First a perceptual comparison tells whether the
+// leaked file is the issued document at all: the hash of the DCT of a
+// thumbnail for images and the share of the phrases of the text for
+// documents. Then the copies are ranked by how much of what sets them apart
+// from each other is found in the leaked file: the pixels where they differ
+// for images and the words they don't all have for documents.
+const (
+	maxPerceptualDistance = 12
+	minTextSimilarity     = 0.5
+	minTextShingles       = 10
+	textShingleWords      = 3
+	minCopyScore          = 5.0
+	copyNoiseArea         = 4.0
+	maxCopyPixels         = 4000000
+	maxOtherCopyScore     = 0.5
+	minCopyDifference     = 1.0 / 1024
+)
+
+// copyRanking is the result of the comparison of a leaked file with the
+// issued copies. The copies are ordered from the closest one.
+type copyRanking struct {
+	similarity float64
+	names      []string
+	scores     []float64
+	confidence float64
+}
+
+// issuedCopyPath returns the path of the copy of a recipient. The database
+// has absolute paths, so the copy is looked up in the project folder when the
+// folder was moved.
+func issuedCopyPath(dbPath, name, path string) string {
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	return filepath.Join(filepath.Dir(dbPath), "files", name, filepath.Base(path))
+}
+
+// rankIssuedCopies compares a leaked file with the copies of the recipients.
+// It returns nil if the file doesn't look like the issued document.
+func rankIssuedCopies(file, dbPath string, targets []string) *copyRanking {
+	var names, paths []string
+	for _, target := range targets {
+		fields := strings.Split(target, ",")
+		if len(fields) < 5 {
+			continue
+		}
+		name := strings.ReplaceAll(fields[0], " ", "_")
+		names = append(names, name)
+		paths = append(paths, issuedCopyPath(dbPath, name, fields[4]))
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if leaked, width, height, ok := decodeImageFile(file); ok {
+		return rankImageCopies(leaked, width, height, names, paths)
+	}
+	if leaked := documentText(file); leaked != "" {
+		return rankTextCopies(leaked, names, paths)
+	}
+	return nil
+}
+
+// decodeImageFile decodes an image if the file is one Go can read and
+// returns its brightness. Images larger than maxCopyPixels are scaled down
+// to it, keeping their shape, so photos of any size can be compared.
+func decodeImageFile(file string) ([]float64, int, int, bool) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width < 8 || height < 8 {
+		return nil, 0, 0, false
+	}
+	luma := imageLuma(img)
+	if width*height > maxCopyPixels {
+		scale := math.Sqrt(float64(maxCopyPixels) / float64(width*height))
+		w, h := maxInt(int(float64(width)*scale), 8), maxInt(int(float64(height)*scale), 8)
+		luma, width, height = resizeLuma(luma, width, height, w, h), w, h
+	}
+	return luma, width, height, true
+}
+
+// rankImageCopies compares the brightness of the images. The copies and the
+// leaked image are scaled to the smaller of their sizes, the same way image
+// editors scale down. Every copy is scored by the correlation of what sets it
+// apart from the mean of the other copies with what sets the leaked image
+// apart from that mean. The score is the correlation in standard deviations
+// of the correlation of unrelated pictures, which is about one over the
+// square root of the number of independent patches of pixels. A copy is only
+// named if the other copies score near zero: the unmarked image is as far
+// from all of them and scores the same for every copy.
+func rankImageCopies(leaked []float64, leakedWidth, leakedHeight int, names, paths []string) *copyRanking {
+	luma, width, height := leaked, leakedWidth, leakedHeight
+	var copies [][]float64
+	var copyNames []string
+	for i, path := range paths {
+		img, w, h, ok := decodeImageFile(path)
+		if !ok {
+			continue
+		}
+		if len(copies) == 0 {
+			width, height = minInt(width, w), minInt(height, h)
+			luma = resizeLuma(luma, leakedWidth, leakedHeight, width, height)
+		}
+		copies = append(copies, resizeLuma(img, w, h, width, height))
+		copyNames = append(copyNames, names[i])
+	}
+	if len(copies) == 0 {
+		return nil
+	}
+	leakedHash := perceptualHash(luma, width, height)
+	distance := 64
+	for _, c := range copies {
+		distance = minInt(distance, bits.OnesCount64(leakedHash^perceptualHash(c, width, height)))
+	}
+	if distance > maxPerceptualDistance {
+		return nil
+	}
+	ranking := &copyRanking{similarity: 1 - float64(distance)/64}
+	if len(copies) == 1 {
+		ranking.names, ranking.scores, ranking.confidence = copyNames, []float64{0}, 1
+		return ranking
+	}
+	total := make([]float64, width*height)
+	for _, c := range copies {
+		for i, value := range c {
+			total[i] += value
+		}
+	}
+	patches := math.Sqrt(float64(width*height) / copyNoiseArea)
+	// Rounding leaves a tiny difference between copies that are the same.
+	tolerance := float64(width*height) * minCopyDifference * minCopyDifference
+	differ := false
+	for k, c := range copies {
+		var product, leakedEnergy, copyEnergy float64
+		for i := range c {
+			others := (total[i] - c[i]) / float64(len(copies)-1)
+			a, b := luma[i]-others, c[i]-others
+			product += a * b
+			leakedEnergy += a * a
+			copyEnergy += b * b
+		}
+		score := 0.0
+		if leakedEnergy > tolerance && copyEnergy > tolerance {
+			score = product / math.Sqrt(leakedEnergy*copyEnergy) * patches
+		}
+		differ = differ || copyEnergy > tolerance
+		ranking.names = append(ranking.names, copyNames[k])
+		ranking.scores = append(ranking.scores, score)
+	}
+	ranking.sort()
+	if !differ || ranking.scores[0] < minCopyScore {
+		return ranking
+	}
+	for _, score := range ranking.scores[1:] {
+		if math.Abs(score) > maxOtherCopyScore*ranking.scores[0] {
+			return ranking
+		}
+	}
+	// The difference of two scores has a deviation of the square root of two.
+	ranking.confidence = normalProbability((ranking.scores[0] - ranking.scores[1]) / math.Sqrt2)
+	return ranking
+}
+
+// rankTextCopies compares the text of the documents. The similarity is the
+// share of the phrases of the leaked text that are in the issued document,
+// with invisible characters removed and swapped letters restored, so a part
+// of a document is similar as well. The copies are scored by the number of
+// their words that are in the leaked text but not in all of the copies.
+func rankTextCopies(leaked string, names, paths []string) *copyRanking {
+	leakedShingles := textShingles(leaked)
+	if len(leakedShingles) < minTextShingles {
+		return nil
+	}
+	var copyNames []string
+	var copyWords []map[string]bool
+	similarity := 0.0
+	for i, path := range paths {
+		text := documentText(path)
+		if text == "" {
+			continue
+		}
+		shingles := textShingles(text)
+		found := 0
+		for shingle := range leakedShingles {
+			if shingles[shingle] {
+				found++
+			}
+		}
+		similarity = math.Max(similarity, float64(found)/float64(len(leakedShingles)))
+		copyNames = append(copyNames, names[i])
+		copyWords = append(copyWords, wordSet(text))
+	}
+	if similarity < minTextSimilarity {
+		return nil
+	}
+	// A word that only some copies have is counted, unless it's the original
+	// of a word with swapped letters, which is what a leaked text looks like
+	// after the letters are put back.
+	counts := make(map[string]int)
+	variants := make(map[string]map[string]bool)
+	for _, words := range copyWords {
+		for word := range words {
+			counts[word]++
+			original := restoreHomoglyphs(word)
+			if variants[original] == nil {
+				variants[original] = make(map[string]bool)
+			}
+			variants[original][word] = true
+		}
+	}
+	leakedWords := wordSet(leaked)
+	ranking := &copyRanking{similarity: similarity}
+	for k, words := range copyWords {
+		hits := 0
+		for word := range words {
+			original := restoreHomoglyphs(word)
+			if counts[word] < len(copyWords) && leakedWords[word] && (word != original || len(variants[original]) == 1) {
+				hits++
+			}
+		}
+		ranking.names = append(ranking.names, copyNames[k])
+		ranking.scores = append(ranking.scores, float64(hits))
+	}
+	ranking.sort()
+	if len(ranking.scores) == 1 {
+		ranking.confidence = 1
+	}
+	if len(ranking.scores) == 1 || ranking.scores[0] == ranking.scores[1] {
+		return ranking
+	}
+	// The words are counted like rare events, so the difference of two counts
+	// has a deviation of the square root of their sum.
+	first, second := ranking.scores[0], ranking.scores[1]
+	ranking.confidence = normalProbability((first - second) / math.Sqrt(first+second))
+	return ranking
+}
+
+// report lists the copies with their scores.
+func (r *copyRanking) report() string {
+	var parts []string
+	for i, name := range r.names {
+		parts = append(parts, fmt.Sprintf("%s %.1f", name, r.scores[i]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (r *copyRanking) sort() {
+	order := make([]int, len(r.names))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return r.scores[order[i]] > r.scores[order[j]] })
+	names, scores := make([]string, len(order)), make([]float64, len(order))
+	for i, k := range order {
+		names[i], scores[i] = r.names[k], r.scores[k]
+	}
+	r.names, r.scores = names, scores
+}
+
+func normalProbability(z float64) float64 {
+	return 0.5 * math.Erfc(-z/math.Sqrt2)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// resizeLuma scales an image down to a new size. Every new pixel is the mean
+// of the pixels it covers.
+func resizeLuma(luma []float64, width, height, w, h int) []float64 {
+	if w == width && h == height {
+		return luma
+	}
+	columns := resizeWeights(width, w)
+	rows := resizeWeights(height, h)
+	wide := make([]float64, width*h)
+	for y, weights := range rows {
+		for _, weight := range weights {
+			for x := 0; x < width; x++ {
+				wide[y*width+x] += luma[weight.index*width+x] * weight.value
+			}
+		}
+	}
+	resized := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x, weights := range columns {
+			for _, weight := range weights {
+				resized[y*w+x] += wide[y*width+weight.index] * weight.value
+			}
+		}
+	}
+	return resized
+}
+
+type resizeWeight struct {
+	index int
+	value float64
+}
+
+// resizeWeights returns the share of every old pixel in the new pixels along
+// one side of an image.
+func resizeWeights(from, to int) [][]resizeWeight {
+	scale := float64(from) / float64(to)
+	weights := make([][]resizeWeight, to)
+	for i := range weights {
+		start, end := float64(i)*scale, float64(i+1)*scale
+		for k := int(start); k < from && float64(k) < end; k++ {
+			overlap := math.Min(end, float64(k+1)) - math.Max(start, float64(k))
+			if overlap > 0 {
+				weights[i] = append(weights[i], resizeWeight{k, overlap / scale})
+			}
+		}
+	}
+	return weights
+}
+
+// perceptualHash returns the signs of the lowest frequencies of the DCT of a
+// 32x32 thumbnail of an image, compared with their median. It stays the same
+// when an image is recompressed, resized or slightly changed in color.
+func perceptualHash(luma []float64, width, height int) uint64 {
+	const size, low = 32, 8
+	small := resizeLuma(luma, width, height, size, size)
+	var coefficients []float64
+	for v := 0; v < low; v++ {
+		for u := 0; u < low; u++ {
+			sum := 0.0
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					sum += small[y*size+x] * math.Cos(math.Pi*float64(u)*(float64(x)+0.5)/size) * math.Cos(math.Pi*float64(v)*(float64(y)+0.5)/size)
+				}
+			}
+			coefficients = append(coefficients, sum)
+		}
+	}
+	sorted := append([]float64{}, coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	var hash uint64
+	for i, c := range coefficients {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+var xmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// documentText returns the text of a document for the comparison. Office and
+// OpenDocument files give the text of their XML parts.
+func documentText(file string) string {
+	extension := strings.ToLower(filepath.Ext(file))
+	switch {
+	case extension == ".pdf":
+		pages, err := extractPDFText(file)
+		if err != nil {
+			return ""
+		}
+		return strings.Join(pages, "\n")
+	case isOfficeFile(extension) || isODFFile(extension):
+		parts, err := readZipFiles(file, func(name string) bool { return strings.HasSuffix(name, ".xml") })
+		if err != nil {
+			return ""
+		}
+		var names []string
+		for name := range parts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var sb strings.Builder
+		for _, name := range names {
+			sb.WriteString(xmlTag.ReplaceAllString(string(parts[name]), " "))
+			sb.WriteString("\n")
+		}
+		return sb.String()
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil || !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+		return ""
+	}
+	return string(content)
+}
+
+// textShingles returns the phrases of a few words of a text, with the
+// letters that wholeaked changes put back.
+func textShingles(text string) map[string]bool {
+	normalized := strings.Map(func(r rune) rune {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return ' '
+		}
+		return unicode.ToLower(r)
+	}, restoreHomoglyphs(withoutZeroWidth(text)))
+	words := strings.Fields(normalized)
+	shingles := make(map[string]bool)
+	for i := 0; i+textShingleWords <= len(words); i++ {
+		shingles[strings.Join(words[i:i+textShingleWords], " ")] = true
+	}
+	return shingles
+}
+
+// wordSet returns the words of a text. The zero-width characters are left
+// out, since the copies that still have them are recognized by them.
+func wordSet(text string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.Fields(withoutZeroWidth(text)) {
+		words[word] = true
+	}
+	return words
+}
+
+func restoreHomoglyphs(text string) string {
+	return strings.Map(func(r rune) rune {
+		if latin, found := homoglyphLatin[r]; found {
+			return latin
+		}
+		return r
+	}, text)
+}
+
+func withoutZeroWidth(text string) string {
+	return strings.Map(func(r rune) rune {
+		for _, symbol := range zeroWidthSymbols {
+			if r == symbol {
+				return -1
+			}
+		}
+		return r
+	}, text)
+}
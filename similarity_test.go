@@ -0,0 +1,103 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestPNG(t *testing.T, file string, img image.Image) {
+	t.Helper()
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := encoder.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPhoto returns a picture larger than maxCopyPixels with blocks of
+// pixels made a little brighter or darker for every recipient, or the
+// unmarked picture for a negative recipient.
+func testPhoto(width, height int, recipient int64) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	rng := rand.New(rand.NewSource(recipient))
+	blocks := make([]float64, (width/32+1)*(height/32+1))
+	for i := range blocks {
+		if recipient >= 0 {
+			blocks[i] = float64(rng.Intn(2)*2-1) * 4
+		}
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := 128 + 60*math.Sin(float64(x)/90)*math.Cos(float64(y)/70)
+			value += blocks[(y/32)*(width/32+1)+x/32]
+			img.Pix[img.PixOffset(x, y)] = uint8(value)
+		}
+	}
+	return img
+}
+
+func TestRankLargeImages(t *testing.T) {
+	dir := t.TempDir()
+	width, height := 2400, 1800
+	var targets []string
+	for i, name := range []string{"Alice", "Bob", "Carol"} {
+		file := filepath.Join(dir, name+".png")
+		writeTestPNG(t, file, testPhoto(width, height, int64(i)))
+		targets = append(targets, name+",,,,"+file)
+	}
+	leaked := testPhoto(width, height, 1)
+	rng := rand.New(rand.NewSource(7))
+	for i := range leaked.Pix {
+		leaked.Pix[i] = uint8(math.Max(0, math.Min(255, float64(leaked.Pix[i])+rng.NormFloat64()*8)))
+	}
+	file := filepath.Join(dir, "leaked.png")
+	writeTestPNG(t, file, leaked)
+
+	luma, w, h, ok := decodeImageFile(file)
+	if !ok || w*h > maxCopyPixels || len(luma) != w*h || math.Abs(float64(w)/float64(h)-float64(width)/float64(height)) > 0.01 {
+		t.Fatalf("decoded a %dx%d image as %dx%d", width, height, w, h)
+	}
+	ranking := rankIssuedCopies(file, filepath.Join(dir, "db.csv"), targets)
+	if ranking == nil {
+		t.Fatal("the leaked image wasn't compared with the copies")
+	}
+	if ranking.names[0] != "Bob" || ranking.scores[0] < minCopyScore || ranking.confidence < 0.99 {
+		t.Errorf("ranked %v with scores %v", ranking.names, ranking.scores)
+	}
+
+	writeTestPNG(t, file, testPhoto(width, height, -1))
+	ranking = rankIssuedCopies(file, filepath.Join(dir, "db.csv"), targets)
+	if ranking == nil || ranking.confidence != 0 {
+		t.Errorf("the unmarked image was attributed: %+v", ranking)
+	}
+}
+
+func TestRankSameImages(t *testing.T) {
+	dir := t.TempDir()
+	// colors whose brightness isn't a whole number, as in GIF files
+	gray := testPhoto(640, 480, 1)
+	photo := image.NewRGBA(gray.Bounds())
+	for i, v := range gray.Pix {
+		photo.Pix[4*i], photo.Pix[4*i+1], photo.Pix[4*i+2], photo.Pix[4*i+3] = v, v/3, 255-v, 255
+	}
+	var targets []string
+	var file string
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		file = filepath.Join(dir, name+".png")
+		writeTestPNG(t, file, photo)
+		targets = append(targets, name+",,,,"+file)
+	}
+	ranking := rankIssuedCopies(file, filepath.Join(dir, "db.csv"), targets)
+	if ranking == nil || ranking.confidence != 0 {
+		t.Errorf("copies that are the same were told apart: %+v", ranking)
+	}
+}
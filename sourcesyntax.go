@@ -0,0 +1,592 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Trailing whitespace inside a string literal is part of the string, so the
+// source files are lexed to find the lines that end in code. Every language
+// gets its comments, strings, raw strings and character literals. Constructs
+// that can't be followed without a full parser, like heredocs, make the whole
+// file ineligible instead.
+type stringSyntax struct {
+	open, close string
+	escapes     bool // a backslash escapes the next character
+	doubled     bool // a doubled closing quote is part of the string
+	multiLine   bool
+	// A backslash before the closing quote is an escape in some dialects
+	// and not in others, so the end of the string is unknown.
+	backslashAmbiguous bool
+}
+
+type sourceSyntax struct {
+	lineComments   []string
+	blockComment   [2]string
+	nestedComments bool
+	strings        []stringSyntax // longer openers first
+	charLiterals   bool
+	regexLiterals  bool
+	rawStrings     func(line string, i int) (stringSyntax, bool)
+	// Code of template languages starts and ends with these markers, the
+	// text around it isn't code.
+	codeStart []string
+	codeEnd   string
+	// ambiguous reports whether a construct that isn't followed starts at
+	// the position, the file is skipped then.
+	ambiguous func(line string, i int) bool
+}
+
+var (
+	cStrings = []stringSyntax{
+		{open: `"`, close: `"`, escapes: true},
+	}
+	cBlockComment = [2]string{"/*", "*/"}
+)
+
+var sourceSyntaxes = map[string]*sourceSyntax{
+	".go": {
+		lineComments: []string{"//"},
+		blockComment: cBlockComment,
+		strings: []stringSyntax{
+			{open: "`", close: "`", multiLine: true},
+			{open: `"`, close: `"`, escapes: true},
+		},
+		charLiterals: true,
+	},
+	".c": {
+		lineComments: []string{"//"},
+		blockComment: cBlockComment,
+		strings:      cStrings,
+		charLiterals: true,
+		rawStrings:   cppRawString,
+	},
+	".cs": {
+		lineComments: []string{"//"},
+		blockComment: cBlockComment,
+		strings: []stringSyntax{
+			{open: `@$"`, close: `"`, doubled: true, multiLine: true},
+			{open: `$@"`, close: `"`, doubled: true, multiLine: true},
+			{open: `@"`, close: `"`, doubled: true, multiLine: true},
+			{open: `"`, close: `"`, escapes: true},
+		},
+		charLiterals: true,
+		rawStrings:   quoteRunString,
+	},
+	".java": {
+		lineComments: []string{"//"},
+		blockComment: cBlockComment,
+		strings: []stringSyntax{
+			{open: `"""`, close: `"""`, escapes: true, multiLine: true},
+			{open: `"`, close: `"`, escapes: true},
+		},
+		charLiterals: true,
+	},
+	".kt": {
+		lineComments: []string{"//"},
+		blockComment: cBlockComment,
+		strings: []stringSyntax{
+			{open: `"""`, close: `"""`, multiLine: true},
+			{open: `"`, close: `"`, escapes: true},
+		},
+		charLiterals: true,
+	},
+	".scala": {
+		lineComments:   []string{"//"},
+		blockComment:   cBlockComment,
+		nestedComments: true,
+		strings: []stringSyntax{
+			{open: `"""`, close: `"""`, multiLine: true},
+			{open: `"`, close: `"`, escapes: true},
+		},
+		charLiterals: true,
+	},
+	".swift": {
+		lineComments:   []string{"//"},
+		blockComment:   cBlockComment,
+		nestedComments: true,
+		strings: []stringSyntax{
+			{open: `"""`, close: `"""`, escapes: true, multiLine: true},
+			{open: `"`, close: `"`, escapes: true},
+		},
+		rawStrings: swiftRawString,
+	},
+	".rs": {
+		lineComments:   []string{"//"},
+		blockComment:   cBlockComment,
+		nestedComments: true,
+		strings: []stringSyntax{
+			{open: `"`, close: `"`, escapes: true, multiLine: true},
+		},
+		charLiterals: true,
+		rawStrings:   rustRawString,
+	},
+	".js": {
+		lineComments: []string{"//"},
+		blockComment: cBlockComment,
+		strings: []stringSyntax{
+			{open: "`", close: "`", escapes: true, multiLine: true},
+			{open: `"`, close: `"`, escapes: true},
+			{open: `'`, close: `'`, escapes: true},
+		},
+		regexLiterals: true,
+	},
+	".py": {
+		lineComments: []string{"#"},
+		strings: []stringSyntax{
+			{open: `"""`, close: `"""`, escapes: true, multiLine: true},
+			{open: `'''`, close: `'''`, escapes: true, multiLine: true},
+			{open: `"`, close: `"`, escapes: true},
+			{open: `'`, close: `'`, escapes: true},
+		},
+	},
+	".rb": {
+		lineComments: []string{"#"},
+		strings: []stringSyntax{
+			{open: `"`, close: `"`, escapes: true, multiLine: true},
+			{open: `'`, close: `'`, escapes: true, multiLine: true},
+			{open: "`", close: "`", escapes: true, multiLine: true},
+		},
+		regexLiterals: true,
+		ambiguous:     rubyAmbiguous,
+	},
+	".php": {
+		lineComments: []string{"//", "#"},
+		blockComment: cBlockComment,
+		strings: []stringSyntax{
+			{open: `"`, close: `"`, escapes: true, multiLine: true},
+			{open: `'`, close: `'`, escapes: true, multiLine: true},
+			{open: "`", close: "`", escapes: true, multiLine: true},
+		},
+		codeStart: []string{"<?php", "<?=", "<?"},
+		codeEnd:   "?>",
+		ambiguous: func(line string, i int) bool {
+			return strings.HasPrefix(line[i:], "<<<")
+		},
+	},
+	".sql": {
+		lineComments: []string{"--", "#"},
+		blockComment: cBlockComment,
+		strings: []stringSyntax{
+			{open: "$$", close: "$$", multiLine: true},
+			{open: `'`, close: `'`, doubled: true, multiLine: true, backslashAmbiguous: true},
+			{open: `"`, close: `"`, doubled: true, multiLine: true, backslashAmbiguous: true},
+		},
+	},
+	".json": {
+		lineComments: []string{"//"},
+		blockComment: cBlockComment,
+		strings:      cStrings,
+	},
+	".toml": {
+		lineComments: []string{"#"},
+		strings: []stringSyntax{
+			{open: `"""`, close: `"""`, escapes: true, multiLine: true},
+			{open: `'''`, close: `'''`, multiLine: true},
+			{open: `"`, close: `"`, escapes: true},
+			{open: `'`, close: `'`},
+		},
+	},
+}
+
+func init() {
+	for _, extension := range []string{".h", ".cpp", ".cc", ".hpp"} {
+		sourceSyntaxes[extension] = sourceSyntaxes[".c"]
+	}
+	for _, extension := range []string{".jsx", ".ts", ".tsx"} {
+		sourceSyntaxes[extension] = sourceSyntaxes[".js"]
+	}
+}
+
+// codeLineEnds returns for every line whether it ends in code or in a line
+// comment, rather than in a string or a block comment. It returns false if
+// the strings of the file can't be told apart with certainty.
+func codeLineEnds(lines []string, extension string) ([]bool, bool) {
+	switch {
+	case isYAML(extension):
+		return yamlLineEnds(lines)
+	case extension == ".xml":
+		return xmlLineEnds(lines)
+	}
+	syntax, found := sourceSyntaxes[extension]
+	if !found {
+		return nil, false
+	}
+	ends := make([]bool, len(lines))
+	var literal *stringSyntax
+	comments := 0
+	outside := syntax.codeEnd != ""
+	for n, line := range lines {
+		body, _ := splitLineEnding(line)
+		var prev byte
+		i := 0
+	scan:
+		for i < len(body) {
+			rest := body[i:]
+			switch {
+			case outside:
+				i++
+				for _, marker := range syntax.codeStart {
+					if strings.HasPrefix(rest, marker) {
+						outside = false
+						i += len(marker) - 1
+						break
+					}
+				}
+			case comments > 0:
+				switch {
+				case syntax.nestedComments && strings.HasPrefix(rest, syntax.blockComment[0]):
+					comments++
+					i += len(syntax.blockComment[0])
+				case strings.HasPrefix(rest, syntax.blockComment[1]):
+					comments--
+					i += len(syntax.blockComment[1])
+				default:
+					i++
+				}
+			case literal != nil:
+				switch {
+				case literal.backslashAmbiguous && body[i] == '\\':
+					return nil, false
+				case literal.escapes && body[i] == '\\':
+					i += 2
+				case strings.HasPrefix(rest, literal.close):
+					i += len(literal.close)
+					if literal.doubled && strings.HasPrefix(body[i:], literal.close) {
+						i += len(literal.close)
+					} else {
+						literal = nil
+						prev = '"'
+					}
+				default:
+					i++
+				}
+			default:
+				if syntax.ambiguous != nil && syntax.ambiguous(body, i) {
+					return nil, false
+				}
+				if syntax.codeEnd != "" && strings.HasPrefix(rest, syntax.codeEnd) {
+					outside = true
+					i += len(syntax.codeEnd)
+					continue
+				}
+				for _, marker := range syntax.lineComments {
+					if strings.HasPrefix(rest, marker) {
+						// The end of the code also ends a line comment.
+						if syntax.codeEnd != "" && strings.Contains(rest, syntax.codeEnd) {
+							return nil, false
+						}
+						break scan
+					}
+				}
+				if syntax.blockComment[0] != "" && strings.HasPrefix(rest, syntax.blockComment[0]) {
+					comments = 1
+					i += len(syntax.blockComment[0])
+					continue
+				}
+				if syntax.rawStrings != nil {
+					if raw, ok := syntax.rawStrings(body, i); ok {
+						literal = &raw
+						i += len(raw.open)
+						continue
+					}
+				}
+				if s := openingString(syntax.strings, rest); s != nil {
+					literal = s
+					i += len(s.open)
+					continue
+				}
+				if syntax.charLiterals && body[i] == '\'' {
+					i += charLiteralLength(body, i)
+					prev = '\''
+					continue
+				}
+				if syntax.regexLiterals && body[i] == '/' && startsRegex(body[:i], prev) {
+					length, ok := regexLength(rest)
+					if !ok {
+						return nil, false
+					}
+					i += length
+					prev = '/'
+					continue
+				}
+				if body[i] != ' ' && body[i] != '\t' {
+					prev = body[i]
+				}
+				i++
+			}
+		}
+		if literal != nil && !literal.multiLine {
+			// A single line string can only continue after an escaped
+			// line break.
+			if i <= len(body) {
+				return nil, false
+			}
+		}
+		ends[n] = literal == nil && comments == 0 && !outside
+	}
+	return ends, literal == nil
+}
+
+// rubyAmbiguous finds heredocs, percent literals and embedded documents.
+func rubyAmbiguous(line string, i int) bool {
+	rest := line[i:]
+	switch {
+	case i == 0 && strings.HasPrefix(rest, "=begin"):
+		return true
+	case strings.HasPrefix(rest, "<<"):
+		rest = strings.TrimLeft(rest[2:], "~-")
+		return rest != "" && (rest[0] == '\'' || rest[0] == '"' || rest[0] == '`' || rest[0] == '_' || rest[0] >= 'A' && rest[0] <= 'Z')
+	case strings.HasPrefix(rest, "%"):
+		rest = rest[1:]
+		if rest != "" && strings.IndexByte("qQwWiIrsx", rest[0]) >= 0 {
+			rest = rest[1:]
+		}
+		return rest != "" && strings.IndexByte("([{<|!/^", rest[0]) >= 0
+	}
+	return false
+}
+
+func openingString(syntaxes []stringSyntax, rest string) *stringSyntax {
+	for i := range syntaxes {
+		if strings.HasPrefix(rest, syntaxes[i].open) {
+			return &syntaxes[i]
+		}
+	}
+	return nil
+}
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// charLiteralLength returns the length of the character literal at i, or 1
+// for a quote that doesn't start one, like a Rust lifetime or a C++ digit
+// separator.
+func charLiteralLength(line string, i int) int {
+	if i > 0 && line[i-1] >= '0' && line[i-1] <= '9' {
+		return 1
+	}
+	rest := line[i+1:]
+	if strings.HasPrefix(rest, `\`) {
+		// The longest escape is \u{10FFFF}.
+		for j := 2; j < len(rest) && j <= 10; j++ {
+			if rest[j] == '\'' {
+				return j + 2
+			}
+		}
+		return 1
+	}
+	if _, size := utf8.DecodeRuneInString(rest); size > 0 && size < len(rest) && rest[size] == '\'' {
+		return size + 2
+	}
+	return 1
+}
+
+// startsRegex reports whether a slash after the code before it starts a
+// regular expression rather than a division.
+func startsRegex(before string, prev byte) bool {
+	if prev == 0 || strings.IndexByte("(,=:[!&|?{};+-*%<>~^", prev) >= 0 {
+		return true
+	}
+	word := strings.TrimRight(before, " \t")
+	start := len(word)
+	for start > 0 && isIdentifierByte(word[start-1]) {
+		start--
+	}
+	switch word[start:] {
+	case "return", "typeof", "case", "in", "of", "when", "if", "unless", "and", "or", "not":
+		return true
+	}
+	return false
+}
+
+// regexLength returns the length of the regular expression literal at the
+// start of rest with its flags. Regular expressions can't span lines.
+func regexLength(rest string) (int, bool) {
+	class := false
+	for i := 1; i < len(rest); i++ {
+		switch {
+		case rest[i] == '\\':
+			i++
+		case rest[i] == '[':
+			class = true
+		case rest[i] == ']':
+			class = false
+		case rest[i] == '/' && !class:
+			for i++; i < len(rest) && isIdentifierByte(rest[i]); i++ {
+			}
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// cppRawString opens a C++ raw string: R"delimiter( ... )delimiter".
+func cppRawString(line string, i int) (stringSyntax, bool) {
+	start := i
+	for _, prefix := range []string{"u8R", "uR", "UR", "LR", "R"} {
+		if strings.HasPrefix(line[i:], prefix+`"`) {
+			i += len(prefix) + 1
+			break
+		}
+	}
+	if i == start || start > 0 && isIdentifierByte(line[start-1]) {
+		return stringSyntax{}, false
+	}
+	end := strings.IndexByte(line[i:], '(')
+	if end < 0 || end > 16 {
+		return stringSyntax{}, false
+	}
+	delimiter := line[i : i+end]
+	return stringSyntax{open: line[start : i+end+1], close: ")" + delimiter + `"`, multiLine: true}, true
+}
+
+// rustRawString opens a Rust raw string: r#"..."#, with any number of hashes.
+func rustRawString(line string, i int) (stringSyntax, bool) {
+	if i > 0 && isIdentifierByte(line[i-1]) {
+		return stringSyntax{}, false
+	}
+	j := i
+	if strings.HasPrefix(line[j:], "br") {
+		j++
+	}
+	if j >= len(line) || line[j] != 'r' {
+		return stringSyntax{}, false
+	}
+	hashes := 0
+	for j++; j < len(line) && line[j] == '#'; j++ {
+		hashes++
+	}
+	if j >= len(line) || line[j] != '"' {
+		return stringSyntax{}, false
+	}
+	return stringSyntax{open: line[i : j+1], close: `"` + strings.Repeat("#", hashes), multiLine: true}, true
+}
+
+// swiftRawString opens a Swift raw string: #"..."# or #"""..."""#.
+func swiftRawString(line string, i int) (stringSyntax, bool) {
+	j := i
+	for j < len(line) && line[j] == '#' {
+		j++
+	}
+	if j == i || !strings.HasPrefix(line[j:], `"`) {
+		return stringSyntax{}, false
+	}
+	hashes := strings.Repeat("#", j-i)
+	if strings.HasPrefix(line[j:], `"""`) {
+		return stringSyntax{open: hashes + `"""`, close: `"""` + hashes, multiLine: true}, true
+	}
+	return stringSyntax{open: hashes + `"`, close: `"` + hashes}, true
+}
+
+// quoteRunString opens a C# raw string, three or more quotes that are closed
+// by the same number of quotes.
+func quoteRunString(line string, i int) (stringSyntax, bool) {
+	j := i
+	for j < len(line) && line[j] == '"' {
+		j++
+	}
+	if j-i < 3 {
+		return stringSyntax{}, false
+	}
+	return stringSyntax{open: line[i:j], close: line[i:j], multiLine: true}, true
+}
+
+// yamlLineEnds follows the quoted scalars of a YAML file, which can span
+// lines, and skips its block scalars. A quote only starts a scalar at the
+// start of a value, so the apostrophe of a plain scalar like don't is left
+// alone.
+func yamlLineEnds(lines []string) ([]bool, bool) {
+	ends := make([]bool, len(lines))
+	var quote byte
+	blockIndent := -1
+	for n, line := range lines {
+		body, _ := splitLineEnding(line)
+		if blockIndent >= 0 {
+			if strings.TrimSpace(body) == "" || indentation(body) > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		for i := 0; i < len(body); i++ {
+			c := body[i]
+			if quote != 0 {
+				switch {
+				case quote == '"' && c == '\\':
+					i++
+				case c == quote && quote == '\'' && i+1 < len(body) && body[i+1] == '\'':
+					i++
+				case c == quote:
+					quote = 0
+				}
+				continue
+			}
+			if c == '#' && (i == 0 || body[i-1] == ' ' || body[i-1] == '\t') {
+				break
+			}
+			if (c == '"' || c == '\'') && startsYAMLValue(body[:i]) {
+				quote = c
+			}
+		}
+		if quote == 0 && isYAMLBlockScalar(strings.TrimSpace(body)) {
+			blockIndent = indentation(body)
+		}
+		ends[n] = quote == 0
+	}
+	return ends, quote == 0
+}
+
+// startsYAMLValue reports whether a value starts after the text: at the start
+// of the line, after a key, a list item or inside a flow collection.
+func startsYAMLValue(before string) bool {
+	trimmed := strings.TrimRight(before, " \t")
+	if trimmed == "" {
+		return true
+	}
+	last := trimmed[len(trimmed)-1]
+	if strings.IndexByte("[{,", last) >= 0 {
+		return true
+	}
+	return strings.IndexByte(":-?", last) >= 0 && len(trimmed) < len(before)
+}
+
+// xmlLineEnds follows the comments, CDATA sections and tags of an XML file.
+// Quotes are only strings inside of tags.
+func xmlLineEnds(lines []string) ([]bool, bool) {
+	ends := make([]bool, len(lines))
+	close := ""
+	var quote byte
+	tag := false
+	for n, line := range lines {
+		body, _ := splitLineEnding(line)
+		for i := 0; i < len(body); i++ {
+			rest := body[i:]
+			switch {
+			case close != "":
+				if strings.HasPrefix(rest, close) {
+					i += len(close) - 1
+					close = ""
+				}
+			case quote != 0:
+				if body[i] == quote {
+					quote = 0
+				}
+			case strings.HasPrefix(rest, "<!--"):
+				close = "-->"
+				i += 3
+			case strings.HasPrefix(rest, "<![CDATA["):
+				close = "]]>"
+				i += 8
+			case body[i] == '<':
+				tag = true
+			case body[i] == '>':
+				tag = false
+			case tag && (body[i] == '"' || body[i] == '\''):
+				quote = body[i]
+			}
+		}
+		ends[n] = close == "" && quote == 0 && !tag
+	}
+	return ends, close == "" && quote == 0
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TIFF structures hold the EXIF metadata of JPEG, PNG and WebP files and are
+// the container of TIFF images. They are changed by appending new IFDs that
+// reuse the entries of the old ones, so the offsets of the image data, the
+// thumbnail and the maker notes stay valid.
+const (
+	tiffImageDescription = 0x010E
+	tiffXMP              = 0x02BC
+	tiffIPTC             = 0x83BB
+	tiffExifIFD          = 0x8769
+	tiffUserComment      = 0x9286
+	tiffTypeByte         = 1
+	tiffTypeASCII        = 2
+	tiffTypeLong         = 4
+	tiffTypeUndefined    = 7
+)
+
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// userCommentASCII is the character code of an ASCII UserComment.
+var userCommentASCII = []byte("ASCII\x00\x00\x00")
+
+type tiffValue struct {
+	tag  uint16
+	kind uint16
+	data []byte
+}
+
+// emptyTIFF is a little endian TIFF header with an empty IFD0.
+func emptyTIFF() []byte {
+	return []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+}
+
+func tiffByteOrder(tiff []byte) (binary.ByteOrder, error) {
+	if len(tiff) >= 8 {
+		switch string(tiff[:4]) {
+		case "II*\x00":
+			return binary.LittleEndian, nil
+		case "MM\x00*":
+			return binary.BigEndian, nil
+		}
+	}
+	return nil, fmt.Errorf("not a TIFF structure")
+}
+
+// readIFD returns the 12 byte entries of an IFD and the offset of the next
+// IFD.
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) ([][]byte, uint32, error) {
+	if int(offset)+2 > len(tiff) {
+		return nil, 0, fmt.Errorf("invalid IFD offset")
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	end := int(offset) + 2 + 12*count
+	if end+4 > len(tiff) {
+		return nil, 0, fmt.Errorf("IFD is truncated")
+	}
+	var entries [][]byte
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + 12*i
+		entries = append(entries, tiff[start:start+12])
+	}
+	return entries, order.Uint32(tiff[end:]), nil
+}
+
+func findIFDEntry(entries [][]byte, order binary.ByteOrder, tag uint16) []byte {
+	for _, entry := range entries {
+		if order.Uint16(entry) == tag {
+			return entry
+		}
+	}
+	return nil
+}
+
+// ifdEntryValue returns the bytes of the value of an IFD entry.
+func ifdEntryValue(tiff []byte, order binary.ByteOrder, entry []byte) []byte {
+	size, found := tiffTypeSizes[order.Uint16(entry[2:])]
+	if !found {
+		return nil
+	}
+	length := size * int(order.Uint32(entry[4:]))
+	if length <= 4 {
+		return entry[8 : 8+length]
+	}
+	offset := int(order.Uint32(entry[8:]))
+	if length < 0 || offset+length > len(tiff) {
+		return nil
+	}
+	return tiff[offset : offset+length]
+}
+
+// updateTIFF sets the given entries of IFD0 and of the EXIF IFD.
+func updateTIFF(tiff []byte, ifd0Values, exifValues []tiffValue) ([]byte, error) {
+	order, err := tiffByteOrder(tiff)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, next, err := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	if err != nil {
+		return nil, err
+	}
+	var exif [][]byte
+	if pointer := findIFDEntry(ifd0, order, tiffExifIFD); pointer != nil {
+		if exif, _, err = readIFD(tiff, order, order.Uint32(pointer[8:])); err != nil {
+			return nil, err
+		}
+	}
+	out := append([]byte{}, tiff...)
+	if len(exifValues) > 0 {
+		exifOffset := appendIFD(&out, order, exif, exifValues, 0)
+		pointer := make([]byte, 4)
+		order.PutUint32(pointer, exifOffset)
+		ifd0Values = append(ifd0Values, tiffValue{tiffExifIFD, tiffTypeLong, pointer})
+	}
+	ifd0Offset := appendIFD(&out, order, ifd0, ifd0Values, next)
+	order.PutUint32(out[4:], ifd0Offset)
+	return out, nil
+}
+
+// appendIFD writes an IFD with the old entries and the new values to the end
+// of the TIFF structure and returns its offset.
+func appendIFD(out *[]byte, order binary.ByteOrder, entries [][]byte, values []tiffValue, next uint32) uint32 {
+	replaced := make(map[uint16]bool)
+	for _, value := range values {
+		replaced[value.tag] = true
+	}
+	var kept [][]byte
+	for _, entry := range entries {
+		if !replaced[order.Uint16(entry)] {
+			kept = append(kept, entry)
+		}
+	}
+	if len(*out)%2 == 1 {
+		*out = append(*out, 0)
+	}
+	offset := len(*out)
+	dataOffset := offset + 2 + 12*(len(kept)+len(values)) + 4
+	var data []byte
+	for _, value := range values {
+		entry := make([]byte, 12)
+		order.PutUint16(entry, value.tag)
+		order.PutUint16(entry[2:], value.kind)
+		order.PutUint32(entry[4:], uint32(len(value.data)/tiffTypeSizes[value.kind]))
+		if len(value.data) <= 4 {
+			copy(entry[8:], value.data)
+		} else {
+			order.PutUint32(entry[8:], uint32(dataOffset+len(data)))
+			data = append(data, value.data...)
+			if len(data)%2 == 1 {
+				data = append(data, 0)
+			}
+		}
+		kept = append(kept, entry)
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		return order.Uint16(kept[i]) < order.Uint16(kept[j])
+	})
+	ifd := make([]byte, 2, dataOffset-offset)
+	order.PutUint16(ifd, uint16(len(kept)))
+	for _, entry := range kept {
+		ifd = append(ifd, entry...)
+	}
+	ifd = append(ifd, 0, 0, 0, 0)
+	order.PutUint32(ifd[len(ifd)-4:], next)
+	*out = append(append(*out, ifd...), data...)
+	return uint32(offset)
+}
+
+// tiffSignatureValues returns the IFD0 and EXIF values that hold the
+// signature. The signature is added to the end of an existing description.
+func tiffSignatureValues(tiff []byte, signature string) ([]tiffValue, []tiffValue) {
+	description := signature
+	if order, err := tiffByteOrder(tiff); err == nil {
+		if ifd0, _, err := readIFD(tiff, order, order.Uint32(tiff[4:])); err == nil {
+			if entry := findIFDEntry(ifd0, order, tiffImageDescription); entry != nil {
+				if current := strings.TrimRight(string(ifdEntryValue(tiff, order, entry)), "\x00 "); current != "" {
+					description = current + " " + signature
+				}
+			}
+		}
+	}
+	ifd0 := []tiffValue{{tiffImageDescription, tiffTypeASCII, []byte(description + "\x00")}}
+	exif := []tiffValue{{tiffUserComment, tiffTypeUndefined, append(append([]byte{}, userCommentASCII...), signature...)}}
+	return ifd0, exif
+}
+
+func signTIFF(tiff []byte, signature string) ([]byte, error) {
+	ifd0Values, exifValues := tiffSignatureValues(tiff, signature)
+	return updateTIFF(tiff, ifd0Values, exifValues)
+}
+
+// tiffStrings returns the description, the user comment, the XMP packet and
+// the IPTC data of a TIFF structure.
+func tiffStrings(tiff []byte) []string {
+	order, err := tiffByteOrder(tiff)
+	if err != nil {
+		return nil
+	}
+	ifd0, _, err := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, tag := range []uint16{tiffImageDescription, tiffXMP, tiffIPTC} {
+		if entry := findIFDEntry(ifd0, order, tag); entry != nil {
+			values = append(values, string(ifdEntryValue(tiff, order, entry)))
+		}
+	}
+	if pointer := findIFDEntry(ifd0, order, tiffExifIFD); pointer != nil {
+		if exif, _, err := readIFD(tiff, order, order.Uint32(pointer[8:])); err == nil {
+			if entry := findIFDEntry(exif, order, tiffUserComment); entry != nil {
+				values = append(values, string(ifdEntryValue(tiff, order, entry)))
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Source code and configuration files carry the signature in trailing
+// whitespace: every eligible line ends with a payload chunk written as
+// spaces (0) and tabs (1). YAML parsers reject tabs after a mapping key, so
+// YAML files spread a chunk over four lines instead, each ending with one to
+// sixteen spaces for a nibble and sixteen more on the first line of the
+// chunk. Files that already use CRLF line endings also get
+// a second copy of the payload in their line endings. A frame starts with
+// three LF endings and a CRLF, a sequence that Manchester coded data (CRLF+LF
+// is 0, LF+CRLF is 1) can't contain, followed by the chunk.
+var whitespaceSync = []bool{false, false, false, true}
+
+const yamlNibbles = payloadChunkBits / 4
+
+func isWhitespaceSource(extension string) bool {
+	switch strings.ToLower(extension) {
+	case ".go", ".c", ".h", ".cpp", ".cc", ".hpp", ".cs", ".java", ".kt", ".scala", ".swift", ".rs",
+		".js", ".jsx", ".ts", ".tsx", ".py", ".rb", ".php", ".sql",
+		".yaml", ".yml", ".json", ".toml", ".xml":
+		return true
+	}
+	return false
+}
+
+func addWhitespaceSignature(file, signature string) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		color.Red("Error occurred while reading the source file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	payload := signatureBytes(signature)
+	if payload == nil {
+		return
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	crlf := usesCRLF(lines)
+	extension := strings.ToLower(filepath.Ext(file))
+	eligible := whitespaceEligibleLines(lines, extension)
+	carrier := 0
+	for i, line := range lines {
+		body, ending := splitLineEnding(line)
+		if eligible[i] {
+			if isYAML(extension) {
+				index := carrier / yamlNibbles % payloadSize
+				body += yamlNibble(payloadChunk(index, payload[index]), carrier%yamlNibbles)
+			} else {
+				index := carrier % payloadSize
+				body += whitespaceChunk(payloadChunk(index, payload[index]))
+			}
+			carrier++
+		}
+		lines[i] = body + ending
+	}
+	if crlf {
+		setLineEndings(lines, payload, nil)
+	}
+	err = ioutil.WriteFile(file, []byte(strings.Join(lines, "")), 0644)
+	if err != nil {
+		color.Red("Error occurred while writing the source file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func splitLineEnding(line string) (string, string) {
+	switch {
+	case strings.HasSuffix(line, "\r\n"):
+		return line[:len(line)-2], "\r\n"
+	case strings.HasSuffix(line, "\n"):
+		return line[:len(line)-1], "\n"
+	}
+	return line, ""
+}
+
+func usesCRLF(lines []string) bool {
+	count := 0
+	for _, line := range lines {
+		_, ending := splitLineEnding(line)
+		switch ending {
+		case "\n":
+			return false
+		case "\r\n":
+			count++
+		}
+	}
+	return count > 0
+}
+
+func whitespaceChunk(chunk uint16) string {
+	var sb strings.Builder
+	for shift := payloadChunkBits - 1; shift >= 0; shift-- {
+		if chunk>>uint(shift)&1 == 1 {
+			sb.WriteByte('\t')
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	return sb.String()
+}
+
+func yamlNibble(chunk uint16, position int) string {
+	count := int(chunk>>uint(payloadChunkBits-4*(position+1))&0xF) + 1
+	if position == 0 {
+		count += 16
+	}
+	return strings.Repeat(" ", count)
+}
+
+func isYAML(extension string) bool {
+	return extension == ".yaml" || extension == ".yml"
+}
+
+// whitespaceEligibleLines marks the lines where trailing whitespace can't
+// change the meaning of the file. Lines that continue with a backslash and
+// lines that end inside a string literal, a block comment or a YAML block
+// scalar are skipped. Files whose strings can't be lexed with certainty get
+// no trailing whitespace at all.
+func whitespaceEligibleLines(lines []string, extension string) []bool {
+	eligible := make([]bool, len(lines))
+	ends, ok := codeLineEnds(lines, extension)
+	if !ok {
+		return eligible
+	}
+	for i, line := range lines {
+		body, ending := splitLineEnding(line)
+		if ending == "" || !ends[i] {
+			continue
+		}
+		if strings.TrimSpace(body) == "" || body != strings.TrimRight(body, " \t") || strings.HasSuffix(body, "\\") {
+			continue
+		}
+		if extension == ".xml" && !strings.HasSuffix(body, ">") {
+			continue
+		}
+		eligible[i] = true
+	}
+	return eligible
+}
+
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+func isYAMLBlockScalar(line string) bool {
+	if i := strings.Index(line, " #"); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	line = strings.TrimRight(line, "+-0123456789")
+	return strings.HasSuffix(line, "|") || strings.HasSuffix(line, ">")
+}
+
+// setLineEndings writes the payload frames to the line endings. Only the
+// lines marked in records carry a bit, all of them if records is nil.
+func setLineEndings(lines []string, payload []byte, records []bool) {
+	count := 0
+	for i := range lines {
+		if records == nil || records[i] {
+			count++
+		}
+	}
+	var endings []bool
+	for chunk := 0; ; chunk++ {
+		index := chunk % payloadSize
+		frame := payloadChunk(index, payload[index])
+		endings = append(endings, whitespaceSync...)
+		for shift := payloadChunkBits - 1; shift >= 0; shift-- {
+			bit := frame>>uint(shift)&1 == 1
+			endings = append(endings, !bit, bit)
+		}
+		if len(endings) >= count {
+			break
+		}
+	}
+	next := 0
+	for i, line := range lines {
+		body, ending := splitLineEnding(line)
+		if ending == "" || (records != nil && !records[i]) {
+			continue
+		}
+		if endings[next] {
+			lines[i] = body + "\r\n"
+		} else {
+			lines[i] = body + "\n"
+		}
+		next++
+	}
+}
+
+func readWhitespaceSignature(file string) payloadVotes {
+	votes := make(payloadVotes)
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	var endings []bool
+	var spaces []int
+	for _, line := range lines {
+		body, ending := splitLineEnding(line)
+		if ending != "" {
+			endings = append(endings, ending == "\r\n")
+		}
+		trailing := body[len(strings.TrimRight(body, " \t")):]
+		if trailing != "" && strings.Trim(trailing, " ") == "" {
+			spaces = append(spaces, len(trailing))
+		}
+		if len(trailing) != payloadChunkBits {
+			continue
+		}
+		var chunk uint16
+		for i := 0; i < len(trailing); i++ {
+			chunk <<= 1
+			if trailing[i] == '\t' {
+				chunk |= 1
+			}
+		}
+		if index, value, ok := parsePayloadChunk(chunk); ok {
+			votes.add(index, value)
+		}
+	}
+	for i := 0; i+yamlNibbles <= len(spaces); i++ {
+		if spaces[i] <= 16 || spaces[i] > 32 {
+			continue
+		}
+		chunk, complete := uint16(spaces[i]-17), true
+		for _, count := range spaces[i+1 : i+yamlNibbles] {
+			complete = complete && count <= 16
+			chunk = chunk<<4 | uint16(count-1)
+		}
+		if index, value, ok := parsePayloadChunk(chunk); ok && complete {
+			votes.add(index, value)
+		}
+	}
+	addLineEndingVotes(votes, endings)
+	return votes
+}
+
+func addLineEndingVotes(votes payloadVotes, endings []bool) {
+	frameLength := len(whitespaceSync) + 2*payloadChunkBits
+	for i := 0; i+frameLength <= len(endings); i++ {
+		if !isLineEndingSync(endings[i:]) {
+			continue
+		}
+		if chunk, ok := decodeLineEndings(endings[i+len(whitespaceSync) : i+frameLength]); ok {
+			if index, value, ok := parsePayloadChunk(chunk); ok {
+				votes.add(index, value)
+			}
+		}
+	}
+}
+
+// CSV files can't take any character in their fields without changing the
+// values, so they only get the payload in the line endings of their records,
+// with the same frames as the CRLF copy of source files. Parsers accept both
+// endings. Line breaks inside quoted fields are part of the value and are
+// left as they are.
+func csvRecordEnds(lines []string) []bool {
+	records := make([]bool, len(lines))
+	quoted := false
+	for i, line := range lines {
+		if strings.Count(line, `"`)%2 == 1 {
+			quoted = !quoted
+		}
+		records[i] = !quoted
+	}
+	return records
+}
+
+func addCSVSignature(file, signature string) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		color.Red("Error occurred while reading the CSV file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	payload := signatureBytes(signature)
+	if payload == nil {
+		return
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	setLineEndings(lines, payload, csvRecordEnds(lines))
+	err = ioutil.WriteFile(file, []byte(strings.Join(lines, "")), 0644)
+	if err != nil {
+		color.Red("Error occurred while writing the CSV file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func readCSVSignature(file string) payloadVotes {
+	votes := make(payloadVotes)
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	var endings []bool
+	for i, record := range csvRecordEnds(lines) {
+		if _, ending := splitLineEnding(lines[i]); record && ending != "" {
+			endings = append(endings, ending == "\r\n")
+		}
+	}
+	addLineEndingVotes(votes, endings)
+	return votes
+}
+
+func detectCSVSignature(file, signature string) bool {
+	return readCSVSignature(file).matches(signature)
+}
+
+func isLineEndingSync(endings []bool) bool {
+	for i, crlf := range whitespaceSync {
+		if endings[i] != crlf {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeLineEndings(endings []bool) (uint16, bool) {
+	var chunk uint16
+	for i := 0; i < len(endings); i += 2 {
+		if endings[i] == endings[i+1] {
+			return 0, false
+		}
+		chunk <<= 1
+		if endings[i+1] {
+			chunk |= 1
+		}
+	}
+	return chunk, true
+}
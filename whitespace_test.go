@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// addWhitespaceToSource adds the signature to a source file and returns the
+// new content.
+func addWhitespaceToSource(t *testing.T, name, source string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addWhitespaceSignature(file, testSignature)
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// stringLines returns the lines between the first line that contains open
+// and the next line that contains close.
+func stringLines(content, open, close string) []string {
+	var lines []string
+	inside := false
+	for _, line := range strings.Split(content, "\n") {
+		switch {
+		case !inside && strings.Contains(line, open):
+			inside = true
+		case inside && strings.Contains(line, close):
+			return lines
+		case inside:
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestWhitespaceSkipsRawStringAfterRuneLiteral(t *testing.T) {
+	var banner strings.Builder
+	for i := 0; i < 61; i++ {
+		fmt.Fprintf(&banner, "  | row %d of the banner |\n", i)
+	}
+	source := "package main\n\nimport \"fmt\"\n\nvar tick = '`'\n\nconst banner = `\n" + banner.String() +
+		"`\n\nfunc main() {\n\tfmt.Println(banner)\n\tfmt.Println(tick)\n}\n"
+	content := addWhitespaceToSource(t, "main.go", source)
+	lines := stringLines(content, "const banner", "`")
+	if len(lines) != 61 {
+		t.Fatalf("got %d lines of the raw string", len(lines))
+	}
+	for _, line := range lines {
+		if line != strings.TrimRight(line, " \t") {
+			t.Fatalf("trailing whitespace in the raw string: %q", line)
+		}
+	}
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "var tick") && len(line) != len("var tick = '`'")+payloadChunkBits {
+			t.Errorf("the line of the rune literal didn't get a chunk: %q", line)
+		}
+	}
+}
+
+func TestWhitespaceSourceStrings(t *testing.T) {
+	tests := []struct {
+		name, source, open, close string
+	}{
+		{"comment.go", "package main\n\n// don't use ` here\nvar s = `\nraw line\n`\n", "var s", "`"},
+		{"string.go", "package main\n\nvar q = \"`\"\nvar s = `\nraw line\n`\n", "var s", "`"},
+		{"triple.py", "x = '\"\"\"'\n# ''' in a comment\ndoc = \"\"\"\nraw line\n\"\"\"\n", "doc =", "\"\"\""},
+		{"template.ts", "const re = /`/g;\nconst s = `\nraw line\n`;\n", "const s", "`"},
+		{"raw.rs", "fn f<'a>(x: &'a str) {}\nlet c = '\"';\nlet s = r#\"\nraw \"line\"\n\"#;\n", "let s", "\"#;"},
+		{"raw.cpp", "char c = '\"';\nauto s = R\"x(\nraw line )\"\n)x\";\n", "auto s", ")x\""},
+		{"block.cs", "var c = '\"';\nvar s = @\"\nraw \"\"line\"\"\n\";\n", "var s", "\";"},
+		{"text.java", "char c = '\"';\nString s = \"\"\"\n    raw line\n    \"\"\";\n", "String s", "\"\"\";"},
+		{"quoted.yaml", "note: don't \"quote\"\nkey: 'it''s\n  raw line\n  last'\nnext: 1\n", "key:", "last"},
+		{"strings.sql", "SELECT 'it''s', \"a\"\"b\" -- don't\nFROM t WHERE x = '\nraw line\n';\n", "FROM", "';"},
+	}
+	for _, test := range tests {
+		content := addWhitespaceToSource(t, test.name, strings.Repeat(test.source, 4))
+		lines := stringLines(content, test.open, test.close)
+		if len(lines) == 0 {
+			t.Fatalf("%s: string not found", test.name)
+		}
+		for _, line := range lines {
+			if line != strings.TrimRight(line, " \t") {
+				t.Errorf("%s: trailing whitespace in a string: %q", test.name, line)
+			}
+		}
+	}
+}
+
+func TestWhitespaceSkipsAmbiguousFiles(t *testing.T) {
+	sources := map[string]string{
+		"heredoc.rb":    "x = 1\ns = <<~EOS\n  don't\nEOS\ny = 2\n",
+		"heredoc.php":   "<?php\n$x = 1;\n$s = <<<EOT\nraw\nEOT;\n",
+		"regex.js":      "const x = 1;\nconst re = /[`\n",
+		"unclosed.json": "{\n  \"a\": \"b\n}\n",
+	}
+	for name, source := range sources {
+		content := addWhitespaceToSource(t, name, source)
+		if content != source {
+			t.Errorf("%s was changed: %q", name, content)
+		}
+	}
+}
+
+func TestWhitespaceRoundTrip(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("package main\n\n")
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&sb, "var v%d = %d\n", i, i)
+	}
+	file := filepath.Join(t.TempDir(), "vars.go")
+	if err := ioutil.WriteFile(file, []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addWhitespaceSignature(file, testSignature)
+	if !readWhitespaceSignature(file).matches(testSignature) {
+		t.Error("signature not found")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Hidden PDF watermarks are written as ordinary words instead of the
+// signature, so that copied or extracted text doesn't look like a tracking
+// ID. Every payload chunk becomes two words, one for each byte.
+var watermarkWords = []string{
+	"able", "above", "access", "account", "action", "active", "actual", "added",
+	"address", "advance", "advice", "agenda", "agreed", "amount", "annual",
+	"answer", "apply", "approach", "area", "around", "asset", "assume", "audit",
+	"author", "average", "backup", "balance", "basic", "become", "before",
+	"begin", "behalf", "below", "benefit", "better", "beyond", "billing",
+	"board", "branch", "brief", "budget", "build", "business", "buyer",
+	"calendar", "capital", "career", "carry", "case", "central", "certain",
+	"change", "channel", "charge", "check", "choice", "claim", "clear",
+	"client", "close", "common", "company", "compare", "complete", "concept",
+	"confirm", "consider", "contact", "content", "context", "contract",
+	"control", "copy", "cost", "count", "course", "cover", "create", "credit",
+	"current", "customer", "daily", "data", "date", "deal", "debit", "decide",
+	"default", "define", "deliver", "demand", "design", "detail", "develop",
+	"direct", "draft", "due", "during", "early", "effort", "either", "enable",
+	"engine", "enough", "entry", "equal", "estimate", "event", "exact",
+	"example", "expect", "expense", "factor", "field", "figure", "final",
+	"finance", "first", "focus", "follow", "formal", "forward", "frame",
+	"future", "general", "global", "goal", "group", "growth", "guide", "handle",
+	"holder", "impact", "include", "income", "index", "inform", "input",
+	"inside", "invoice", "issue", "item", "keep", "label", "ledger", "level",
+	"limit", "linked", "local", "manage", "manual", "margin", "market",
+	"matter", "measure", "member", "method", "middle", "minor", "model",
+	"monthly", "name", "network", "normal", "notice", "number", "object",
+	"offer", "office", "online", "option", "order", "other", "outline",
+	"output", "owner", "panel", "partner", "party", "payment", "period",
+	"person", "place", "planning", "policy", "portal", "position", "prepare",
+	"present", "price", "primary", "prior", "process", "product", "profile",
+	"program", "project", "proposal", "quality", "quarter", "query", "range",
+	"rate", "reason", "receipt", "record", "region", "regular", "related",
+	"release", "report", "request", "review", "revenue", "sales", "schedule",
+	"scope", "section", "secure", "select", "service", "session", "share",
+	"simple", "source", "space", "staff", "stage", "standard", "status",
+	"stock", "store", "strategy", "subject", "summary", "supply", "support",
+	"system", "table", "target", "team", "term", "total", "track", "trade",
+	"training", "transfer", "update", "usage", "valid", "value", "vendor",
+	"version", "volume", "weekly", "working",
+}
+
+var watermarkWordValues = func() map[string]int {
+	values := make(map[string]int, len(watermarkWords))
+	for i, word := range watermarkWords {
+		values[word] = i
+	}
+	return values
+}()
+
+func encodeWatermarkWords(signature string) string {
+	payload := signatureBytes(signature)
+	if payload == nil {
+		return signature
+	}
+	words := make([]string, 0, 2*len(payload))
+	for i, value := range payload {
+		chunk := payloadChunk(i, value)
+		words = append(words, watermarkWords[chunk>>8], watermarkWords[chunk&0xFF])
+	}
+	return strings.Join(words, " ")
+}
+
+// pageWatermarkWords puts a page mark in front of the signature words. The
+// mark holds the page number and a tag derived from the signature and the
+// page, so a page can't be claimed by the signature of another recipient.
+func pageWatermarkWords(signature string, page int) string {
+	tag := pageTag(signature, page)
+	return strings.Join([]string{
+		watermarkWords[page>>8&0xFF], watermarkWords[page&0xFF],
+		watermarkWords[tag>>8], watermarkWords[tag&0xFF],
+		encodeWatermarkWords(signature),
+	}, " ")
+}
+
+func pageTag(signature string, page int) int {
+	return int(crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s:%d", signature, page))) & 0xFFFF)
+}
+
+type watermarkRun struct {
+	start   int
+	indexes []int
+	values  []byte
+}
+
+// watermarkRuns finds the runs of valid chunks in a list of word values.
+// Ordinary text is full of the watermark words, so only runs of at least
+// minPayloadMatch chunks with consecutive positions are counted.
+func watermarkRuns(values []int) []watermarkRun {
+	var runs []watermarkRun
+	for start := 0; start+1 < len(values); start++ {
+		run := watermarkRun{start: start}
+		for i := start; i+1 < len(values) && values[i] >= 0 && values[i+1] >= 0; i += 2 {
+			index, value, ok := parsePayloadChunk(uint16(values[i]<<8 | values[i+1]))
+			if !ok || len(run.indexes) > 0 && index != (run.indexes[len(run.indexes)-1]+1)%payloadSize {
+				break
+			}
+			run.indexes = append(run.indexes, index)
+			run.values = append(run.values, value)
+		}
+		if len(run.indexes) < minPayloadMatch {
+			continue
+		}
+		runs = append(runs, run)
+		start += 2*len(run.indexes) - 1
+	}
+	return runs
+}
+
+func watermarkWordList(text string) []int {
+	var values []int
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		value, found := watermarkWordValues[word]
+		if !found {
+			value = -1
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// decodeWatermarkWords collects the chunks of the watermark words in a text.
+func decodeWatermarkWords(text string) payloadVotes {
+	votes := make(payloadVotes)
+	for _, run := range watermarkRuns(watermarkWordList(text)) {
+		for i, index := range run.indexes {
+			votes.add(index, run.values[i])
+		}
+	}
+	return votes
+}
+
+type pageMark struct {
+	page, tag int
+}
+
+// decodePageMarks returns the page marks in front of the signature words.
+func decodePageMarks(text string) []pageMark {
+	values := watermarkWordList(text)
+	var marks []pageMark
+	for _, run := range watermarkRuns(values) {
+		if run.indexes[0] != 0 || run.start < 4 {
+			continue
+		}
+		mark := values[run.start-4 : run.start]
+		if mark[0] < 0 || mark[1] < 0 || mark[2] < 0 || mark[3] < 0 {
+			continue
+		}
+		marks = append(marks, pageMark{mark[0]<<8 | mark[1], mark[2]<<8 | mark[3]})
+	}
+	return marks
+}
+
+// pagesWithSignature returns the sorted page numbers whose marks belong to
+// the signature.
+func pagesWithSignature(marks []pageMark, signature string) []int {
+	found := make(map[int]bool)
+	var pages []int
+	for _, mark := range marks {
+		if !found[mark.page] && mark.tag == pageTag(signature, mark.page) {
+			found[mark.page] = true
+			pages = append(pages, mark.page)
+		}
+	}
+	sort.Ints(pages)
+	return pages
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Workbooks carry the signature in a worksheet that is "veryHidden" (it can
+// only be shown from VBA), in a hidden defined name and in the number format
+// of an empty cell of that worksheet. Excel and LibreOffice Calc keep all of
+// them when the workbook is saved again.
+const (
+	xlsxSheetName   = "Config"
+	xlsxDefinedName = "_DocumentID"
+	xlsxSheetType   = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet"
+	xlsxSheetMime   = "application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"
+	xlsxRelsPart    = "xl/_rels/workbook.xml.rels"
+	xlsxFirstNumFmt = 164
+)
+
+var (
+	sheetIDPattern   = regexp.MustCompile(`sheetId="(\d+)"`)
+	numFmtIDPattern  = regexp.MustCompile(`numFmtId="(\d+)"`)
+	sheetPartPattern = regexp.MustCompile(`^xl/worksheets/sheet(\d+)\.xml$`)
+	countPattern     = regexp.MustCompile(`count="\d+"`)
+)
+
+func addXlsxSignature(file, signature string) {
+	err := addXlsxParts(file, signature)
+	if err != nil {
+		color.Red("Error occurred while adding the signature to the workbook")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func addXlsxParts(file, signature string) error {
+	parts := make(map[string][]byte)
+	workbook, err := readZipFile(file, "xl/workbook.xml")
+	if err != nil {
+		return err
+	}
+	rels, err := readZipFile(file, xlsxRelsPart)
+	if err != nil {
+		return err
+	}
+	contentTypes, err := readZipFile(file, "[Content_Types].xml")
+	if err != nil {
+		return err
+	}
+
+	sheetNumber, err := nextSheetNumber(file)
+	if err != nil {
+		return err
+	}
+	sheetPart := fmt.Sprintf("xl/worksheets/sheet%d.xml", sheetNumber)
+	newRels, relID, err := addRelationship(string(rels), xlsxSheetType, fmt.Sprintf("worksheets/sheet%d.xml", sheetNumber))
+	if err != nil {
+		return err
+	}
+	parts[xlsxRelsPart] = []byte(newRels)
+	newContentTypes, err := addContentTypeOverride(string(contentTypes), sheetPart, xlsxSheetMime)
+	if err != nil {
+		return err
+	}
+	parts["[Content_Types].xml"] = []byte(newContentTypes)
+
+	content := string(workbook)
+	sheetName := xlsxSheetName
+	for i := 2; strings.Contains(content, `name="`+sheetName+`"`); i++ {
+		sheetName = fmt.Sprintf("%s%d", xlsxSheetName, i)
+	}
+	sheet := fmt.Sprintf(`<sheet name="%s" sheetId="%d" state="veryHidden" r:id="%s"/>`, sheetName, nextID(content, sheetIDPattern, 1), relID)
+	if !strings.Contains(content, "xmlns:r=") {
+		sheet = strings.Replace(sheet, "<sheet ", `<sheet xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" `, 1)
+	}
+	content, ok := insertBefore(content, "</sheets>", sheet)
+	if !ok {
+		return fmt.Errorf("xl/workbook.xml doesn't contain any sheets")
+	}
+	definedName := fmt.Sprintf(`<definedName name="%s" hidden="1">"%s"</definedName>`, xlsxDefinedName, signature)
+	if content, ok = insertBefore(content, "</definedNames>", definedName); !ok {
+		// The elements of the workbook have a fixed order, definedNames
+		// comes after the sheets, the function groups and the external
+		// references.
+		end := 0
+		for _, element := range []string{"sheets", "functionGroups", "externalReferences"} {
+			end = maxInt(end, elementEnd(content, element))
+		}
+		content = content[:end] + "<definedNames>" + definedName + "</definedNames>" + content[end:]
+	}
+	parts["xl/workbook.xml"] = []byte(content)
+
+	cell := ""
+	if styles, err := readZipFile(file, "xl/styles.xml"); err == nil {
+		newStyles, style, ok := addXlsxNumberFormat(string(styles), signature)
+		if ok {
+			parts["xl/styles.xml"] = []byte(newStyles)
+			cell = fmt.Sprintf(`<c r="B2" s="%d"/>`, style)
+		}
+	}
+	parts[sheetPart] = []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\r\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><dimension ref="A1:B2"/><sheetData>` +
+		`<row r="1"><c r="A1" t="inlineStr"><is><t>` + signature + `</t></is></c></row>` +
+		`<row r="2">` + cell + `</row></sheetData></worksheet>`)
+	return writeOfficeParts(file, parts)
+}
+
+func nextSheetNumber(file string) (int, error) {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	number := 1
+	for _, f := range r.File {
+		if match := sheetPartPattern.FindStringSubmatch(f.Name); match != nil {
+			if n, _ := strconv.Atoi(match[1]); n >= number {
+				number = n + 1
+			}
+		}
+	}
+	return number, nil
+}
+
+// addXlsxNumberFormat adds a number format that holds the signature and a
+// cell style using it. It returns the index of the new cell style.
+func addXlsxNumberFormat(styles, signature string) (string, int, bool) {
+	id := nextID(styles, numFmtIDPattern, xlsxFirstNumFmt)
+	numFmt := fmt.Sprintf(`<numFmt numFmtId="%d" formatCode="General;-General;General;@&quot;%s&quot;"/>`, id, signature)
+	if newStyles, ok := insertBefore(styles, "</numFmts>", numFmt); ok {
+		styles = updateCount(newStyles, "numFmts", "numFmt")
+	} else {
+		start := strings.Index(styles, "<styleSheet")
+		if start < 0 {
+			return "", 0, false
+		}
+		end := strings.IndexByte(styles[start:], '>')
+		if end < 0 {
+			return "", 0, false
+		}
+		end += start + 1
+		styles = styles[:end] + `<numFmts count="1">` + numFmt + `</numFmts>` + styles[end:]
+	}
+	start := strings.Index(styles, "<cellXfs")
+	end := strings.Index(styles, "</cellXfs>")
+	if start < 0 || end < 0 {
+		return "", 0, false
+	}
+	style := strings.Count(styles[start:end], "<xf ") + strings.Count(styles[start:end], "<xf>")
+	xf := fmt.Sprintf(`<xf numFmtId="%d" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>`, id)
+	styles, _ = insertBefore(styles, "</cellXfs>", xf)
+	return updateCount(styles, "cellXfs", "xf"), style, true
+}
+
+// elementEnd returns the offset after the first element with the name, or
+// zero if there is none.
+func elementEnd(content, name string) int {
+	if end := strings.Index(content, "</"+name+">"); end >= 0 {
+		return end + len("</"+name+">")
+	}
+	for offset := 0; ; {
+		start := strings.Index(content[offset:], "<"+name)
+		if start < 0 {
+			return 0
+		}
+		start += offset
+		rest := content[start+len(name)+1:]
+		if rest != "" && strings.IndexByte(" \t\r\n/", rest[0]) >= 0 {
+			if end := strings.Index(rest, "/>"); end >= 0 {
+				return start + len(name) + 1 + end + 2
+			}
+		}
+		offset = start + 1
+	}
+}
+
+func insertBefore(content, marker, insert string) (string, bool) {
+	end := strings.LastIndex(content, marker)
+	if end < 0 {
+		return content, false
+	}
+	return content[:end] + insert + content[end:], true
+}
+
+// updateCount recalculates the count attribute of a styles.xml collection.
+func updateCount(styles, collection, element string) string {
+	start := strings.Index(styles, "<"+collection)
+	if start < 0 {
+		return styles
+	}
+	tagEnd := start + strings.IndexByte(styles[start:], '>')
+	closing := strings.Index(styles[start:], "</"+collection+">")
+	if closing < 0 {
+		return styles
+	}
+	body := styles[tagEnd : start+closing]
+	count := strings.Count(body, "<"+element+" ") + strings.Count(body, "<"+element+">")
+	tag := countPattern.ReplaceAllString(styles[start:tagEnd], fmt.Sprintf(`count="%d"`, count))
+	return styles[:start] + tag + styles[tagEnd:]
+}
+
+// detectXlsxSignature looks for the signature in the workbook, the shared
+// strings, the styles and every worksheet.
+func detectXlsxSignature(file, signature string) bool {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if !strings.HasPrefix(f.Name, "xl/") || !strings.HasSuffix(f.Name, ".xml") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err == nil && strings.Contains(string(content), signature) {
+			return true
+		}
+	}
+	return false
+}
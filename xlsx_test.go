@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestXlsxDefinedNamesOrder(t *testing.T) {
+	const sheets = `<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets>`
+	workbooks := []string{
+		sheets + `<calcPr calcId="191029"/>`,
+		sheets + `<functionGroups builtInGroupCount="18"/><calcPr calcId="191029"/>`,
+		sheets + `<functionGroups><functionGroup name="Tools"/></functionGroups><calcPr calcId="191029"/>`,
+		sheets + `<functionGroups builtInGroupCount="18"/><externalReferences><externalReference r:id="rId9"/></externalReferences><calcPr calcId="191029"/>`,
+	}
+	for _, elements := range workbooks {
+		file := filepath.Join(t.TempDir(), "book.xlsx")
+		writeTestZip(t, file, map[string]string{
+			"[Content_Types].xml":        `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"></Types>`,
+			"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="` + xlsxSheetType + `" Target="worksheets/sheet1.xml"/></Relationships>`,
+			"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+				`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` + elements + `</workbook>`,
+			"xl/worksheets/sheet1.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData/></worksheet>`,
+		})
+		if err := addXlsxParts(file, testSignature); err != nil {
+			t.Fatal(err)
+		}
+		workbook, err := readZipFile(file, "xl/workbook.xml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := string(workbook)
+		names := strings.Index(content, "<definedNames>")
+		if names < 0 || names > strings.Index(content, "<calcPr") {
+			t.Errorf("definedNames is out of order: %s", content)
+		}
+		for _, before := range []string{"</sheets>", "<functionGroups", "<externalReferences>"} {
+			if strings.Index(content, before) > names {
+				t.Errorf("definedNames is before %s: %s", before, content)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+)
+
+// Each zero-width character carries two bits of a payload chunk. Chunks are
+// placed after the spaces between words so that every sentence of the document
+// carries a part of the signature.
+var zeroWidthSymbols = []rune{'\u200b', '\u200c', '\u200d', '\u2060'}
+
+const zeroWidthChunkLength = payloadChunkBits / 2
+
+func isZeroWidthText(extension string) bool {
+	switch strings.ToLower(extension) {
+	case ".txt", ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+func isMarkdown(extension string) bool {
+	extension = strings.ToLower(extension)
+	return extension == ".md" || extension == ".markdown"
+}
+
+func addZeroWidthSignature(file, signature string) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		color.Red("Error occurred while reading the text file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if !utf8.Valid(content) {
+		return
+	}
+	payload := signatureBytes(signature)
+	text := string(content)
+	gaps := zeroWidthGaps(text, isMarkdown(filepath.Ext(file)))
+	if payload == nil || len(gaps) == 0 {
+		return
+	}
+	perGap := (payloadSize + len(gaps) - 1) / len(gaps)
+	var out strings.Builder
+	last, chunk := 0, 0
+	for _, gap := range gaps {
+		out.WriteString(text[last:gap])
+		for i := 0; i < perGap; i++ {
+			index := chunk % payloadSize
+			out.WriteString(zeroWidthChunk(payloadChunk(index, payload[index])))
+			chunk++
+		}
+		last = gap
+	}
+	out.WriteString(text[last:])
+	err = ioutil.WriteFile(file, []byte(out.String()), 0644)
+	if err != nil {
+		color.Red("Error occurred while writing the text file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func zeroWidthChunk(chunk uint16) string {
+	var sb strings.Builder
+	for shift := payloadChunkBits - 2; shift >= 0; shift -= 2 {
+		sb.WriteRune(zeroWidthSymbols[(chunk>>uint(shift))&3])
+	}
+	return sb.String()
+}
+
+// zeroWidthGaps returns the byte offsets right after a space that separates
+// two words. Markdown code blocks, code spans, link targets and tags are left
+// untouched so that copied code and URLs keep working.
+func zeroWidthGaps(text string, markdown bool) []int {
+	var gaps []int
+	fenced := false
+	offset := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		start := offset
+		offset += len(line)
+		if markdown {
+			trimmed := strings.TrimLeft(line, " ")
+			if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+				fenced = !fenced
+				continue
+			}
+			if fenced || strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") {
+				continue
+			}
+		}
+		inCode, inLink, inTag := false, false, false
+		for i := 1; i < len(line)-1; i++ {
+			if markdown {
+				switch {
+				case line[i-1] == '`':
+					inCode = !inCode
+				case line[i-1] == '(' && i > 1 && line[i-2] == ']':
+					inLink = true
+				case line[i-1] == ')':
+					inLink = false
+				case line[i-1] == '<':
+					inTag = true
+				case line[i-1] == '>':
+					inTag = false
+				}
+				if inCode || inLink || inTag {
+					continue
+				}
+			}
+			if line[i-1] == ' ' && i > 1 && !isSpaceByte(line[i-2]) && !isSpaceByte(line[i]) {
+				gaps = append(gaps, start+i)
+			}
+		}
+	}
+	return gaps
+}
+
+func isSpaceByte(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+func readZeroWidthSignature(file string) payloadVotes {
+	votes := make(payloadVotes)
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var run []int
+	flush := func() {
+		for len(run) >= zeroWidthChunkLength {
+			var chunk uint16
+			for _, symbol := range run[:zeroWidthChunkLength] {
+				chunk = chunk<<2 | uint16(symbol)
+			}
+			if index, value, ok := parsePayloadChunk(chunk); ok {
+				votes.add(index, value)
+			}
+			run = run[zeroWidthChunkLength:]
+		}
+		run = run[:0]
+	}
+	for _, r := range string(content) {
+		symbol := zeroWidthSymbol(r)
+		if symbol < 0 {
+			flush()
+			continue
+		}
+		run = append(run, symbol)
+	}
+	flush()
+	return votes
+}
+
+func zeroWidthSymbol(r rune) int {
+	for i, symbol := range zeroWidthSymbols {
+		if r == symbol {
+			return i
+		}
+	}
+	return -1
+}
+
+func detectZeroWidthSignature(file, signature string) bool {
+	return readZeroWidthSignature(file).matches(signature)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSignature = "75746b7573656e-0ddb2043-c296-44bf-92c3-9fd0fff65fa7"
+
+func TestZeroWidthRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "notes.md")
+	text := "A paragraph with a few words in it, and a `code span` too.\n\n```\nleave this alone\n```\n" +
+		strings.Repeat("Another line of plain text that can carry the signature.\n", 20)
+	if err := ioutil.WriteFile(file, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addZeroWidthSignature(file, testSignature)
+	content, _ := ioutil.ReadFile(file)
+	if !strings.Contains(string(content), "```\nleave this alone\n```") || !strings.Contains(string(content), "`code span`") {
+		t.Error("code was changed")
+	}
+	if !detectZeroWidthSignature(file, testSignature) {
+		t.Error("signature not found")
+	}
+}
+
+func TestCSVKeepsFieldValues(t *testing.T) {
+	if isZeroWidthText(".csv") {
+		t.Fatal("CSV files must not get zero-width characters")
+	}
+	var sb strings.Builder
+	sb.WriteString("id,name,note\n")
+	for i := 0; i < 200; i++ {
+		if i%7 == 0 {
+			fmt.Fprintf(&sb, "%d,customer %d,\"two\nlines\"\n", i, i)
+		} else {
+			fmt.Fprintf(&sb, "%d,customer %d,plain\n", i, i)
+		}
+	}
+	file := filepath.Join(t.TempDir(), "data.csv")
+	if err := ioutil.WriteFile(file, []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addCSVSignature(file, testSignature)
+	want, _ := csv.NewReader(strings.NewReader(sb.String())).ReadAll()
+	content, _ := ioutil.ReadFile(file)
+	got, err := csv.NewReader(strings.NewReader(string(content))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Error("field values were changed")
+	}
+	if !strings.Contains(string(content), "\"two\nlines\"") {
+		t.Error("line break inside a quoted field was changed")
+	}
+	if !detectCSVSignature(file, testSignature) {
+		t.Error("signature not found")
+	}
+	if detectCSVSignature(file, "75746b7573656e-220a09c3-9f0a-4bdf-b552-1a38b530103e") {
+		t.Error("wrong signature matched")
+	}
+}